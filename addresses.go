@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// address is one of a person's postal addresses. Label is free text such as
+// "home" or "work", and Country is an ISO 3166-1 alpha-2 code.
+type address struct {
+	ID         int    `json:"id"`
+	PersonID   int    `json:"person_id"`
+	Label      string `json:"label,omitempty"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+	Country    string `json:"country"`
+}
+
+// addressRequest is the body of an address create or replace; the IDs come
+// from the path.
+type addressRequest struct {
+	Label      string `json:"label"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
+func (req addressRequest) address() address {
+	return address{
+		Label:      strings.TrimSpace(req.Label),
+		Line1:      strings.TrimSpace(req.Line1),
+		Line2:      strings.TrimSpace(req.Line2),
+		City:       strings.TrimSpace(req.City),
+		Region:     strings.TrimSpace(req.Region),
+		PostalCode: strings.TrimSpace(req.PostalCode),
+		Country:    strings.ToUpper(strings.TrimSpace(req.Country)),
+	}
+}
+
+func validateAddress(a address) error {
+	if a.Line1 == "" {
+		return &validationError{Name: "line1", Reason: "is required"}
+	}
+
+	if a.City == "" {
+		return &validationError{Name: "city", Reason: "is required"}
+	}
+
+	if len(a.Country) != 2 || strings.Trim(a.Country, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return &validationError{Name: "country", Reason: "must be a two letter ISO 3166-1 code"}
+	}
+
+	return nil
+}
+
+func handlePersonAddressesGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	addresses, err := actx.storer.personAddresses(ctx, pathInt(r, "id"))
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	if addresses == nil {
+		addresses = []address{}
+	}
+	writeJSON(w, http.StatusOK, addresses)
+}
+
+func handlePersonAddressesPOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	a, ok := decodeAddress(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	created, err := actx.storer.addAddress(ctx, pathInt(r, "id"), a)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, created)
+}
+
+func handlePersonAddressGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	a, err := actx.storer.addressForID(ctx, pathInt(r, "id"), pathInt(r, "addressID"))
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, *a)
+}
+
+func handlePersonAddressPUT(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	a, ok := decodeAddress(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	updated, err := actx.storer.updateAddress(ctx, pathInt(r, "id"), pathInt(r, "addressID"), a)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+func handlePersonAddressDELETE(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	if err := actx.storer.deleteAddress(ctx, pathInt(r, "id"), pathInt(r, "addressID")); err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// decodeAddress reads and validates an address body, writing the error and
+// returning false when it is no good.
+func decodeAddress(w http.ResponseWriter, r *http.Request) (address, bool) {
+	var req addressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return address{}, false
+	}
+
+	a := req.address()
+	if err := validateAddress(a); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return address{}, false
+	}
+
+	return a, true
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_validateContact(t *testing.T) {
+	for _, tc := range []struct {
+		p     Person
+		field string
+	}{
+		{Person{}, ""},
+		{Person{Email: "bob@example.com", Phone: "+14155550123", DateOfBirth: "1970-01-31"}, ""},
+		{Person{Email: "bob"}, "email"},
+		{Person{Email: "Bob <bob@example.com>"}, "email"},
+		{Person{Phone: "4155550123"}, "phone"},
+		{Person{Phone: "+0123"}, "phone"},
+		{Person{DateOfBirth: "31/01/1970"}, "date_of_birth"},
+		{Person{DateOfBirth: time.Now().AddDate(1, 0, 0).Format(dateLayout)}, "date_of_birth"},
+	} {
+		err := validateContact(tc.p)
+
+		var ve *validationError
+		if tc.field == "" && err != nil {
+			t.Errorf("got error %s for %+v but expected none", err, tc.p)
+		} else if tc.field != "" && (!errors.As(err, &ve) || ve.Name != tc.field) {
+			t.Errorf("got error %v for %+v but expected one for %s", err, tc.p, tc.field)
+		}
+	}
+}
+
+func Test_deriveAge(t *testing.T) {
+	now := time.Date(2024, time.April, 30, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		dob string
+		exp int
+	}{
+		{"1990-04-30", 34},
+		{"1990-05-01", 33},
+		{"2024-04-30", 0},
+		{"", 7},
+	} {
+		p := Person{Age: 7, DateOfBirth: tc.dob}
+		p.deriveAge(now)
+		if p.Age != tc.exp {
+			t.Errorf("got age %d for %q but expected %d", p.Age, tc.dob, tc.exp)
+		}
+	}
+}
+
+func Test_MemoryStoreEmailTaken(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+
+	if _, err := ms.addPerson(ctx, Person{ID: 4, FirstName: "A", LastName: "B", Email: "ab@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.deletePerson(ctx, 4, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Soft deleted people keep their email, whatever its case.
+	_, err := ms.addPerson(ctx, Person{ID: 5, FirstName: "C", LastName: "D", Email: "AB@example.com"})
+	if !errors.Is(err, errEmailTaken) {
+		t.Errorf("got error %v but expected %v", err, errEmailTaken)
+	}
+
+	if _, err := ms.updatePerson(ctx, 1, Person{FirstName: "Bob", LastName: "Barker", Email: "Ab@Example.com"}, 0); !errors.Is(err, errEmailTaken) {
+		t.Errorf("got error %v but expected %v", err, errEmailTaken)
+	}
+
+	p, err := ms.restorePerson(ctx, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Email != "ab@example.com" {
+		t.Errorf("got email %q after restore but expected %q", p.Email, "ab@example.com")
+	}
+}
+
+func Test_handlePersonContact(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	dob := time.Now().AddDate(-30, 0, -1).Format(dateLayout)
+	body := `{"id": 4, "firstname": "Ann", "lastname": "Lee", "age": 99, "email": "ann@example.com", "phone": "+442071234567", "date_of_birth": "` + dob + `"}`
+	res, err := http.Post(server.URL+"/people", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var p Person
+	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+	if p.Age != 30 || p.Email != "ann@example.com" || p.Phone != "+442071234567" || p.DateOfBirth != dob {
+		t.Errorf("got %+v but expected the contact details and an age of 30", p)
+	}
+
+	for _, tc := range []struct {
+		body      string
+		expstatus int
+	}{
+		{`{"id": 5, "firstname": "X", "lastname": "Y", "email": "ANN@example.com"}`, http.StatusConflict},
+		{`{"id": 5, "firstname": "X", "lastname": "Y", "email": "not an email"}`, http.StatusBadRequest},
+		{`{"id": 5, "firstname": "X", "lastname": "Y", "date_of_birth": "tomorrow"}`, http.StatusBadRequest},
+	} {
+		res, err := http.Post(server.URL+"/people", "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("error during http.Post: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.expstatus {
+			t.Errorf("got status %d for %s but expected %d", res.StatusCode, tc.body, tc.expstatus)
+		}
+	}
+}
+
+func Test_handlePersonAddresses(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	do := func(method, path, body string, expstatus int, v any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", method, path, err.Error())
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != expstatus {
+			t.Fatalf("got status %d for %s %s but expected %d", res.StatusCode, method, path, expstatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("error during decode: %s", err.Error())
+			}
+		}
+	}
+
+	var home, work address
+	do("POST", "/people/1/addresses", `{"label": " home ", "line1": "1 Main St", "city": "Springfield", "country": "us"}`, http.StatusOK, &home)
+	do("POST", "/people/1/addresses", `{"label": "work", "line1": "2 Elm St", "city": "Shelbyville", "country": "US"}`, http.StatusOK, &work)
+	exp := address{ID: 1, PersonID: 1, Label: "home", Line1: "1 Main St", City: "Springfield", Country: "US"}
+	if home != exp {
+		t.Errorf("got %+v but expected %+v", home, exp)
+	}
+
+	do("POST", "/people/1/addresses", `{"line1": "1 Main St", "city": "Springfield", "country": "USA"}`, http.StatusBadRequest, nil)
+	do("POST", "/people/99/addresses", `{"line1": "1 Main St", "city": "Springfield", "country": "US"}`, http.StatusNotFound, nil)
+
+	work.City = "Capital City"
+	var updated address
+	do("PUT", "/people/1/addresses/2", `{"label": "work", "line1": "2 Elm St", "city": "Capital City", "country": "US"}`, http.StatusOK, &updated)
+	if updated != work {
+		t.Errorf("got %+v but expected %+v", updated, work)
+	}
+
+	// Addresses belong to one person only.
+	do("GET", "/people/2/addresses/1", "", http.StatusNotFound, nil)
+	do("DELETE", "/people/2/addresses/1", "", http.StatusNotFound, nil)
+
+	do("DELETE", "/people/1/addresses/1", "", http.StatusOK, nil)
+	do("GET", "/people/1/addresses/1", "", http.StatusNotFound, nil)
+
+	var addresses []address
+	do("GET", "/people/1/addresses", "", http.StatusOK, &addresses)
+	if !reflect.DeepEqual(addresses, []address{work}) {
+		t.Errorf("got %+v but expected %+v", addresses, []address{work})
+	}
+
+	// A soft deleted person's addresses are out of reach until they are
+	// restored.
+	do("DELETE", "/people/1", "", http.StatusOK, nil)
+	do("GET", "/people/1/addresses", "", http.StatusNotFound, nil)
+	do("POST", "/people/1:restore", "", http.StatusOK, nil)
+	do("GET", "/people/1/addresses/2", "", http.StatusOK, nil)
+}
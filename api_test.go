@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -15,7 +17,7 @@ import (
 func Test_handlePersonGET(t *testing.T) {
 	expperson := Person{FirstName: "Foo", LastName: "Bar", Age: 22}
 	ss := StorerStub{
-		personForIDStub: func(ctx context.Context, id int) (*Person, error) {
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
 			return &expperson, nil
 		},
 	}
@@ -44,7 +46,7 @@ func Test_handlePersonGET(t *testing.T) {
 		return
 	}
 
-	if p != expperson {
+	if !reflect.DeepEqual(p, expperson) {
 		t.Errorf("got response %v but got %v", p, expperson)
 		return
 	}
@@ -52,7 +54,7 @@ func Test_handlePersonGET(t *testing.T) {
 
 func Test_handlePersonGETBadRequest(t *testing.T) {
 	ss := StorerStub{
-		personForIDStub: func(ctx context.Context, id int) (*Person, error) {
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
 			return &Person{}, nil
 		},
 	}
@@ -72,26 +74,16 @@ func Test_handlePersonGETBadRequest(t *testing.T) {
 		return
 	}
 
-	decoder := json.NewDecoder(res.Body)
 	defer res.Body.Close()
-	var r map[string]string
-	err = decoder.Decode(&r)
-	if err != nil {
-		t.Errorf("error during decode: %s", err.Error())
-		return
-	}
-
-	expmap := map[string]string{"error": "invalid request"}
-
-	if !reflect.DeepEqual(r, expmap) {
-		t.Errorf("got response %v but got %v", r, expmap)
-		return
+	p := decodeProblem(t, res)
+	if p["detail"] != "invalid request" {
+		t.Errorf("got detail %v but expected %q", p["detail"], "invalid request")
 	}
 }
 
 func Test_handlePersonGETBadID(t *testing.T) {
 	ss := StorerStub{
-		personForIDStub: func(ctx context.Context, id int) (*Person, error) {
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
 			return &Person{}, errors.New("Foo Bar")
 		},
 	}
@@ -106,31 +98,21 @@ func Test_handlePersonGETBadID(t *testing.T) {
 		return
 	}
 
-	if res.StatusCode != http.StatusBadRequest {
-		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusInternalServerError)
 		return
 	}
 
-	decoder := json.NewDecoder(res.Body)
 	defer res.Body.Close()
-	var r map[string]string
-	err = decoder.Decode(&r)
-	if err != nil {
-		t.Errorf("error during decode: %s", err.Error())
-		return
-	}
-
-	expmap := map[string]string{"error": "Foo Bar"}
-
-	if !reflect.DeepEqual(r, expmap) {
-		t.Errorf("got response %v but got %v", r, expmap)
-		return
+	p := decodeProblem(t, res)
+	if p["detail"] != "The request could not be completed" {
+		t.Errorf("got detail %v but expected %q", p["detail"], "The request could not be completed")
 	}
 }
 
 func Test_handlePersonGETTimeout(t *testing.T) {
 	ss := StorerStub{
-		personForIDStub: func(ctx context.Context, id int) (*Person, error) {
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
 			type ret struct {
 				person *Person
 				error  error
@@ -164,25 +146,15 @@ func Test_handlePersonGETTimeout(t *testing.T) {
 		return
 	}
 
-	if res.StatusCode != http.StatusBadRequest {
-		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusGatewayTimeout)
 		return
 	}
 
-	decoder := json.NewDecoder(res.Body)
 	defer res.Body.Close()
-	var r map[string]string
-	err = decoder.Decode(&r)
-	if err != nil {
-		t.Errorf("error during decode: %s", err.Error())
-		return
-	}
-
-	expmap := map[string]string{"error": "context deadline exceeded"}
-
-	if !reflect.DeepEqual(r, expmap) {
-		t.Errorf("got response %v but got %v", r, expmap)
-		return
+	p := decodeProblem(t, res)
+	if p["detail"] != "The request timed out" {
+		t.Errorf("got detail %v but expected %q", p["detail"], "The request timed out")
 	}
 }
 
@@ -192,8 +164,13 @@ func Test_handlePeopleGET(t *testing.T) {
 		{FirstName: "Bin", LastName: "Baz", Age: 24},
 	}
 	ss := StorerStub{
-		allPeopleStub: func(ctx context.Context) ([]Person, error) {
-			return exppeople, nil
+		eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+			for _, p := range exppeople {
+				if err := fn(p); err != nil {
+					return err
+				}
+			}
+			return nil
 		},
 	}
 	h := newTestHandler(ss)
@@ -229,8 +206,8 @@ func Test_handlePeopleGET(t *testing.T) {
 
 func Test_handlePeopleGETBadRequest(t *testing.T) {
 	ss := StorerStub{
-		allPeopleStub: func(ctx context.Context) ([]Person, error) {
-			return []Person{}, errors.New("Something went wrong")
+		eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+			return errors.New("Something went wrong")
 		},
 	}
 	h := newTestHandler(ss)
@@ -244,26 +221,93 @@ func Test_handlePeopleGETBadRequest(t *testing.T) {
 		return
 	}
 
-	if res.StatusCode != http.StatusBadRequest {
-		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusInternalServerError)
 		return
 	}
 
-	decoder := json.NewDecoder(res.Body)
 	defer res.Body.Close()
-	var r map[string]string
-	err = decoder.Decode(&r)
+	p := decodeProblem(t, res)
+	if p["detail"] != "The request could not be completed" {
+		t.Errorf("got detail %v but expected %q", p["detail"], "The request could not be completed")
+	}
+}
+
+func Test_handlePeopleGETEmpty(t *testing.T) {
+	ss := StorerStub{
+		eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+			return nil
+		},
+	}
+	h := newTestHandler(ss)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/people")
 	if err != nil {
-		t.Errorf("error during decode: %s", err.Error())
+		t.Errorf("error during http.Get: %s", err.Error())
+		return
+	}
+
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Errorf("error reading body: %s", err.Error())
 		return
 	}
 
-	expmap := map[string]string{"error": "Something went wrong"}
+	if string(b) != "[]\n" {
+		t.Errorf("got body %q but expected %q", string(b), "[]\n")
+	}
+}
+
+func Test_handlePeopleGETClientDisconnect(t *testing.T) {
+	done := make(chan error, 1)
+	ss := StorerStub{
+		eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+			for i := 0; ; i++ {
+				if err := ctx.Err(); err != nil {
+					done <- err
+					return err
+				}
+				if err := fn(Person{ID: i, FirstName: "Foo", LastName: "Bar"}); err != nil {
+					done <- err
+					return err
+				}
+			}
+		},
+	}
+	actx := AppContext{
+		storer:  ss,
+		timeout: time.Minute,
+		logger:  noopLogger{},
+	}
+
+	server := httptest.NewServer(NewHandler(actx))
+	defer server.Close()
 
-	if !reflect.DeepEqual(r, expmap) {
-		t.Errorf("got response %v but got %v", r, expmap)
+	res, err := http.Get(server.URL + "/people")
+	if err != nil {
+		t.Errorf("error during http.Get: %s", err.Error())
 		return
 	}
+
+	b := make([]byte, 1024)
+	if _, err := io.ReadFull(res.Body, b); err != nil {
+		t.Errorf("error reading body: %s", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected listing to stop with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("listing did not stop after the client disconnected")
+	}
 }
 
 func Test_handlePeoplePOST(t *testing.T) {
@@ -334,32 +378,22 @@ func Test_handlePeoplePOSTBadRequest(t *testing.T) {
 		return
 	}
 
-	if res.StatusCode != http.StatusBadRequest {
-		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusInternalServerError)
 		return
 	}
 
-	var resm map[string]string
-	decoder := json.NewDecoder(res.Body)
 	defer res.Body.Close()
-	err = decoder.Decode(&resm)
-	if err != nil {
-		t.Errorf("error during decode: %s", err.Error())
-		return
-	}
-
-	expm := map[string]string{"error": "Something went wrong"}
-
-	if !reflect.DeepEqual(expm, resm) {
-		t.Errorf("got response %v but got %v", expm, resm)
-		return
+	p := decodeProblem(t, res)
+	if p["detail"] != "The request could not be completed" {
+		t.Errorf("got detail %v but expected %q", p["detail"], "The request could not be completed")
 	}
 }
 
 func Test_handlePersonsPUT(t *testing.T) {
 	expperson := Person{FirstName: "Foo", LastName: "Bar", Age: 22}
 	ss := StorerStub{
-		updatePersonStub: func(ctx context.Context, id int, p Person) (Person, error) {
+		updatePersonStub: func(ctx context.Context, id int, p Person, version int) (Person, error) {
 			return expperson, nil
 		},
 	}
@@ -407,7 +441,7 @@ func Test_handlePersonsPUT(t *testing.T) {
 func Test_handlePersonsPUTBadRequest(t *testing.T) {
 	expperson := Person{FirstName: "Foo", LastName: "Bar", Age: 22}
 	ss := StorerStub{
-		updatePersonStub: func(ctx context.Context, id int, p Person) (Person, error) {
+		updatePersonStub: func(ctx context.Context, id int, p Person, version int) (Person, error) {
 			return expperson, nil
 		},
 	}
@@ -437,26 +471,16 @@ func Test_handlePersonsPUTBadRequest(t *testing.T) {
 		return
 	}
 
-	var m map[string]string
-	decoder := json.NewDecoder(res.Body)
 	defer res.Body.Close()
-	err = decoder.Decode(&m)
-	if err != nil {
-		t.Errorf("error during decode: %s", err.Error())
-		return
-	}
-
-	expm := map[string]string{"error": "invalid request"}
-
-	if !reflect.DeepEqual(m, expm) {
-		t.Errorf("got response %v but got %v", m, expm)
-		return
+	p := decodeProblem(t, res)
+	if p["detail"] != "invalid request" {
+		t.Errorf("got detail %v but expected %q", p["detail"], "invalid request")
 	}
 }
 
 func Test_handlePersonDELETE(t *testing.T) {
 	ss := StorerStub{
-		deletePersonStub: func(ctx context.Context, id int) error {
+		deletePersonStub: func(ctx context.Context, id int, version int) error {
 			return nil
 		},
 	}
@@ -493,12 +517,295 @@ func Test_handlePersonDELETE(t *testing.T) {
 	}
 }
 
+func Test_handlePersonGETETag(t *testing.T) {
+	ss := StorerStub{
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
+			return &Person{ID: id, FirstName: "Foo", Version: 3}, nil
+		},
+	}
+	h := newTestHandler(ss)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/people/1")
+	if err != nil {
+		t.Errorf("error during http.Get: %s", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	if got := res.Header.Get("ETag"); got != `"3"` {
+		t.Errorf("got ETag %s but expected %s", got, `"3"`)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/people/1", nil)
+	if err != nil {
+		t.Errorf("New request error: %s", err.Error())
+		return
+	}
+	req.Header.Set("If-None-Match", `W/"3"`)
+
+	cli := &http.Client{}
+	res, err = cli.Do(req)
+	if err != nil {
+		t.Errorf("Error during cli.Do: %s", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusNotModified)
+	}
+}
+
+func Test_handlePersonPUTIfMatch(t *testing.T) {
+	var gotVersion int
+	ss := StorerStub{
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
+			return &Person{ID: id, Version: 2}, nil
+		},
+		updatePersonStub: func(ctx context.Context, id int, p Person, version int) (Person, error) {
+			gotVersion = version
+			p.Version = version + 1
+			return p, nil
+		},
+	}
+	h := newTestHandler(ss)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		ifMatch    string
+		expstatus  int
+		expversion int
+	}{
+		{ifMatch: `"2"`, expstatus: http.StatusOK, expversion: 2},
+		{ifMatch: `"1"`, expstatus: http.StatusPreconditionFailed},
+		{ifMatch: `W/"2"`, expstatus: http.StatusPreconditionFailed},
+		{ifMatch: `"1", "2"`, expstatus: http.StatusOK, expversion: 2},
+		{ifMatch: "*", expstatus: http.StatusOK, expversion: 2},
+		{ifMatch: "", expstatus: http.StatusOK, expversion: 0},
+	}
+
+	for _, tt := range tests {
+		gotVersion = -1
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/people/1", strings.NewReader(`{"firstname": "Foo"}`))
+		if err != nil {
+			t.Errorf("New request error: %s", err.Error())
+			return
+		}
+		if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		cli := &http.Client{}
+		res, err := cli.Do(req)
+		if err != nil {
+			t.Errorf("Error during cli.Do: %s", err.Error())
+			return
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tt.expstatus {
+			t.Errorf("If-Match %s: got status %d but expected %d", tt.ifMatch, res.StatusCode, tt.expstatus)
+			continue
+		}
+
+		if tt.expstatus == http.StatusOK && gotVersion != tt.expversion {
+			t.Errorf("If-Match %s: got version %d but expected %d", tt.ifMatch, gotVersion, tt.expversion)
+		}
+	}
+}
+
+func Test_handlePersonPATCH(t *testing.T) {
+	ss := StorerStub{
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
+			return &Person{ID: id, FirstName: "Foo", LastName: "Bar", Age: 22, Version: 4}, nil
+		},
+		updatePersonStub: func(ctx context.Context, id int, p Person, version int) (Person, error) {
+			if version != 4 {
+				return p, errVersionMismatch
+			}
+			p.Version = version + 1
+			return p, nil
+		},
+	}
+	h := newTestHandler(ss)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPatch, server.URL+"/people/7", strings.NewReader(`{"age": 23}`))
+	if err != nil {
+		t.Errorf("New request error: %s", err.Error())
+		return
+	}
+
+	cli := &http.Client{}
+	res, err := cli.Do(req)
+	if err != nil {
+		t.Errorf("Error during cli.Do: %s", err.Error())
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+		return
+	}
+
+	var p Person
+	decoder := json.NewDecoder(res.Body)
+	defer res.Body.Close()
+	if err := decoder.Decode(&p); err != nil {
+		t.Errorf("error during decode: %s", err.Error())
+		return
+	}
+
+	expperson := Person{ID: 7, FirstName: "Foo", LastName: "Bar", Age: 23, Version: 5}
+	if !reflect.DeepEqual(p, expperson) {
+		t.Errorf("got response %v but expected %v", p, expperson)
+	}
+
+	if got := res.Header.Get("ETag"); got != `"5"` {
+		t.Errorf("got ETag %s but expected %s", got, `"5"`)
+	}
+}
+
+func Test_handlePersonDELETEPreconditionFailed(t *testing.T) {
+	ss := StorerStub{
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
+			return &Person{ID: id, Version: 2}, nil
+		},
+		deletePersonStub: func(ctx context.Context, id int, version int) error {
+			t.Errorf("deletePerson should not be called")
+			return nil
+		},
+	}
+	h := newTestHandler(ss)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/people/1", nil)
+	if err != nil {
+		t.Errorf("New request error: %s", err.Error())
+		return
+	}
+	req.Header.Set("If-Match", `"1"`)
+
+	cli := &http.Client{}
+	res, err := cli.Do(req)
+	if err != nil {
+		t.Errorf("Error during cli.Do: %s", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusPreconditionFailed)
+	}
+}
+
 func newTestHandler(ss Storer) http.Handler {
 	actx := AppContext{
-		storer:  ss,
-		timeout: 30 * time.Millisecond,
-		logger:  noopLogger{},
+		storer:         ss,
+		timeout:        30 * time.Millisecond,
+		idempotencyTTL: time.Minute,
+		logger:         noopLogger{},
 	}
 
 	return NewHandler(actx)
 }
+
+func Test_handlePeopleGETIdleTimeout(t *testing.T) {
+	slow := func(first time.Duration) StorerStub {
+		return StorerStub{
+			eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+				for i, wait := range []time.Duration{first, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond} {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					if err := fn(Person{ID: i, FirstName: "Foo", LastName: "Bar"}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+
+	// Every row arrives within the 30ms timeout, but not all of them do.
+	server := httptest.NewServer(newTestHandler(slow(10 * time.Millisecond)))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/people")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	var people []Person
+	err = json.NewDecoder(res.Body).Decode(&people)
+	res.Body.Close()
+	if err != nil || len(people) != 5 {
+		t.Errorf("got %d people and error %v but expected all 5", len(people), err)
+	}
+
+	idle := httptest.NewServer(newTestHandler(slow(time.Second)))
+	defer idle.Close()
+
+	res, err = http.Get(idle.URL + "/people")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusGatewayTimeout)
+	}
+}
+
+func Test_shutdownFinishesRequests(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error during net.Listen: %s", err.Error())
+	}
+
+	started := make(chan struct{})
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})}
+	go s.Serve(lis)
+
+	gs := newGRPCServer(&AppContext{storer: StorerStub{}, timeout: time.Second, logger: noopLogger{}})
+	glis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error during net.Listen: %s", err.Error())
+	}
+	go gs.Serve(glis)
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + lis.Addr().String())
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+
+	<-started
+	shutdown(s, gs, time.Second)
+
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("got status %d for the request in flight but expected %d", got, http.StatusOK)
+	}
+	if _, err := http.Get("http://" + lis.Addr().String()); err == nil {
+		t.Errorf("expected no requests to be served after shutdown")
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// attributes are a person's custom fields, a JSON object whose keys each
+// team picks for itself. A key can have an attributeSchema its values must
+// satisfy; keys without one take any value.
+type attributes map[string]any
+
+// attributeKey is the form of an attribute key, which keeps keys usable in
+// the attr.<key> filters of GET /people.
+var attributeKey = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,63}$`)
+
+func (a attributes) clone() attributes {
+	if a == nil {
+		return nil
+	}
+
+	c := make(attributes, len(a))
+	for k, v := range a {
+		c[k] = v
+	}
+
+	return c
+}
+
+// xmlAttribute is an attribute in XML, with its value as JSON text.
+type xmlAttribute struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// MarshalXML writes each attribute as an <attribute key="..."> element
+// holding its value as JSON, since XML has no map of its own.
+func (a attributes) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := make([]xmlAttribute, len(keys))
+	for i, k := range keys {
+		b, err := json.Marshal(a[k])
+		if err != nil {
+			return err
+		}
+		items[i] = xmlAttribute{Key: k, Value: string(b)}
+	}
+
+	return e.EncodeElement(struct {
+		Items []xmlAttribute `xml:"attribute"`
+	}{items}, start)
+}
+
+// UnmarshalXML reads the elements MarshalXML writes, merging them into a
+// like JSON does. A value that isn't JSON is taken as a string.
+func (a *attributes) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v struct {
+		Items []xmlAttribute `xml:"attribute"`
+	}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+
+	if *a == nil {
+		*a = attributes{}
+	}
+	for _, item := range v.Items {
+		var value any
+		if err := json.Unmarshal([]byte(item.Value), &value); err != nil {
+			value = item.Value
+		}
+		(*a)[item.Key] = value
+	}
+
+	return nil
+}
+
+// attributeSchema is the JSON Schema the values of an attribute key must
+// satisfy. It applies to writes made after it is set; values already stored
+// are left as they are.
+type attributeSchema struct {
+	Key       string          `json:"key"`
+	Schema    json.RawMessage `json:"schema"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// compile checks the schema and prepares it for validating values. Schemas
+// have to be self-contained: a $ref to anything outside them fails rather
+// than being fetched.
+func (s attributeSchema) compile() (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	c.AssertFormat = true
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("%s is not part of the schema", url)
+	}
+
+	url := "attributes/" + s.Key + ".json"
+	if err := c.AddResource(url, strings.NewReader(string(s.Schema))); err != nil {
+		return nil, err
+	}
+
+	return c.Compile(url)
+}
+
+// checkAttributes validates attrs against the schemas for their keys and
+// returns them as JSON values, the way every encoding reads them back. Null
+// values are dropped, so a PATCH can remove an attribute by setting it to
+// null.
+func checkAttributes(attrs attributes, schemas []attributeSchema) (attributes, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, &validationError{Name: "attributes", Reason: "must be a JSON object"}
+	}
+
+	var values map[string]any
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(values))
+	for k, v := range values {
+		if v == nil {
+			delete(values, k)
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bySchema := map[string]attributeSchema{}
+	for _, s := range schemas {
+		bySchema[s.Key] = s
+	}
+
+	for _, k := range keys {
+		if !attributeKey.MatchString(k) {
+			return nil, &validationError{Name: "attributes." + k, Reason: "is not a valid key: use up to 64 letters, digits, _ and -, starting with a letter"}
+		}
+
+		s, ok := bySchema[k]
+		if !ok {
+			continue
+		}
+
+		compiled, err := s.compile()
+		if err != nil {
+			return nil, fmt.Errorf("compiling the schema of attribute %s: %w", k, err)
+		}
+		if err := compiled.Validate(values[k]); err != nil {
+			return nil, &validationError{Name: "attributes." + k, Reason: schemaErrorReason(err)}
+		}
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return attributes(values), nil
+}
+
+// schemaErrorReason describes the first thing wrong with a value that failed
+// its schema, and where in the value it is.
+func schemaErrorReason(err error) string {
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err.Error()
+	}
+
+	for len(ve.Causes) > 0 {
+		ve = ve.Causes[0]
+	}
+	if ve.InstanceLocation != "" {
+		return ve.InstanceLocation + ": " + ve.Message
+	}
+
+	return ve.Message
+}
+
+// attributeFilterValues are the values a filter attr.<key>=value matches:
+// the string itself, and the number or boolean it spells if it is one.
+func attributeFilterValues(value string) []any {
+	values := []any{value}
+
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err == nil {
+		switch v.(type) {
+		case float64, bool:
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// attributesMatch reports whether attrs has every attribute in filter, as
+// attributeFilterValues reads the filter's values.
+func attributesMatch(attrs attributes, filter map[string]string) bool {
+	for k, value := range filter {
+		found := false
+		for _, v := range attributeFilterValues(value) {
+			found = found || reflect.DeepEqual(attrs[k], v)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// keepAttributes gives p the attributes stored for the person with id, for
+// the full updates of gRPC and GraphQL, which can't carry attributes and
+// would otherwise erase them. It returns the version to update against:
+// version, or the version read when version is 0, so that attributes
+// changed in the meantime fail the update rather than being undone.
+func keepAttributes(ctx context.Context, s Storer, id int, p Person, version int) (Person, int, error) {
+	current, err := s.personForID(ctx, id, personQuery{})
+	if err != nil {
+		return p, version, err
+	}
+
+	p.Attributes = current.Attributes
+	if version == 0 {
+		version = current.Version
+	}
+
+	return p, version, nil
+}
+
+func handleAttributeSchemasGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	schemas, err := actx.storer.attributeSchemas(ctx)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	if schemas == nil {
+		schemas = []attributeSchema{}
+	}
+	writeJSON(w, http.StatusOK, schemas)
+}
+
+func handleAttributeSchemaGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	s, err := actx.storer.attributeSchemaForKey(ctx, pathParam(r, "key"))
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, *s)
+}
+
+// handleAttributeSchemaPUT sets the schema of an attribute key, replacing
+// any it had.
+func handleAttributeSchemaPUT(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Schema json.RawMessage `json:"schema"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	s := attributeSchema{Key: pathParam(r, "key"), Schema: req.Schema}
+	if !attributeKey.MatchString(s.Key) {
+		writeError(w, r, http.StatusBadRequest, &validationError{Name: "key", Reason: "must be up to 64 letters, digits, _ and -, starting with a letter"})
+		return
+	}
+	if len(s.Schema) == 0 {
+		writeError(w, r, http.StatusBadRequest, &validationError{Name: "schema", Reason: "is required"})
+		return
+	}
+	if _, err := s.compile(); err != nil {
+		writeError(w, r, http.StatusBadRequest, &validationError{Name: "schema", Reason: "is not a valid JSON Schema: " + schemaErrorReason(err)})
+		return
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	saved, err := actx.storer.putAttributeSchema(ctx, s)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, saved)
+}
+
+func handleAttributeSchemaDELETE(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	if err := actx.storer.deleteAttributeSchema(ctx, pathParam(r, "key")); err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
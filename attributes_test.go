@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_checkAttributes(t *testing.T) {
+	schemas := []attributeSchema{
+		{Key: "level", Schema: json.RawMessage(`{"type": "integer", "minimum": 1}`)},
+		{Key: "tags", Schema: json.RawMessage(`{"type": "array", "items": {"type": "string"}}`)},
+	}
+
+	for _, tc := range []struct {
+		attrs attributes
+		exp   attributes
+		field string
+	}{
+		{nil, nil, ""},
+		{attributes{"gone": nil}, nil, ""},
+		// Values come back as JSON would read them.
+		{attributes{"level": 2, "team": map[string]any{"size": int64(4)}}, attributes{"level": 2.0, "team": map[string]any{"size": 4.0}}, ""},
+		{attributes{"tags": []any{"a", "b"}, "gone": nil}, attributes{"tags": []any{"a", "b"}}, ""},
+		{attributes{"level": 0}, nil, "attributes.level"},
+		{attributes{"level": "high"}, nil, "attributes.level"},
+		{attributes{"tags": []any{"a", 1}}, nil, "attributes.tags"},
+		{attributes{"has space": 1}, nil, "attributes.has space"},
+	} {
+		got, err := checkAttributes(tc.attrs, schemas)
+
+		var ve *validationError
+		if tc.field != "" {
+			if !errors.As(err, &ve) || ve.Name != tc.field {
+				t.Errorf("got error %v for %v but expected one for %s", err, tc.attrs, tc.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("got error %s for %v but expected none", err, tc.attrs)
+		} else if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("got %#v for %v but expected %#v", got, tc.attrs, tc.exp)
+		}
+	}
+}
+
+func Test_attributeSchemaNoRemoteRefs(t *testing.T) {
+	s := attributeSchema{Key: "remote", Schema: json.RawMessage(`{"$ref": "file:///etc/passwd"}`)}
+	if _, err := s.compile(); err == nil {
+		t.Errorf("got no error compiling a schema with a remote $ref")
+	}
+}
+
+func Test_attributesMatch(t *testing.T) {
+	attrs := attributes{"department": "eng", "level": 3.0, "remote": true, "code": "7"}
+	for _, tc := range []struct {
+		filter map[string]string
+		exp    bool
+	}{
+		{nil, true},
+		{map[string]string{"department": "eng"}, true},
+		{map[string]string{"department": "Eng"}, false},
+		{map[string]string{"department": "eng", "level": "3"}, true},
+		{map[string]string{"level": "4"}, false},
+		{map[string]string{"remote": "true"}, true},
+		{map[string]string{"code": "7"}, true},
+		{map[string]string{"missing": "x"}, false},
+	} {
+		if got := attributesMatch(attrs, tc.filter); got != tc.exp {
+			t.Errorf("got %t for %v but expected %t", got, tc.filter, tc.exp)
+		}
+	}
+}
+
+func Test_attributesCodecs(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	p, err := ms.updatePerson(ctx, 1, Person{FirstName: "Bob", LastName: "Barker", Attributes: attributes{
+		"department": "eng",
+		"level":      3,
+		"manager":    map[string]any{"id": 2, "remote": true},
+	}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every codec reads back the attributes it writes.
+	for _, c := range codecs {
+		var buf bytes.Buffer
+		if err := c.encode(&buf, p); err != nil {
+			t.Fatalf("error encoding %s: %s", c.mediaType, err)
+		}
+
+		var got Person
+		if err := c.decode(buf.Bytes(), &got); err != nil {
+			t.Fatalf("error decoding %s: %s", c.mediaType, err)
+		}
+
+		attrs, err := checkAttributes(got.Attributes, nil)
+		if err != nil {
+			t.Fatalf("error checking %s attributes: %s", c.mediaType, err)
+		}
+		if !reflect.DeepEqual(attrs, p.Attributes) {
+			t.Errorf("got %#v from %s but expected %#v", attrs, c.mediaType, p.Attributes)
+		}
+	}
+}
+
+func Test_handlePeopleAttributes(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	do := func(method, path, body string, expstatus int) []byte {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", method, path, err.Error())
+		}
+		defer res.Body.Close()
+
+		var buf bytes.Buffer
+		buf.ReadFrom(res.Body)
+		if res.StatusCode != expstatus {
+			t.Fatalf("got status %d for %s %s but expected %d: %s", res.StatusCode, method, path, expstatus, buf.String())
+		}
+
+		return buf.Bytes()
+	}
+
+	do("PUT", "/admin/attributes/level", `{"schema": {"type": "integer", "minimum": 1}}`, http.StatusOK)
+	do("PATCH", "/people/1", `{"attributes": {"department": "eng", "level": 2}}`, http.StatusOK)
+	do("PATCH", "/people/2", `{"attributes": {"department": "eng", "level": 3}}`, http.StatusOK)
+	do("PATCH", "/people/3", `{"attributes": {"department": "ops"}}`, http.StatusOK)
+
+	body := do("PATCH", "/people/3", `{"attributes": {"level": "senior"}}`, http.StatusBadRequest)
+	var prob struct {
+		InvalidParams []validationError `json:"invalid_params"`
+	}
+	json.Unmarshal(body, &prob)
+	if len(prob.InvalidParams) != 1 || prob.InvalidParams[0].Name != "attributes.level" {
+		t.Errorf("got problem %s but expected attributes.level to be invalid", body)
+	}
+
+	// A patch merges attributes, and null removes one.
+	var patched Person
+	json.Unmarshal(do("PATCH", "/people/1", `{"attributes": {"level": null, "remote": true}}`, http.StatusOK), &patched)
+	exp := attributes{"department": "eng", "remote": true}
+	if !reflect.DeepEqual(patched.Attributes, exp) {
+		t.Errorf("got attributes %v but expected %v", patched.Attributes, exp)
+	}
+
+	for _, tc := range []struct {
+		query  string
+		expids []int
+	}{
+		{"?attr.department=eng", []int{2, 1}},
+		{"?attr.department=eng&attr.level=3", []int{2}},
+		{"?attr.remote=true", []int{1}},
+		{"?attr.department=sales", []int{}},
+	} {
+		var people []Person
+		json.Unmarshal(do("GET", "/people"+tc.query, "", http.StatusOK), &people)
+
+		ids := []int{}
+		for _, p := range people {
+			ids = append(ids, p.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.expids) {
+			t.Errorf("got %v for %s but expected %v", ids, tc.query, tc.expids)
+		}
+	}
+
+	do("GET", "/people?attr.=x", "", http.StatusBadRequest)
+	do("PUT", "/admin/attributes/bad.key", `{"schema": {}}`, http.StatusBadRequest)
+	do("PUT", "/admin/attributes/level", `{}`, http.StatusBadRequest)
+	do("DELETE", "/admin/attributes/level", "", http.StatusOK)
+	do("DELETE", "/admin/attributes/level", "", http.StatusNotFound)
+	do("PATCH", "/people/3", `{"attributes": {"level": "senior"}}`, http.StatusOK)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+	auditPurge   = "purge"
+)
+
+// auditEvent records a single change to a person. Before is nil for a
+// create and After is nil for a delete.
+type auditEvent struct {
+	ID        int       `json:"id"`
+	PersonID  int       `json:"person_id"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	RequestID string    `json:"request_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Before    *Person   `json:"before"`
+	After     *Person   `json:"after"`
+}
+
+// auditInfo is who made a change and as part of which request.
+type auditInfo struct {
+	Actor     string
+	RequestID string
+}
+
+func auditInfoFromContext(ctx context.Context) auditInfo {
+	return auditInfo{
+		Actor:     actorFromContext(ctx),
+		RequestID: requestIDFromContext(ctx),
+	}
+}
+
+// handlePersonHistoryGET returns the changes made to a person, oldest first.
+func handlePersonHistoryGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	events, err := actx.storer.personHistory(ctx, id)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	if events == nil {
+		events = []auditEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
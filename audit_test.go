@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_handlePersonHistoryGET(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPost, "/people", `{"id": 10, "firstname": "Foo", "lastname": "Bar", "age": 22}`},
+		{http.MethodPut, "/people/10", `{"firstname": "Foo", "lastname": "Baz", "age": 23}`},
+		{http.MethodDelete, "/people/10", ""},
+	}
+
+	cli := &http.Client{}
+	for i, tt := range requests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("New request error: %s", err.Error())
+		}
+		req.Header.Set("X-Actor", "alice")
+		req.Header.Set("X-Request-ID", "req-"+string(rune('a'+i)))
+
+		res, err := cli.Do(req)
+		if err != nil {
+			t.Fatalf("Error during cli.Do: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: got status %d but expected %d", tt.method, tt.path, res.StatusCode, http.StatusOK)
+		}
+	}
+
+	res, err := http.Get(server.URL + "/people/10/history")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var events []auditEvent
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&events); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	expactions := []string{auditCreate, auditUpdate, auditDelete}
+	if len(events) != len(expactions) {
+		t.Fatalf("got %d events but expected %d", len(events), len(expactions))
+	}
+
+	for i, e := range events {
+		if e.Action != expactions[i] || e.Actor != "alice" || e.RequestID != "req-"+string(rune('a'+i)) {
+			t.Errorf("event %d: got %s by %s in %s", i, e.Action, e.Actor, e.RequestID)
+		}
+	}
+
+	if events[0].Before != nil || events[0].After == nil || events[0].After.LastName != "Bar" {
+		t.Errorf("got create snapshots %v and %v", events[0].Before, events[0].After)
+	}
+
+	if events[1].Before.LastName != "Bar" || events[1].After.LastName != "Baz" || events[1].After.Version != 2 {
+		t.Errorf("got update snapshots %v and %v", events[1].Before, events[1].After)
+	}
+
+	if events[2].Before == nil || events[2].Before.DeletedAt != nil || events[2].After == nil || events[2].After.DeletedAt == nil {
+		t.Errorf("got delete snapshots %v and %v", events[2].Before, events[2].After)
+	}
+}
+
+func Test_requestMwGeneratesRequestID(t *testing.T) {
+	h := newTestHandler(StorerStub{})
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if len(res.Header.Get("X-Request-ID")) != 32 {
+		t.Errorf("got X-Request-ID %q but expected a generated ID", res.Header.Get("X-Request-ID"))
+	}
+}
+
+func Test_callerRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		id   string
+		kept bool
+	}{
+		{"req-1", true},
+		{strings.Repeat("a", maxRequestIDLength), true},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+		{"two words", false},
+		{"line\nbreak", false},
+		{"café", false},
+		{"", false},
+	} {
+		got := callerRequestID(tc.id)
+		if kept := got == tc.id; kept != tc.kept {
+			t.Errorf("got %q for %q but expected it kept: %t", got, tc.id, tc.kept)
+		}
+		if !tc.kept && len(got) != 32 {
+			t.Errorf("got %q for %q but expected a generated ID", got, tc.id)
+		}
+	}
+}
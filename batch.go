@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	batchCreate = "create"
+	batchUpdate = "update"
+	batchDelete = "delete"
+
+	batchAtomic     = "atomic"
+	batchBestEffort = "best_effort"
+
+	maxBatchOperations = 10000
+)
+
+var errBatchAborted = errors.New("Batch was rolled back")
+
+// batchOperation is a single create, update or delete in a batch request.
+// Version has the same meaning as for updatePerson and deletePerson.
+type batchOperation struct {
+	Op      string `json:"op"`
+	ID      int    `json:"id,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Person  Person `json:"person"`
+}
+
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchResult is the outcome of the operation at Index. Stores fill in Err;
+// the handler turns it into Status and Error.
+type batchResult struct {
+	Index  int     `json:"index"`
+	Op     string  `json:"op"`
+	Status int     `json:"status"`
+	Person *Person `json:"person,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	Err    error   `json:"-"`
+}
+
+type batchResponse struct {
+	Mode    string        `json:"mode"`
+	Applied bool          `json:"applied"`
+	Results []batchResult `json:"results"`
+}
+
+// handlePeopleBatchPOST applies a list of operations. In atomic mode either
+// every operation is applied or none is; in best_effort mode each operation
+// succeeds or fails on its own and the response reports each outcome.
+func handlePeopleBatchPOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var br batchRequest
+	if err := decoder.Decode(&br); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if br.Mode == "" {
+		br.Mode = batchAtomic
+	}
+
+	if err := validateBatch(br); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	atomic := br.Mode == batchAtomic
+	results, err := actx.storer.applyBatch(ctx, br.Operations, atomic)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	failed := false
+	for _, res := range results {
+		if res.Err != nil {
+			failed = true
+		}
+	}
+
+	for i := range results {
+		res := &results[i]
+		if res.Err == nil && atomic && failed {
+			res.Err = errBatchAborted
+			res.Person = nil
+		}
+
+		res.Status = http.StatusOK
+		if res.Err != nil {
+			res.Status = batchStatus(res.Err)
+			res.Error = clientErrorMessage(actx, r, res.Err)
+		}
+	}
+
+	// A rolled back batch is a problem that still carries every result, so
+	// clients can see which operations failed.
+	if atomic && failed {
+		p := newProblem(r, http.StatusBadRequest, errBatchAborted)
+		p.Extensions = map[string]any{"mode": br.Mode, "applied": false, "results": results}
+		writeProblem(w, p)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, batchResponse{
+		Mode:    br.Mode,
+		Applied: true,
+		Results: results,
+	})
+}
+
+func validateBatch(br batchRequest) error {
+	if br.Mode != batchAtomic && br.Mode != batchBestEffort {
+		return fmt.Errorf("Unknown batch mode: %q", br.Mode)
+	}
+
+	if len(br.Operations) == 0 {
+		return errors.New("Batch has no operations")
+	}
+
+	if len(br.Operations) > maxBatchOperations {
+		return fmt.Errorf("Batch has more than %d operations", maxBatchOperations)
+	}
+
+	for i, op := range br.Operations {
+		switch op.Op {
+		case batchCreate:
+		case batchUpdate, batchDelete:
+			if op.ID <= 0 {
+				return fmt.Errorf("Operation %d: %s requires an id", i, op.Op)
+			}
+		default:
+			return fmt.Errorf("Operation %d: unknown op %q", i, op.Op)
+		}
+
+		if err := validateContact(op.Person); err != nil {
+			return fmt.Errorf("Operation %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+func batchStatus(err error) int {
+	switch {
+	case errors.Is(err, errBatchAborted):
+		return http.StatusFailedDependency
+	case errors.Is(err, errPersonNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, errEmailTaken):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postBatch(t *testing.T, url string, body string) (*http.Response, batchResponse) {
+	res, err := http.Post(url+"/people:batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var br batchResponse
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&br); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return res, br
+}
+
+func Test_handlePeopleBatchAtomic(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := `{"operations": [
+		{"op": "create", "person": {"id": 10, "firstname": "Foo", "lastname": "Bar", "age": 22}},
+		{"op": "update", "id": 2, "person": {"firstname": "Wilma", "lastname": "Flintstone", "age": 40}},
+		{"op": "delete", "id": 99}
+	]}`
+	res, br := postBatch(t, server.URL, body)
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	if br.Applied {
+		t.Errorf("expected atomic batch with a failure not to be applied")
+	}
+
+	expstatuses := []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound}
+	for i, res := range br.Results {
+		if res.Status != expstatuses[i] {
+			t.Errorf("operation %d: got status %d but expected %d", i, res.Status, expstatuses[i])
+		}
+	}
+
+	if len(ms.tenants[defaultTenant].people) != 3 || ms.tenants[defaultTenant].people[1].FirstName != "Fred" {
+		t.Errorf("expected store to be unchanged, got %v", ms.tenants[defaultTenant].people)
+	}
+}
+
+func Test_handlePeopleBatchBestEffort(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := `{"mode": "best_effort", "operations": [
+		{"op": "create", "person": {"id": 10, "firstname": "Foo", "lastname": "Bar", "age": 22}},
+		{"op": "update", "id": 2, "version": 5, "person": {"firstname": "Wilma"}},
+		{"op": "delete", "id": 3}
+	]}`
+	res, br := postBatch(t, server.URL, body)
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	expstatuses := []int{http.StatusOK, http.StatusPreconditionFailed, http.StatusOK}
+	for i, res := range br.Results {
+		if res.Status != expstatuses[i] {
+			t.Errorf("operation %d: got status %d but expected %d", i, res.Status, expstatuses[i])
+		}
+	}
+
+	if br.Results[0].Person == nil || br.Results[0].Person.Version != 1 {
+		t.Errorf("expected created person in result, got %v", br.Results[0].Person)
+	}
+
+	ids := []int{}
+	for _, p := range ms.tenants[defaultTenant].people {
+		if p.DeletedAt == nil {
+			ids = append(ids, p.ID)
+		}
+	}
+	if len(ids) != 3 || ids[2] != 10 {
+		t.Errorf("got people %v but expected ids 1, 2 and 10", ids)
+	}
+}
+
+func Test_handlePeopleBatchInvalid(t *testing.T) {
+	h := newTestHandler(StorerStub{})
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	bodies := []string{
+		`{"operations": []}`,
+		`{"mode": "sometimes", "operations": [{"op": "create"}]}`,
+		`{"operations": [{"op": "upsert"}]}`,
+		`{"operations": [{"op": "delete"}]}`,
+	}
+
+	for _, body := range bodies {
+		res, err := http.Post(server.URL+"/people:batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error during http.Post: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got status %d but expected %d", body, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
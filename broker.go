@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// subscriberBuffer is how many events a subscriber may fall behind by
+	// before it is dropped and has to resume from its last event.
+	subscriberBuffer = 256
+
+	// brokerPollInterval bounds how late the broker sees changes it was not
+	// told about, such as another replica's while the listener is down.
+	brokerPollInterval = 5 * time.Second
+)
+
+// changeBroker fans each tenant's change feed out to the tenant's
+// in-process subscribers. Writes wake it through notify, and it then reads
+// the new events of each tenant with subscribers from the store once and
+// hands them to every one of them.
+type changeBroker struct {
+	storer  Storer
+	logger  logger
+	timeout time.Duration
+	wake    chan struct{}
+
+	// written is signalled along with wake, for the webhook dispatcher,
+	// which works through every tenant's deliveries rather than following
+	// one tenant's feed.
+	written chan struct{}
+
+	mu      sync.Mutex
+	cursors map[string]changeCursor
+	subs    map[*subscription]struct{}
+}
+
+// subscription receives the events of one tenant until it is unsubscribed
+// or dropped, at which point events is closed.
+type subscription struct {
+	tenant string
+	events chan changeEvent
+}
+
+func newChangeBroker(storer Storer, logger logger, timeout time.Duration) *changeBroker {
+	return &changeBroker{
+		storer:  storer,
+		logger:  logger,
+		timeout: timeout,
+		wake:    make(chan struct{}, 1),
+		written: make(chan struct{}, 1),
+		cursors: map[string]changeCursor{},
+		subs:    map[*subscription]struct{}{},
+	}
+}
+
+// run delivers events until ctx is done, then closes every subscription.
+func (b *changeBroker) run(ctx context.Context) {
+	defer b.closeAll()
+
+	ticker := time.NewTicker(brokerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for tenant, cursor := range b.feeds() {
+			b.fetch(withTenant(ctx, tenant), cursor)
+		}
+	}
+}
+
+// feeds returns where each tenant with subscribers is up to, forgetting the
+// tenants left without any.
+func (b *changeBroker) feeds() map[string]changeCursor {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscribed := map[string]bool{}
+	for s := range b.subs {
+		subscribed[s.tenant] = true
+	}
+
+	feeds := map[string]changeCursor{}
+	for tenant, cursor := range b.cursors {
+		if !subscribed[tenant] {
+			delete(b.cursors, tenant)
+			continue
+		}
+		feeds[tenant] = cursor
+	}
+
+	return feeds
+}
+
+// fetch publishes the events after cursor of the tenant in ctx.
+func (b *changeBroker) fetch(ctx context.Context, cursor changeCursor) {
+	tenant := tenantFromContext(ctx)
+	for {
+		ctx, cancel := context.WithTimeout(ctx, b.timeout)
+		events, err := b.storer.changesSince(ctx, cursor, maxChangesLimit)
+		cancel()
+		if err != nil {
+			b.logger.error(fmt.Errorf("change broker: %w", err))
+			return
+		}
+
+		for _, e := range events {
+			b.publish(tenant, e)
+			cursor = e.Cursor
+		}
+
+		b.mu.Lock()
+		if _, ok := b.cursors[tenant]; ok {
+			b.cursors[tenant] = cursor
+		}
+		b.mu.Unlock()
+
+		if len(events) < maxChangesLimit {
+			return
+		}
+	}
+}
+
+// notify wakes the broker to look for new events. It never blocks.
+func (b *changeBroker) notify() {
+	for _, ch := range []chan struct{}{b.wake, b.written} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a subscription to the changes of the tenant in ctx. The
+// first subscription of a tenant starts its feed from the end, so only
+// changes made from then on are delivered.
+func (b *changeBroker) subscribe(ctx context.Context) (*subscription, error) {
+	tenant := tenantFromContext(ctx)
+	s := &subscription{tenant: tenant, events: make(chan changeEvent, subscriberBuffer)}
+
+	b.mu.Lock()
+	_, following := b.cursors[tenant]
+	b.mu.Unlock()
+
+	var latest changeCursor
+	if !following {
+		ctx, cancel := context.WithTimeout(ctx, b.timeout)
+		defer cancel()
+
+		var err error
+		if latest, err = b.storer.latestChangeCursor(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.cursors[tenant]; !ok {
+		b.cursors[tenant] = latest
+	}
+	b.subs[s] = struct{}{}
+
+	return s, nil
+}
+
+func (b *changeBroker) unsubscribe(s *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+func (b *changeBroker) subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.subs)
+}
+
+// publish hands e to every subscriber of the tenant, dropping any that are
+// too far behind rather than holding up the rest.
+func (b *changeBroker) publish(tenant string, e changeEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		if s.tenant != tenant {
+			continue
+		}
+
+		select {
+		case s.events <- e:
+		default:
+			delete(b.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+func (b *changeBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.events)
+	}
+}
+
+// notifyingStore wakes the broker after every successful write, so
+// subscribers hear about changes as soon as they are made.
+type notifyingStore struct {
+	Storer
+	broker *changeBroker
+}
+
+func (ns notifyingStore) addPerson(ctx context.Context, p Person) (Person, error) {
+	up, err := ns.Storer.addPerson(ctx, p)
+	if err == nil {
+		ns.broker.notify()
+	}
+
+	return up, err
+}
+
+func (ns notifyingStore) updatePerson(ctx context.Context, id int, p Person, version int) (Person, error) {
+	up, err := ns.Storer.updatePerson(ctx, id, p, version)
+	if err == nil {
+		ns.broker.notify()
+	}
+
+	return up, err
+}
+
+func (ns notifyingStore) deletePerson(ctx context.Context, id int, version int) error {
+	err := ns.Storer.deletePerson(ctx, id, version)
+	if err == nil {
+		ns.broker.notify()
+	}
+
+	return err
+}
+
+func (ns notifyingStore) restorePerson(ctx context.Context, id int) (Person, error) {
+	p, err := ns.Storer.restorePerson(ctx, id)
+	if err == nil {
+		ns.broker.notify()
+	}
+
+	return p, err
+}
+
+func (ns notifyingStore) purgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	n, err := ns.Storer.purgeDeleted(ctx, before)
+	if err == nil && n > 0 {
+		ns.broker.notify()
+	}
+
+	return n, err
+}
+
+func (ns notifyingStore) applyBatch(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error) {
+	results, err := ns.Storer.applyBatch(ctx, ops, atomic)
+	if err == nil {
+		ns.broker.notify()
+	}
+
+	return results, err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// personCacheSize bounds how many people a replica keeps cached.
+const personCacheSize = 10000
+
+// personCache holds current people by tenant and ID. Every invalidation
+// bumps the generation, and put only stores a person read under the
+// generation still current, so a read that raced a write can't put back what
+// it replaced.
+type personCache struct {
+	mu         sync.Mutex
+	people     map[cacheKey]Person
+	generation uint64
+	size       int
+}
+
+type cacheKey struct {
+	tenant string
+	id     int
+}
+
+func newPersonCache(size int) *personCache {
+	return &personCache{people: map[cacheKey]Person{}, size: size}
+}
+
+func (c *personCache) get(tenant string, id int) (Person, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.people[cacheKey{tenant, id}]
+	return p, ok
+}
+
+func (c *personCache) gen() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.generation
+}
+
+func (c *personCache) put(tenant string, p Person, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.generation {
+		return
+	}
+
+	key := cacheKey{tenant, p.ID}
+	if _, ok := c.people[key]; !ok && len(c.people) >= c.size {
+		for k := range c.people {
+			delete(c.people, k)
+			break
+		}
+	}
+
+	c.people[key] = p
+}
+
+func (c *personCache) invalidate(tenant string, ids ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range ids {
+		delete(c.people, cacheKey{tenant, id})
+	}
+	c.generation++
+}
+
+// invalidateTenant drops every person cached for tenant.
+func (c *personCache) invalidateTenant(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.people {
+		if k.tenant == tenant {
+			delete(c.people, k)
+		}
+	}
+	c.generation++
+}
+
+func (c *personCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.people = map[cacheKey]Person{}
+	c.generation++
+}
+
+// cachingStore serves current reads of a single person from the cache, for
+// the tenant in ctx. Its own writes invalidate what they change straight
+// away; writes made by other replicas arrive through PostgresStore.listen.
+type cachingStore struct {
+	Storer
+	cache *personCache
+}
+
+func (cs cachingStore) personForID(ctx context.Context, id int, pq personQuery) (*Person, error) {
+	if pq.IncludeDeleted || !pq.AsOf.IsZero() || pq.Attributes != nil {
+		return cs.Storer.personForID(ctx, id, pq)
+	}
+
+	tenant := tenantFromContext(ctx)
+	if p, ok := cs.cache.get(tenant, id); ok {
+		return &p, nil
+	}
+
+	gen := cs.cache.gen()
+	p, err := cs.Storer.personForID(ctx, id, pq)
+	if err != nil {
+		return p, err
+	}
+
+	cs.cache.put(tenant, *p, gen)
+	return p, nil
+}
+
+// peopleForIDs only asks the store for the people missing from the cache.
+func (cs cachingStore) peopleForIDs(ctx context.Context, ids []int) ([]Person, error) {
+	tenant := tenantFromContext(ctx)
+	var people []Person
+	var missing []int
+	for _, id := range ids {
+		if p, ok := cs.cache.get(tenant, id); ok {
+			people = append(people, p)
+			continue
+		}
+		missing = append(missing, id)
+	}
+
+	if len(missing) == 0 {
+		return people, nil
+	}
+
+	gen := cs.cache.gen()
+	found, err := cs.Storer.peopleForIDs(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range found {
+		cs.cache.put(tenant, p, gen)
+	}
+
+	return append(people, found...), nil
+}
+
+func (cs cachingStore) addPerson(ctx context.Context, p Person) (Person, error) {
+	up, err := cs.Storer.addPerson(ctx, p)
+	cs.cache.invalidate(tenantFromContext(ctx), up.ID)
+	return up, err
+}
+
+func (cs cachingStore) updatePerson(ctx context.Context, id int, p Person, version int) (Person, error) {
+	up, err := cs.Storer.updatePerson(ctx, id, p, version)
+	cs.cache.invalidate(tenantFromContext(ctx), id)
+	return up, err
+}
+
+func (cs cachingStore) deletePerson(ctx context.Context, id int, version int) error {
+	err := cs.Storer.deletePerson(ctx, id, version)
+	cs.cache.invalidate(tenantFromContext(ctx), id)
+	return err
+}
+
+func (cs cachingStore) restorePerson(ctx context.Context, id int) (Person, error) {
+	p, err := cs.Storer.restorePerson(ctx, id)
+	cs.cache.invalidate(tenantFromContext(ctx), id)
+	return p, err
+}
+
+func (cs cachingStore) purgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	n, err := cs.Storer.purgeDeleted(ctx, before)
+	cs.cache.flush()
+	return n, err
+}
+
+func (cs cachingStore) applyBatch(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error) {
+	results, err := cs.Storer.applyBatch(ctx, ops, atomic)
+	cs.cache.flush()
+	return results, err
+}
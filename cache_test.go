@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func Test_cachingStorePersonForID(t *testing.T) {
+	ms := NewMemoryStore(0)
+	cs := cachingStore{Storer: &ms, cache: newPersonCache(personCacheSize)}
+	ctx := withTenant(context.Background(), defaultTenant)
+
+	if _, err := cs.personForID(ctx, 1, personQuery{}); err != nil {
+		t.Fatalf("error during personForID: %s", err.Error())
+	}
+
+	// A write the cache doesn't hear about, as if from another replica.
+	if _, err := ms.updatePerson(ctx, 1, Person{FirstName: "Robert", LastName: "Barker"}, 0); err != nil {
+		t.Fatalf("error during updatePerson: %s", err.Error())
+	}
+
+	p, _ := cs.personForID(ctx, 1, personQuery{})
+	if p.FirstName != "Bob" {
+		t.Errorf("got %s but expected the cached Bob", p.FirstName)
+	}
+
+	cs.cache.invalidate(defaultTenant, 1)
+	p, _ = cs.personForID(ctx, 1, personQuery{})
+	if p.FirstName != "Robert" {
+		t.Errorf("got %s but expected Robert after invalidation", p.FirstName)
+	}
+
+	if _, err := cs.updatePerson(ctx, 1, Person{FirstName: "Bobby", LastName: "Barker"}, 0); err != nil {
+		t.Fatalf("error during updatePerson: %s", err.Error())
+	}
+
+	p, _ = cs.personForID(ctx, 1, personQuery{})
+	if p.FirstName != "Bobby" {
+		t.Errorf("got %s but expected its own write to invalidate", p.FirstName)
+	}
+
+	if err := cs.deletePerson(ctx, 1, 0); err != nil {
+		t.Fatalf("error during deletePerson: %s", err.Error())
+	}
+
+	if _, err := cs.personForID(ctx, 1, personQuery{}); err == nil {
+		t.Errorf("expected a deleted person to no longer be found")
+	}
+}
+
+func Test_cachingStoreTenants(t *testing.T) {
+	ms := NewMemoryStore(0)
+	cs := cachingStore{Storer: &ms, cache: newPersonCache(personCacheSize)}
+
+	if _, err := cs.personForID(withTenant(context.Background(), defaultTenant), 1, personQuery{}); err != nil {
+		t.Fatalf("error during personForID: %s", err.Error())
+	}
+
+	// Another tenant's person 1 is theirs, whatever is cached for the
+	// default tenant.
+	ctx := withTenant(context.Background(), "acme")
+	if p, err := cs.personForID(ctx, 1, personQuery{}); !errors.Is(err, errPersonNotFound) {
+		t.Errorf("got %v and error %v but expected %v", p, err, errPersonNotFound)
+	}
+	if people, _ := cs.peopleForIDs(ctx, []int{1}); len(people) != 0 {
+		t.Errorf("got %v but expected no people", people)
+	}
+}
+
+func Test_personCacheStaleRead(t *testing.T) {
+	c := newPersonCache(personCacheSize)
+
+	gen := c.gen()
+	c.invalidate(defaultTenant, 1)
+	c.put(defaultTenant, Person{ID: 1, FirstName: "Bob"}, gen)
+
+	if _, ok := c.get(defaultTenant, 1); ok {
+		t.Errorf("expected a read from before an invalidation not to be cached")
+	}
+
+	c.put(defaultTenant, Person{ID: 1, FirstName: "Bob"}, c.gen())
+	c.flush()
+
+	if _, ok := c.get(defaultTenant, 1); ok {
+		t.Errorf("expected flush to empty the cache")
+	}
+}
+
+func Test_personCacheSize(t *testing.T) {
+	c := newPersonCache(2)
+	for id := 1; id <= 3; id++ {
+		c.put(defaultTenant, Person{ID: id}, c.gen())
+	}
+
+	if len(c.people) != 2 {
+		t.Errorf("got %d cached but expected at most 2", len(c.people))
+	}
+
+	if _, ok := c.get(defaultTenant, 3); !ok {
+		t.Errorf("expected the newest person to be cached")
+	}
+}
+
+func Test_personCacheInvalidateTenant(t *testing.T) {
+	c := newPersonCache(personCacheSize)
+	c.put(defaultTenant, Person{ID: 1}, c.gen())
+	c.put(defaultTenant, Person{ID: 2}, c.gen())
+	c.put("acme", Person{ID: 1}, c.gen())
+
+	c.invalidate(defaultTenant, 1, 2)
+	if _, ok := c.get(defaultTenant, 2); ok {
+		t.Errorf("expected every person invalidated to be dropped")
+	}
+
+	c.put(defaultTenant, Person{ID: 3}, c.gen())
+	c.invalidateTenant(defaultTenant)
+	if _, ok := c.get(defaultTenant, 3); ok {
+		t.Errorf("expected the tenant's people to be dropped")
+	}
+	if _, ok := c.get("acme", 1); !ok {
+		t.Errorf("expected another tenant's people to stay cached")
+	}
+}
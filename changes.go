@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+
+	// maxChangesWait keeps a long poll well inside the server WriteTimeout.
+	maxChangesWait      = 60 * time.Second
+	changesPollInterval = 500 * time.Millisecond
+
+	// changeRetention is how long the change feed keeps an event. A consumer
+	// that falls further behind misses the events pruned meanwhile.
+	changeRetention = 7 * 24 * time.Hour
+)
+
+// changeCursor is a position in the change feed. Events are ordered by the
+// transaction that wrote them and then by their ID within it, which lets
+// PostgresStore hold back events from transactions that are still open
+// without a later event overtaking them. MemoryStore only uses ID.
+type changeCursor struct {
+	Tx uint64
+	ID int64
+}
+
+// String encodes the cursor as the opaque token clients pass back in since.
+func (c changeCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Tx, c.ID)))
+}
+
+// after reports whether c comes later in the feed than o.
+func (c changeCursor) after(o changeCursor) bool {
+	return c.Tx > o.Tx || (c.Tx == o.Tx && c.ID > o.ID)
+}
+
+func parseChangeCursor(s string) (changeCursor, error) {
+	var c changeCursor
+	if s == "" {
+		return c, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("Invalid cursor: %q", s)
+	}
+
+	tx, id, ok := strings.Cut(string(b), ".")
+	if !ok {
+		return c, fmt.Errorf("Invalid cursor: %q", s)
+	}
+
+	if c.Tx, err = strconv.ParseUint(tx, 10, 64); err != nil {
+		return c, fmt.Errorf("Invalid cursor: %q", s)
+	}
+
+	if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return c, fmt.Errorf("Invalid cursor: %q", s)
+	}
+
+	return c, nil
+}
+
+// changeEvent is a single entry in the change feed. Person is the state
+// after the change and is nil once a person has been purged.
+type changeEvent struct {
+	Cursor    changeCursor `json:"-"`
+	Token     string       `json:"cursor"`
+	PersonID  int          `json:"person_id"`
+	Action    string       `json:"action"`
+	Person    *Person      `json:"person"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+type changesResponse struct {
+	Events     []changeEvent `json:"events"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+// handlePeopleChangesGET returns the changes after the since cursor, oldest
+// first. With wait set, a request that finds nothing new is held open until
+// a change arrives or the wait runs out.
+func handlePeopleChangesGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	since, err := parseChangeCursor(query.Get("since"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	limit := defaultChangesLimit
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxChangesLimit {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxChangesLimit))
+			return
+		}
+	}
+
+	var wait time.Duration
+	if v := query.Get("wait"); v != "" {
+		wait, err = time.ParseDuration(v)
+		if err != nil || wait < 0 || wait > maxChangesWait {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("wait must be a duration of at most %s", maxChangesWait))
+			return
+		}
+	}
+
+	// With a broker, a write wakes the poll straight away rather than at
+	// the next interval.
+	var wake <-chan changeEvent
+	if wait > 0 && actx.broker != nil {
+		sub, err := actx.broker.subscribe(r.Context())
+		if err != nil {
+			writeStoreError(actx, w, r, err)
+			return
+		}
+		defer actx.broker.unsubscribe(sub)
+		wake = sub.events
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		events, err := changesSince(r.Context(), actx, since, limit)
+		if err != nil {
+			writeStoreError(actx, w, r, err)
+			return
+		}
+
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			writeChanges(w, since, events)
+			return
+		}
+
+		select {
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
+			}
+		case <-time.After(changesPollInterval):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func changesSince(ctx context.Context, actx *AppContext, since changeCursor, limit int) ([]changeEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	return actx.storer.changesSince(ctx, since, limit)
+}
+
+func writeChanges(w http.ResponseWriter, since changeCursor, events []changeEvent) {
+	next := since
+	for i := range events {
+		events[i].Token = events[i].Cursor.String()
+		next = events[i].Cursor
+	}
+
+	if events == nil {
+		events = []changeEvent{}
+	}
+
+	writeJSON(w, http.StatusOK, changesResponse{Events: events, NextCursor: next.String()})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getChanges(t *testing.T, url string) changesResponse {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	var cr changesResponse
+	if err := json.NewDecoder(res.Body).Decode(&cr); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return cr
+}
+
+func Test_handlePeopleChangesGET(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	for _, body := range []string{
+		`{"id": 10, "firstname": "Foo", "lastname": "Bar"}`,
+		`{"id": 11, "firstname": "Bin", "lastname": "Baz"}`,
+		`{"id": 12, "firstname": "Qux", "lastname": "Quux"}`,
+	} {
+		res, err := http.Post(server.URL+"/people", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error during http.Post: %s", err.Error())
+		}
+		res.Body.Close()
+	}
+
+	cr := getChanges(t, server.URL+"/people/changes?limit=2")
+	if len(cr.Events) != 2 || cr.Events[0].PersonID != 10 || cr.Events[1].PersonID != 11 {
+		t.Fatalf("got events %v but expected creates of 10 and 11", cr.Events)
+	}
+
+	if cr.NextCursor != cr.Events[1].Token {
+		t.Errorf("got next cursor %s but expected the last event's %s", cr.NextCursor, cr.Events[1].Token)
+	}
+
+	cr = getChanges(t, server.URL+"/people/changes?since="+cr.NextCursor)
+	if len(cr.Events) != 1 || cr.Events[0].PersonID != 12 || cr.Events[0].Action != auditCreate {
+		t.Fatalf("got events %v but expected the create of 12", cr.Events)
+	}
+
+	last := cr.NextCursor
+	cr = getChanges(t, server.URL+"/people/changes?since="+last)
+	if len(cr.Events) != 0 || cr.NextCursor != last {
+		t.Errorf("got %d events and cursor %s but expected none and %s", len(cr.Events), cr.NextCursor, last)
+	}
+
+	res, err := http.Get(server.URL + "/people/changes?since=nonsense")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for a bad cursor but expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func Test_handlePeopleChangesGETLongPoll(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		res, err := http.Post(server.URL+"/people", "application/json", strings.NewReader(`{"id": 10, "firstname": "Foo", "lastname": "Bar"}`))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	start := time.Now()
+	cr := getChanges(t, server.URL+"/people/changes?wait=5s")
+	if len(cr.Events) != 1 || cr.Events[0].PersonID != 10 {
+		t.Errorf("got events %v but expected the create of 10", cr.Events)
+	}
+
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("long poll took %s to see the change", time.Since(start))
+	}
+}
+
+func Test_MemoryStorePruneChanges(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	for _, id := range []int{10, 11} {
+		if _, err := ms.addPerson(ctx, Person{ID: id, FirstName: "Foo", LastName: "Bar"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := ms.pruneChanges(ctx, time.Now()); err != nil || n != 2 {
+		t.Fatalf("got %d pruned and error %v but expected 2", n, err)
+	}
+
+	// Cursors carry on from where they were rather than starting over.
+	if _, err := ms.addPerson(ctx, Person{ID: 12, FirstName: "Foo", LastName: "Bar"}); err != nil {
+		t.Fatal(err)
+	}
+	events, err := ms.changesSince(ctx, changeCursor{ID: 2}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Cursor.ID != 3 || events[0].PersonID != 12 {
+		t.Errorf("got events %+v but expected only the create of 12 as 3", events)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	mediaJSON    = "application/json"
+	mediaXML     = "application/xml"
+	mediaYAML    = "application/yaml"
+	mediaCBOR    = "application/cbor"
+	mediaMsgPack = "application/msgpack"
+)
+
+// codec reads and writes Person resources in one media type.
+type codec struct {
+	mediaType string
+	aliases   []string
+	encode    func(w io.Writer, v any) error
+	decode    func(data []byte, v any) error
+}
+
+// cborMode writes times as RFC 3339 strings, like the other encodings,
+// rather than as epoch seconds.
+var cborMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+// cborDecMode reads maps nested in attributes with string keys, as the other
+// encodings do, so they can be checked as JSON.
+var cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+
+// codecs are the encodings of Person resources, in order of preference when
+// the client has none. CBOR and MessagePack use the json struct tags, so the
+// field names are the same in every encoding.
+var codecs = []codec{
+	{
+		mediaType: mediaJSON,
+		encode:    func(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) },
+		decode:    func(data []byte, v any) error { return json.NewDecoder(bytes.NewReader(data)).Decode(v) },
+	},
+	{
+		mediaType: mediaXML,
+		aliases:   []string{"text/xml"},
+		encode: func(w io.Writer, v any) error {
+			if _, err := io.WriteString(w, xml.Header); err != nil {
+				return err
+			}
+			return xml.NewEncoder(w).Encode(xmlValue(v))
+		},
+		decode: xml.Unmarshal,
+	},
+	{
+		mediaType: mediaYAML,
+		aliases:   []string{"application/x-yaml", "text/yaml"},
+		encode:    func(w io.Writer, v any) error { return yaml.NewEncoder(w).Encode(v) },
+		decode:    yaml.Unmarshal,
+	},
+	{
+		mediaType: mediaCBOR,
+		encode:    func(w io.Writer, v any) error { return cborMode.NewEncoder(w).Encode(v) },
+		decode:    cborDecMode.Unmarshal,
+	},
+	{
+		mediaType: mediaMsgPack,
+		aliases:   []string{"application/x-msgpack", "application/vnd.msgpack"},
+		encode: func(w io.Writer, v any) error {
+			enc := msgpack.NewEncoder(w)
+			enc.SetCustomStructTag("json")
+			return enc.Encode(v)
+		},
+		decode: func(data []byte, v any) error {
+			dec := msgpack.NewDecoder(bytes.NewReader(data))
+			dec.SetCustomStructTag("json")
+			return dec.Decode(v)
+		},
+	},
+}
+
+// xmlValue names the root element after the resource rather than the Go
+// type, and wraps lists so each person is its own element.
+func xmlValue(v any) any {
+	switch v := v.(type) {
+	case Person:
+		return struct {
+			XMLName xml.Name `xml:"person"`
+			Person
+		}{Person: v}
+	case []Person:
+		return struct {
+			XMLName xml.Name `xml:"people"`
+			People  []Person `xml:"person"`
+		}{People: v}
+	}
+
+	return v
+}
+
+func codecFor(mediaType string) (codec, bool) {
+	for _, c := range codecs {
+		if c.mediaType == mediaType {
+			return c, true
+		}
+	}
+
+	return codec{}, false
+}
+
+// canonicalMediaType maps an alias such as text/xml to the media type its
+// codec is listed under.
+func canonicalMediaType(mt string) string {
+	for _, c := range codecs {
+		for _, a := range c.aliases {
+			if a == mt {
+				return c.mediaType
+			}
+		}
+	}
+
+	return mt
+}
+
+func codecMediaTypes() []string {
+	var offers []string
+	for _, c := range codecs {
+		offers = append(offers, c.mediaType)
+	}
+
+	return offers
+}
+
+// negotiate picks the offer the Accept header prefers, breaking ties in the
+// order of offers. A request without Accept gets the first offer. It returns
+// false when Accept rules out every offer.
+func negotiate(r *http.Request, offers []string) (string, bool) {
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		typ, subtype, _ := strings.Cut(canonicalMediaType(mt), "/")
+		ranges = append(ranges, mediaRange{typ, subtype, q})
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype, _ := strings.Cut(offer, "/")
+
+		// The most specific range that matches the offer sets its quality.
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			s := -1
+			switch {
+			case mr.typ == typ && mr.subtype == subtype:
+				s = 2
+			case mr.typ == typ && mr.subtype == "*":
+				s = 1
+			case mr.typ == "*" && mr.subtype == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+
+	return best, best != ""
+}
+
+// negotiateCodec picks the codec for a Person response, writing 406 and
+// returning false when the client accepts none of them.
+func negotiateCodec(w http.ResponseWriter, r *http.Request) (codec, bool) {
+	w.Header().Add("Vary", "Accept")
+	mt, ok := negotiate(r, codecMediaTypes())
+	if !ok {
+		writeNotAcceptable(w, r, codecMediaTypes())
+		return codec{}, false
+	}
+
+	c, _ := codecFor(mt)
+	return c, true
+}
+
+func writeNotAcceptable(w http.ResponseWriter, r *http.Request, offers []string) {
+	writeError(w, r, http.StatusNotAcceptable, fmt.Errorf("Accept must allow one of %s", strings.Join(offers, ", ")))
+}
+
+// writeEntity writes v in the codec's media type.
+func writeEntity(w http.ResponseWriter, c codec, status int, v any) {
+	w.Header().Set("Content-Type", c.mediaType)
+	w.WriteHeader(status)
+	c.encode(w, v)
+}
+
+var errUnsupportedMediaType = errors.New("Unsupported Content-Type")
+
+// decodeBody decodes the request body according to its Content-Type, which
+// defaults to JSON. An unknown media type is errUnsupportedMediaType.
+func decodeBody(r *http.Request, v any) error {
+	mt := mediaJSON
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		parsed, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return fmt.Errorf("%w: %q", errUnsupportedMediaType, ct)
+		}
+		mt = canonicalMediaType(parsed)
+	}
+
+	c, ok := codecFor(mt)
+	if !ok {
+		return fmt.Errorf("%w: %q, expected one of %s", errUnsupportedMediaType, mt, strings.Join(codecMediaTypes(), ", "))
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	return c.decode(data, v)
+}
+
+// writeDecodeError reports a body decodeBody could not read.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, errUnsupportedMediaType) {
+		status = http.StatusUnsupportedMediaType
+	}
+
+	writeError(w, r, status, err)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_negotiate(t *testing.T) {
+	offers := listMediaTypes()
+
+	for _, tc := range []struct {
+		accept string
+		exp    string
+	}{
+		{"", mediaJSON},
+		{"*/*", mediaJSON},
+		{"application/xml", mediaXML},
+		{"text/xml", mediaXML},
+		{"application/x-msgpack", mediaMsgPack},
+		{"application/json;q=0.5, application/yaml", mediaYAML},
+		{"application/yaml;q=0.1, */*;q=0.5", mediaJSON},
+		{"application/*;q=0.9, application/json;q=0", mediaXML},
+		{"text/*", mediaCSV},
+		{"text/plain", ""},
+		{"application/json;q=0", ""},
+	} {
+		r := httptest.NewRequest("GET", "/people", nil)
+		if tc.accept != "" {
+			r.Header.Set("Accept", tc.accept)
+		}
+
+		got, ok := negotiate(r, offers)
+		if got != tc.exp || ok != (tc.exp != "") {
+			t.Errorf("got %q, %t for Accept %q but expected %q", got, ok, tc.accept, tc.exp)
+		}
+	}
+}
+
+func Test_codecsRoundTrip(t *testing.T) {
+	deleted := time.Date(2026, time.October, 1, 12, 0, 0, 0, time.UTC)
+	for _, p := range []Person{
+		{ID: 1, FirstName: "Foo", LastName: "Bar", Age: 22, Version: 3},
+		{ID: 2, FirstName: "Bin", LastName: "Baz", Version: 1, DeletedAt: &deleted},
+	} {
+		for _, c := range codecs {
+			var buf bytes.Buffer
+			if err := c.encode(&buf, p); err != nil {
+				t.Errorf("error encoding %s: %s", c.mediaType, err.Error())
+				continue
+			}
+
+			var got Person
+			if err := c.decode(buf.Bytes(), &got); err != nil {
+				t.Errorf("error decoding %s: %s", c.mediaType, err.Error())
+				continue
+			}
+
+			// MessagePack timestamps carry no zone, so compare the instant.
+			if got.DeletedAt != nil {
+				utc := got.DeletedAt.UTC()
+				got.DeletedAt = &utc
+			}
+
+			if !reflect.DeepEqual(got, p) {
+				t.Errorf("got %v from %s but expected %v", got, c.mediaType, p)
+			}
+		}
+	}
+}
+
+func Test_codecsXMLRoots(t *testing.T) {
+	c, _ := codecFor(mediaXML)
+
+	var buf bytes.Buffer
+	c.encode(&buf, []Person{{ID: 1, FirstName: "Foo"}})
+	if body := buf.String(); !strings.Contains(body, "<people><person><id>1</id><firstname>Foo</firstname>") {
+		t.Errorf("got list %s but expected <people> of <person>", body)
+	}
+
+	buf.Reset()
+	c.encode(&buf, Person{ID: 1})
+	if body := buf.String(); !strings.Contains(body, "<person><id>1</id>") {
+		t.Errorf("got person %s but expected a <person> root", body)
+	}
+}
+
+func Test_handlePersonNegotiation(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+		accept      string
+		expstatus   int
+		exptype     string
+	}{
+		{"GET", "/people/1", "", "", "application/yaml", http.StatusOK, mediaYAML},
+		{"GET", "/people/1", "", "", "application/cbor", http.StatusOK, mediaCBOR},
+		{"GET", "/people/1", "", "", "text/html", http.StatusNotAcceptable, problemMediaType},
+		{"GET", "/people", "", "", "application/xml", http.StatusOK, mediaXML},
+		{"GET", "/people", "", "", "image/png", http.StatusNotAcceptable, problemMediaType},
+		{"POST", "/people", mediaXML, "<person><id>10</id><firstname>Foo</firstname><lastname>Bar</lastname></person>", "", http.StatusOK, mediaJSON},
+		{"POST", "/people", "text/plain", "Foo Bar", "", http.StatusUnsupportedMediaType, problemMediaType},
+		{"POST", "/people", mediaJSON, `{"id": 11}`, "text/html", http.StatusNotAcceptable, problemMediaType},
+		{"PUT", "/people/10", mediaYAML, "firstname: Foo\nlastname: Baz\n", mediaMsgPack, http.StatusOK, mediaMsgPack},
+		{"PATCH", "/people/10", mediaYAML, "age: [", "", http.StatusBadRequest, problemMediaType},
+	} {
+		req, _ := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", tc.method, tc.path, err.Error())
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tc.expstatus {
+			t.Errorf("got status %d for %s %s but expected %d: %s", res.StatusCode, tc.method, tc.path, tc.expstatus, body)
+		}
+
+		if ct := res.Header.Get("Content-Type"); ct != tc.exptype {
+			t.Errorf("got Content-Type %q for %s %s but expected %q", ct, tc.method, tc.path, tc.exptype)
+		}
+	}
+
+	// Nothing was created by the POST that could not be answered.
+	if _, err := ms.personForID(withTenant(context.Background(), defaultTenant), 11, personQuery{}); err == nil {
+		t.Errorf("got person 11 but expected the POST to be refused before creating it")
+	}
+}
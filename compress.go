@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// minCompressSize is the smallest response worth compressing. Anything
+	// shorter is sent as it is, since the encoding overhead eats the saving.
+	minCompressSize = 1024
+
+	// maxDecompressedBody caps what a compressed request body can expand to.
+	maxDecompressedBody = 64 << 20
+)
+
+// compressEncodings are the response encodings in order of preference when
+// Accept-Encoding rates them equally.
+var compressEncodings = []string{"zstd", "gzip"}
+
+var gzipWriters = sync.Pool{New: func() any {
+	return gzip.NewWriter(io.Discard)
+}}
+
+var zstdWriters = sync.Pool{New: func() any {
+	// A single goroutine per encoder keeps streaming writes cheap.
+	enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+	return enc
+}}
+
+// compressor is the part of gzip.Writer and zstd.Encoder that
+// compressWriter uses.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressMw compresses responses with zstd or gzip as Accept-Encoding
+// allows, and decompresses request bodies sent with Content-Encoding: gzip.
+func compressMw(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch ce := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); ce {
+		case "", "identity":
+		case "gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, fmt.Errorf("Invalid gzip request body: %w", err))
+				return
+			}
+			defer zr.Close()
+
+			r.Body = http.MaxBytesReader(w, zr, maxDecompressedBody)
+			r.ContentLength = -1
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			writeError(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("Unsupported Content-Encoding: %q", ce))
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := acceptEncoding(r)
+		if encoding == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// acceptEncoding returns the response encoding Accept-Encoding prefers, or
+// "" when the response should not be compressed.
+func acceptEncoding(r *http.Request) string {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(strings.Join(r.Header.Values("Accept-Encoding"), ","), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				continue
+			}
+		}
+		qs[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range compressEncodings {
+		q, ok := qs[enc]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// the response is big enough to compress. A Flush before then settles it in
+// favour of compressing, since a handler that flushes is streaming a
+// response of unknown length.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	cz      compressor
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+
+	// Informational responses go straight out and leave the final one open.
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	cw.status = status
+	if !cw.compressible() {
+		cw.start(false)
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.buf.Write(b)
+		if cw.buf.Len() < minCompressSize {
+			return len(b), nil
+		}
+
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.cz != nil {
+		return cw.cz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) FlushError() error {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		if err := cw.start(true); err != nil {
+			return err
+		}
+	}
+
+	if cw.cz != nil {
+		if err := cw.cz.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Flush() {
+	cw.FlushError()
+}
+
+// Unwrap lets http.ResponseController reach the connection, for write
+// deadlines in particular.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// compressible reports whether the response, as far as the headers go, can
+// be compressed.
+func (cw *compressWriter) compressible() bool {
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < minCompressSize {
+		return false
+	}
+
+	ct := h.Get("Content-Type")
+	for _, prefix := range []string{"image/", "audio/", "video/", "application/zip", "application/gzip", "application/zstd"} {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// start sends the header, compressed or not, and whatever has been held
+// back so far.
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+
+	if compress && cw.compressible() {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+
+		switch cw.encoding {
+		case "zstd":
+			enc := zstdWriters.Get().(*zstd.Encoder)
+			enc.Reset(cw.ResponseWriter)
+			cw.cz = enc
+		default:
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.cz = gz
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.cz != nil {
+		_, err = cw.cz.Write(cw.buf.Bytes())
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf.Bytes())
+	}
+	cw.buf.Reset()
+	return err
+}
+
+// close sends a response that never reached minCompressSize as it is, or
+// ends the compressed stream.
+func (cw *compressWriter) close() error {
+	if cw.status == 0 {
+		// The handler wrote nothing, so leave the default response to the
+		// server.
+		return nil
+	}
+
+	if !cw.decided {
+		cw.decided = true
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, err := cw.ResponseWriter.Write(cw.buf.Bytes())
+		return err
+	}
+
+	if cw.cz == nil {
+		return nil
+	}
+
+	err := cw.cz.Close()
+	switch cz := cw.cz.(type) {
+	case *zstd.Encoder:
+		zstdWriters.Put(cz)
+	case *gzip.Writer:
+		gzipWriters.Put(cz)
+	}
+	cw.cz = nil
+
+	return err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// rawClient leaves Accept-Encoding and the response body alone, where the
+// default transport would ask for gzip and decompress it out of sight.
+var rawClient = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+func manyPeopleStub(n int) StorerStub {
+	return StorerStub{
+		eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+			for i := 1; i <= n; i++ {
+				if err := fn(Person{ID: i, FirstName: "Foo", LastName: "Bar", Age: 22, Version: 1}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func decompress(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("error reading gzip: %s", err.Error())
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("error reading zstd: %s", err.Error())
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return body
+	}
+
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error decompressing %s: %s", encoding, err.Error())
+	}
+	return out
+}
+
+func Test_acceptEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		accept string
+		exp    string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"*", "zstd"},
+		{"*;q=0.2, zstd;q=0", "gzip"},
+		{"gzip;q=0", ""},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.accept)
+
+		if got := acceptEncoding(r); got != tc.exp {
+			t.Errorf("got %q for Accept-Encoding %q but expected %q", got, tc.accept, tc.exp)
+		}
+	}
+}
+
+func Test_compressMwResponses(t *testing.T) {
+	server := httptest.NewServer(newTestHandler(manyPeopleStub(200)))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path        string
+		accept      string
+		expencoding string
+	}{
+		{"/people", "gzip", "gzip"},
+		{"/people", "gzip, zstd", "zstd"},
+		{"/people", "", ""},
+		{"/people", "br", ""},
+		{"/", "gzip", ""},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+tc.path, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept-Encoding", tc.accept)
+		}
+
+		res, err := rawClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during GET %s: %s", tc.path, err.Error())
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if ce := res.Header.Get("Content-Encoding"); ce != tc.expencoding {
+			t.Errorf("got Content-Encoding %q for %s with %q but expected %q", ce, tc.path, tc.accept, tc.expencoding)
+			continue
+		}
+
+		if vary := res.Header.Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept-Encoding") {
+			t.Errorf("got Vary %v for %s but expected it to name Accept-Encoding", vary, tc.path)
+		}
+
+		var v any
+		if err := json.Unmarshal(decompress(t, tc.expencoding, body), &v); err != nil {
+			t.Errorf("error decoding %s with %q: %s", tc.path, tc.accept, err.Error())
+		}
+		if people, ok := v.([]any); tc.path == "/people" && (!ok || len(people) != 200) {
+			t.Errorf("got %v for %s but expected 200 people", v, tc.path)
+		}
+	}
+}
+
+func Test_compressMwFlush(t *testing.T) {
+	flushed := make(chan struct{})
+	h := compressMw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		rc := http.NewResponseController(w)
+		fmt.Fprint(w, "data: one\n\n")
+		if err := rc.Flush(); err != nil {
+			t.Errorf("error during flush: %s", err.Error())
+		}
+		<-flushed
+	}))
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := rawClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during GET: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if ce := res.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("got Content-Encoding %q but expected gzip", ce)
+	}
+
+	// The event arrives while the handler is still running.
+	zr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatalf("error reading gzip: %s", err.Error())
+	}
+	line := make([]byte, len("data: one\n\n"))
+	if _, err := io.ReadFull(zr, line); err != nil || string(line) != "data: one\n\n" {
+		t.Errorf("got %q, %v but expected the flushed event", line, err)
+	}
+	close(flushed)
+}
+
+func Test_compressMwRequestBody(t *testing.T) {
+	var got Person
+	ss := StorerStub{
+		addPersonStub: func(ctx context.Context, p Person) (Person, error) {
+			got = p
+			return p, nil
+		},
+	}
+	server := httptest.NewServer(newTestHandler(ss))
+	defer server.Close()
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"id": 4, "firstname": "Foo", "lastname": "Bar"}`))
+	zw.Close()
+
+	for _, tc := range []struct {
+		encoding  string
+		body      []byte
+		expstatus int
+	}{
+		{"gzip", gz.Bytes(), http.StatusOK},
+		{"gzip", []byte(`{"id": 4}`), http.StatusBadRequest},
+		{"br", gz.Bytes(), http.StatusUnsupportedMediaType},
+	} {
+		got = Person{}
+		req, _ := http.NewRequest("POST", server.URL+"/people", bytes.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", tc.encoding)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during POST: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.expstatus {
+			t.Errorf("got status %d for Content-Encoding %s but expected %d", res.StatusCode, tc.encoding, tc.expstatus)
+		}
+
+		if tc.expstatus == http.StatusOK && got.FirstName != "Foo" {
+			t.Errorf("got person %v but expected the decompressed body", got)
+		}
+	}
+}
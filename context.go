@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	actorKey
+	tenantKey
+	graphqlRequestKey
+	pathParamsKey
+)
+
+// anonymousActor is recorded for changes made without an X-Actor header.
+const anonymousActor = "anonymous"
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func withActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey).(string); ok && actor != "" {
+		return actor
+	}
+
+	return anonymousActor
+}
+
+// withTenant scopes everything done with ctx to one tenant's data. The
+// stores take the tenant from ctx and nowhere else.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// tenantFromContext returns the tenant ctx is scoped to, or "" when it
+// names none. The stores read and write nothing for "", so a path that
+// forgets withTenant fails rather than reaching the default tenant's data;
+// only tenantResolver falls back to defaultTenant, and only when it is set
+// up to.
+func tenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
+// maxRequestIDLength bounds the X-Request-ID a caller may choose.
+const maxRequestIDLength = 128
+
+// callerRequestID returns the request ID a caller sent when it is fit to be
+// echoed, logged and stored: up to maxRequestIDLength printable ASCII
+// characters other than space. Otherwise it returns a new ID.
+func callerRequestID(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRequestID()
+		}
+	}
+
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
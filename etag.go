@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// etag returns the strong entity tag for a person version.
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// parseETags splits an If-Match or If-None-Match header into its entity tags.
+// Weak tags keep their W/ prefix so callers can decide how to compare them.
+func parseETags(header string) []string {
+	var tags []string
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" {
+			tags = append(tags, t)
+		}
+	}
+
+	return tags
+}
+
+// ifMatchVersion resolves the If-Match header against the current version of
+// a person. It returns the version a conditional write should expect, 0 when
+// the request carries no precondition, and false when the precondition fails.
+func ifMatchVersion(r *http.Request, current int) (int, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, true
+	}
+
+	for _, t := range parseETags(header) {
+		if t == "*" || t == etag(current) {
+			return current, true
+		}
+	}
+
+	return 0, false
+}
+
+// ifNoneMatch reports whether the If-None-Match header matches the current
+// version of a person, using the weak comparison GET requires.
+func ifNoneMatch(r *http.Request, current int) bool {
+	for _, t := range parseETags(r.Header.Get("If-None-Match")) {
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag(current) {
+			return true
+		}
+	}
+
+	return false
+}
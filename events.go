@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// sseHeartbeat is how often an idle stream gets a comment line, which
+	// keeps proxies from timing it out and notices gone clients.
+	sseHeartbeat = 15 * time.Second
+
+	// sseWriteTimeout replaces the server WriteTimeout for each write to an
+	// event stream, which would otherwise cut every stream off after 90s.
+	sseWriteTimeout = 30 * time.Second
+
+	// sseRetry is the reconnection delay suggested to clients.
+	sseRetry = 3 * time.Second
+)
+
+// sseEventTypes names the event sent for each change feed action.
+var sseEventTypes = map[string]string{
+	auditCreate:  "person.created",
+	auditUpdate:  "person.updated",
+	auditDelete:  "person.deleted",
+	auditRestore: "person.restored",
+	auditPurge:   "person.purged",
+}
+
+// handlePeopleEventsGET streams changes to people as server-sent events. Each
+// event's id is its change feed cursor, so a client that reconnects with
+// Last-Event-ID is first sent everything it missed.
+func handlePeopleEventsGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	if actx.broker == nil {
+		writeError(w, r, http.StatusServiceUnavailable, errors.New("Event stream is not available"))
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	since, err := parseChangeCursor(lastID)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	// Subscribe before catching up so that nothing written in between is
+	// missed. Events the catch up already sent are skipped below.
+	sub, err := actx.broker.subscribe(r.Context())
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+	defer actx.broker.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sw := sseWriter{w: w, rc: http.NewResponseController(w)}
+	if err := sw.send(fmt.Sprintf("retry: %d\n\n", sseRetry.Milliseconds())); err != nil {
+		return
+	}
+
+	for lastID != "" {
+		events, err := changesSince(r.Context(), actx, since, maxChangesLimit)
+		if err != nil {
+			actx.logger.error(fmt.Errorf("event stream catch up: %w", err))
+			return
+		}
+
+		for _, e := range events {
+			if err := sw.event(e); err != nil {
+				return
+			}
+			since = e.Cursor
+		}
+
+		if len(events) < maxChangesLimit {
+			break
+		}
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				// Dropped for falling behind, or shutting down. Either way
+				// the client reconnects and resumes from its last event.
+				return
+			}
+
+			if !e.Cursor.after(since) {
+				continue
+			}
+
+			if err := sw.event(e); err != nil {
+				return
+			}
+			since = e.Cursor
+		case <-heartbeat.C:
+			if err := sw.send(": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// sseWriter writes server-sent events, flushing each one and pushing the
+// write deadline back before it.
+type sseWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (sw sseWriter) event(e changeEvent) error {
+	e.Token = e.Cursor.String()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return sw.send(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", e.Token, sseEventTypes[e.Action], data))
+}
+
+func (sw sseWriter) send(s string) error {
+	err := sw.rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	if _, err := fmt.Fprint(sw.w, s); err != nil {
+		return err
+	}
+
+	return sw.rc.Flush()
+}
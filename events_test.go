@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBrokerTestHandler is newTestHandler with a running change broker.
+func newBrokerTestHandler(t *testing.T, ss Storer) (http.Handler, *changeBroker) {
+	broker := newChangeBroker(ss, noopLogger{}, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go broker.run(ctx)
+
+	actx := AppContext{
+		storer:         notifyingStore{Storer: ss, broker: broker},
+		timeout:        30 * time.Millisecond,
+		idempotencyTTL: time.Minute,
+		logger:         noopLogger{},
+		broker:         broker,
+	}
+
+	return NewHandler(actx), broker
+}
+
+// readSSE reads the fields of the next event, skipping comments.
+func readSSE(t *testing.T, br *bufio.Reader) map[string]string {
+	fields := map[string]string{}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event stream: %s", err.Error())
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, ": ")
+		fields[name] = value
+	}
+}
+
+func openEvents(t *testing.T, ctx context.Context, url string, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url+"/people/events", nil)
+	if err != nil {
+		t.Fatalf("error creating request: %s", err.Error())
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during request: %s", err.Error())
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %q but expected text/event-stream", ct)
+	}
+
+	br := bufio.NewReader(res.Body)
+	if retry := readSSE(t, br)["retry"]; retry != "3000" {
+		t.Errorf("got retry %q but expected 3000", retry)
+	}
+
+	return res, br
+}
+
+func postPerson(t *testing.T, url string, body string) {
+	res, err := http.Post(url+"/people", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	res.Body.Close()
+}
+
+func Test_handlePeopleEventsGET(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h, _ := newBrokerTestHandler(t, &ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, br := openEvents(t, ctx, server.URL, "")
+	defer res.Body.Close()
+
+	postPerson(t, server.URL, `{"id": 10, "firstname": "Foo", "lastname": "Bar"}`)
+
+	fields := readSSE(t, br)
+	if fields["event"] != "person.created" {
+		t.Errorf("got event %q but expected person.created", fields["event"])
+	}
+
+	var e changeEvent
+	if err := json.Unmarshal([]byte(fields["data"]), &e); err != nil {
+		t.Fatalf("error during unmarshal: %s", err.Error())
+	}
+
+	if e.PersonID != 10 || e.Person == nil || e.Person.FirstName != "Foo" {
+		t.Errorf("got event %+v but expected the create of 10", e)
+	}
+
+	if fields["id"] != e.Token {
+		t.Errorf("got id %q but expected the cursor %q", fields["id"], e.Token)
+	}
+}
+
+func Test_handlePeopleEventsGETResume(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h, _ := newBrokerTestHandler(t, &ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	postPerson(t, server.URL, `{"id": 10, "firstname": "Foo", "lastname": "Bar"}`)
+	postPerson(t, server.URL, `{"id": 11, "firstname": "Bin", "lastname": "Baz"}`)
+
+	cr := getChanges(t, server.URL+"/people/changes")
+	if len(cr.Events) != 2 {
+		t.Fatalf("got %d changes but expected 2", len(cr.Events))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, br := openEvents(t, ctx, server.URL, cr.Events[0].Token)
+	defer res.Body.Close()
+
+	fields := readSSE(t, br)
+	if fields["id"] != cr.Events[1].Token {
+		t.Errorf("got id %q but expected the missed event %q", fields["id"], cr.Events[1].Token)
+	}
+
+	postPerson(t, server.URL, `{"id": 12, "firstname": "Qux", "lastname": "Quux"}`)
+
+	var e changeEvent
+	if err := json.Unmarshal([]byte(readSSE(t, br)["data"]), &e); err != nil {
+		t.Fatalf("error during unmarshal: %s", err.Error())
+	}
+
+	if e.PersonID != 12 {
+		t.Errorf("got person %d but expected the live create of 12 without repeats", e.PersonID)
+	}
+}
+
+func Test_handlePeopleEventsGETInvalidLastEventID(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h, _ := newBrokerTestHandler(t, &ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/people/events", nil)
+	req.Header.Set("Last-Event-ID", "not a cursor")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during request: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func Test_handlePeopleEventsGETDisconnect(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h, broker := newBrokerTestHandler(t, &ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res, _ := openEvents(t, ctx, server.URL, "")
+
+	if n := broker.subscribers(); n != 1 {
+		t.Fatalf("got %d subscribers but expected 1", n)
+	}
+
+	cancel()
+	res.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for broker.subscribers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriber was not released after the client went away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_changeBrokerDropsSlowSubscriber(t *testing.T) {
+	ms := NewMemoryStore(0)
+	broker := newChangeBroker(&ms, noopLogger{}, time.Second)
+	slow, err := broker.subscribe(withTenant(context.Background(), defaultTenant))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i <= subscriberBuffer; i++ {
+		broker.publish(defaultTenant, changeEvent{Cursor: changeCursor{ID: int64(i + 1)}})
+	}
+
+	received := 0
+	for range slow.events {
+		received++
+	}
+
+	if received != subscriberBuffer {
+		t.Errorf("got %d events but expected the %d that fit", received, subscriberBuffer)
+	}
+
+	if n := broker.subscribers(); n != 0 {
+		t.Errorf("got %d subscribers but expected the slow one dropped", n)
+	}
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+const (
+	defaultConnectionFirst = 20
+	maxConnectionFirst     = 100
+
+	// maxQueryDepth and maxQueryCost bound what one request can ask for;
+	// see queryCost. Introspection queries nest type references deeply, so
+	// the depth leaves room for them.
+	maxQueryDepth = 15
+	maxQueryCost  = 1000
+)
+
+// graphqlRequest is what resolvers need from the request being served. It
+// travels in the context because the schema is shared by every request.
+type graphqlRequest struct {
+	actx   *AppContext
+	loader *personLoader
+}
+
+func graphqlRequestFromContext(ctx context.Context) *graphqlRequest {
+	gr, _ := ctx.Value(graphqlRequestKey).(*graphqlRequest)
+	return gr
+}
+
+// graphqlError carries a machine readable code in the error's extensions,
+// matching the status the REST handlers would have used.
+type graphqlError struct {
+	err  error
+	code string
+}
+
+func (e graphqlError) Error() string {
+	return e.err.Error()
+}
+
+func (e graphqlError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": e.code}
+}
+
+func graphqlStoreError(err error) error {
+	switch {
+	case errors.Is(err, errPersonNotFound):
+		return graphqlError{err, "NOT_FOUND"}
+	case errors.Is(err, errVersionMismatch):
+		return graphqlError{err, "PRECONDITION_FAILED"}
+	case errors.Is(err, errPersonNotDeleted), errors.Is(err, errEmailTaken):
+		return graphqlError{err, "CONFLICT"}
+	default:
+		return graphqlError{err, "BAD_REQUEST"}
+	}
+}
+
+// personLoader batches the person(id) lookups of a request. Loads only
+// queue their ID and return a thunk; the executor runs every thunk at one
+// depth after resolving that depth, so the first thunk run fetches the whole
+// queue with a single peopleForIDs call.
+type personLoader struct {
+	actx    *AppContext
+	ctx     context.Context
+	mu      sync.Mutex
+	pending []int
+	loaded  map[int]*Person
+	errs    map[int]error
+}
+
+func newPersonLoader(ctx context.Context, actx *AppContext) *personLoader {
+	return &personLoader{actx: actx, ctx: ctx, loaded: map[int]*Person{}, errs: map[int]error{}}
+}
+
+func (l *personLoader) load(id int) func() (interface{}, error) {
+	l.mu.Lock()
+	if _, ok := l.loaded[id]; !ok {
+		l.pending = append(l.pending, id)
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.flush()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if err := l.errs[id]; err != nil {
+			return nil, graphqlStoreError(err)
+		}
+
+		if p := l.loaded[id]; p != nil {
+			return *p, nil
+		}
+
+		return nil, nil
+	}
+}
+
+func (l *personLoader) flush() {
+	l.mu.Lock()
+	ids := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(l.ctx, l.actx.timeout)
+	defer cancel()
+	people, err := l.actx.storer.peopleForIDs(ctx, ids)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		l.loaded[id] = nil
+		if err != nil {
+			l.errs[id] = err
+		}
+	}
+	for i := range people {
+		l.loaded[people[i].ID] = &people[i]
+	}
+}
+
+type personEdge struct {
+	Cursor string `json:"cursor"`
+	Node   Person `json:"node"`
+}
+
+type pageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor"`
+	EndCursor       *string `json:"endCursor"`
+}
+
+type personConnection struct {
+	Edges      []personEdge `json:"edges"`
+	PageInfo   pageInfo     `json:"pageInfo"`
+	TotalCount int          `json:"totalCount"`
+}
+
+func personCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte("person:" + strconv.Itoa(id)))
+}
+
+func parsePersonCursor(s string) (int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		if id, ok := strings.CutPrefix(string(b), "person:"); ok {
+			if n, err := strconv.Atoi(id); err == nil {
+				return n, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("Invalid cursor: %q", s)
+}
+
+// personFilterFromArgs reads the people(filter) argument.
+func personFilterFromArgs(args map[string]interface{}) personFilter {
+	var f personFilter
+	m, _ := args["filter"].(map[string]interface{})
+	if v, ok := m["firstname"].(string); ok {
+		f.FirstName = v
+	}
+	if v, ok := m["lastname"].(string); ok {
+		f.LastName = v
+	}
+	if v, ok := m["minAge"].(int); ok {
+		f.MinAge = &v
+	}
+	if v, ok := m["maxAge"].(int); ok {
+		f.MaxAge = &v
+	}
+	if v, ok := m["includeDeleted"].(bool); ok {
+		f.IncludeDeleted = v
+	}
+	if v, ok := m["asOf"].(time.Time); ok {
+		f.AsOf = v
+	}
+
+	return f
+}
+
+// resolvePeople pages through the matching people in ID order, leaving the
+// filtering, ordering and counting to the store.
+func resolvePeople(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+
+	first := defaultConnectionFirst
+	if v, ok := p.Args["first"].(int); ok {
+		if v < 0 || v > maxConnectionFirst {
+			return nil, graphqlError{fmt.Errorf("first must be between 0 and %d", maxConnectionFirst), "BAD_REQUEST"}
+		}
+		first = v
+	}
+
+	after := 0
+	if v, ok := p.Args["after"].(string); ok {
+		var err error
+		if after, err = parsePersonCursor(v); err != nil {
+			return nil, graphqlError{err, "BAD_REQUEST"}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(p.Context, gr.actx.timeout)
+	defer cancel()
+
+	page, err := gr.actx.storer.pagePeople(ctx, personFilterFromArgs(p.Args), after, first)
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	conn := personConnection{
+		Edges:      []personEdge{},
+		TotalCount: page.Total,
+		PageInfo: pageInfo{
+			HasNextPage:     page.Before+len(page.People) < page.Total,
+			HasPreviousPage: page.Before > 0,
+		},
+	}
+	for _, p := range page.People {
+		conn.Edges = append(conn.Edges, personEdge{Cursor: personCursor(p.ID), Node: p})
+	}
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.StartCursor = &conn.Edges[0].Cursor
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+
+	return conn, nil
+}
+
+func resolvePerson(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+	return gr.loader.load(p.Args["id"].(int)), nil
+}
+
+// personFromInput fills in the fields of p present in a PersonInput or
+// PersonPatch argument.
+func personFromInput(p Person, input map[string]interface{}) Person {
+	if v, ok := input["id"].(int); ok {
+		p.ID = v
+	}
+	if v, ok := input["firstname"].(string); ok {
+		p.FirstName = v
+	}
+	if v, ok := input["lastname"].(string); ok {
+		p.LastName = v
+	}
+	if v, ok := input["age"].(int); ok {
+		p.Age = v
+	}
+	if v, ok := input["email"].(string); ok {
+		p.Email = v
+	}
+	if v, ok := input["phone"].(string); ok {
+		p.Phone = v
+	}
+	if v, ok := input["dateOfBirth"].(string); ok {
+		p.DateOfBirth = v
+	}
+
+	return p
+}
+
+func resolveCreatePerson(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+	person := personFromInput(Person{}, p.Args["input"].(map[string]interface{}))
+	if err := validatePerson(person); err != nil {
+		return nil, graphqlError{err, "BAD_REQUEST"}
+	}
+
+	ctx, cancel := context.WithTimeout(p.Context, gr.actx.timeout)
+	defer cancel()
+
+	up, err := gr.actx.storer.addPerson(ctx, person)
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	return up, nil
+}
+
+// resolveUpdatePerson replaces a person like PUT, with version standing in
+// for If-Match. The input has no attributes, so the stored ones are kept.
+func resolveUpdatePerson(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+	id := p.Args["id"].(int)
+	version, _ := p.Args["version"].(int)
+	person := personFromInput(Person{}, p.Args["input"].(map[string]interface{}))
+	if err := validatePerson(person); err != nil {
+		return nil, graphqlError{err, "BAD_REQUEST"}
+	}
+
+	ctx, cancel := context.WithTimeout(p.Context, gr.actx.timeout)
+	defer cancel()
+
+	person, version, err := keepAttributes(ctx, gr.actx.storer, id, person, version)
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	up, err := gr.actx.storer.updatePerson(ctx, id, person, version)
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	return up, nil
+}
+
+// resolvePatchPerson changes only the given fields like PATCH, conditioned
+// on the version read so a concurrent update is never silently undone.
+func resolvePatchPerson(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+	id := p.Args["id"].(int)
+
+	ctx, cancel := context.WithTimeout(p.Context, gr.actx.timeout)
+	defer cancel()
+
+	person, err := gr.actx.storer.personForID(ctx, id, personQuery{})
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	if version, ok := p.Args["version"].(int); ok && version != person.Version {
+		return nil, graphqlStoreError(errVersionMismatch)
+	}
+
+	patched := personFromInput(*person, p.Args["input"].(map[string]interface{}))
+	if err := validatePerson(patched); err != nil {
+		return nil, graphqlError{err, "BAD_REQUEST"}
+	}
+
+	up, err := gr.actx.storer.updatePerson(ctx, id, patched, person.Version)
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	return up, nil
+}
+
+func resolveDeletePerson(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+	id := p.Args["id"].(int)
+	version, _ := p.Args["version"].(int)
+
+	ctx, cancel := context.WithTimeout(p.Context, gr.actx.timeout)
+	defer cancel()
+
+	if err := gr.actx.storer.deletePerson(ctx, id, version); err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	return true, nil
+}
+
+func resolveRestorePerson(p graphql.ResolveParams) (interface{}, error) {
+	gr := graphqlRequestFromContext(p.Context)
+
+	ctx, cancel := context.WithTimeout(p.Context, gr.actx.timeout)
+	defer cancel()
+
+	rp, err := gr.actx.storer.restorePerson(ctx, p.Args["id"].(int))
+	if err != nil {
+		return nil, graphqlStoreError(err)
+	}
+
+	return rp, nil
+}
+
+var graphqlSchema = newGraphQLSchema()
+
+// contactField resolves one of a person's optional contact details, which
+// are null rather than empty when unset.
+func contactField(get func(Person) string) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.String,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if person, ok := p.Source.(Person); ok && get(person) != "" {
+				return get(person), nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+func newGraphQLSchema() graphql.Schema {
+	personType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Person",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"firstname":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"lastname":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"age":         &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"version":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"email":       contactField(func(p Person) string { return p.Email }),
+			"phone":       contactField(func(p Person) string { return p.Phone }),
+			"dateOfBirth": contactField(func(p Person) string { return p.DateOfBirth }),
+			"deletedAt": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if person, ok := p.Source.(Person); ok && person.DeletedAt != nil {
+						return *person.DeletedAt, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+
+	edgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PersonEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(personType)},
+		},
+	})
+
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"hasPreviousPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"startCursor":     &graphql.Field{Type: graphql.String},
+			"endCursor":       &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	connectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PersonConnection",
+		Fields: graphql.Fields{
+			"edges":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edgeType)))},
+			"pageInfo":   &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+			"totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	filterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "PersonFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"firstname":      &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"lastname":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"minAge":         &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"maxAge":         &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"includeDeleted": &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			"asOf":           &graphql.InputObjectFieldConfig{Type: graphql.DateTime},
+		},
+	})
+
+	inputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "PersonInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"id":          &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"firstname":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"lastname":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"age":         &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"email":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"dateOfBirth": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	patchType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "PersonPatch",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"firstname":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"lastname":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"age":         &graphql.InputObjectFieldConfig{Type: graphql.Int},
+			"email":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"phone":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"dateOfBirth": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	idArg := &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}
+	versionArg := &graphql.ArgumentConfig{Type: graphql.Int}
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"person": &graphql.Field{
+				Type:    personType,
+				Args:    graphql.FieldConfigArgument{"id": idArg},
+				Resolve: resolvePerson,
+			},
+			"people": &graphql.Field{
+				Type: graphql.NewNonNull(connectionType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: filterType},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int},
+					"after":  &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: resolvePeople,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createPerson": &graphql.Field{
+				Type:    graphql.NewNonNull(personType),
+				Args:    graphql.FieldConfigArgument{"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(inputType)}},
+				Resolve: resolveCreatePerson,
+			},
+			"updatePerson": &graphql.Field{
+				Type: graphql.NewNonNull(personType),
+				Args: graphql.FieldConfigArgument{
+					"id":      idArg,
+					"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(inputType)},
+					"version": versionArg,
+				},
+				Resolve: resolveUpdatePerson,
+			},
+			"patchPerson": &graphql.Field{
+				Type: graphql.NewNonNull(personType),
+				Args: graphql.FieldConfigArgument{
+					"id":      idArg,
+					"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(patchType)},
+					"version": versionArg,
+				},
+				Resolve: resolvePatchPerson,
+			},
+			"deletePerson": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.Boolean),
+				Args:    graphql.FieldConfigArgument{"id": idArg, "version": versionArg},
+				Resolve: resolveDeletePerson,
+			},
+			"restorePerson": &graphql.Field{
+				Type:    graphql.NewNonNull(personType),
+				Args:    graphql.FieldConfigArgument{"id": idArg},
+				Resolve: resolveRestorePerson,
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		panic(fmt.Sprintf("invalid GraphQL schema: %v", err))
+	}
+
+	return schema
+}
+
+type graphqlRequestBody struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// handleGraphQLPOST executes a GraphQL query or mutation. Like any GraphQL
+// server it answers 200 whenever the request could be read, with failures
+// reported in the errors of the result.
+func handleGraphQLPOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	var body graphqlRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := checkQueryLimits(body.Query); err != nil {
+		writeJSON(w, http.StatusOK, &graphql.Result{Errors: []gqlerrors.FormattedError{{
+			Message:    err.Error(),
+			Extensions: graphqlError{err, "BAD_REQUEST"}.Extensions(),
+		}}})
+		return
+	}
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, graphqlRequestKey, &graphqlRequest{
+		actx:   actx,
+		loader: newPersonLoader(ctx, actx),
+	})
+
+	result := graphql.Do(graphql.Params{
+		Schema:         graphqlSchema,
+		RequestString:  body.Query,
+		VariableValues: body.Variables,
+		OperationName:  body.OperationName,
+		Context:        ctx,
+	})
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// checkQueryLimits rejects a query deeper than maxQueryDepth or costlier than
+// maxQueryCost in any of its operations. A query that doesn't parse is left
+// for graphql.Do to report.
+func checkQueryLimits(query string) error {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return nil
+	}
+
+	qc := queryCost{fragments: map[string]*ast.FragmentDefinition{}, visiting: map[string]bool{}, walked: map[string][2]int{}}
+	for _, def := range doc.Definitions {
+		if fd, ok := def.(*ast.FragmentDefinition); ok {
+			qc.fragments[fd.Name.Value] = fd
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		od, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+
+		depth, cost := qc.selectionSet(od.SelectionSet)
+		if depth > maxQueryDepth {
+			return fmt.Errorf("Query is nested %d fields deep, more than the %d allowed", depth, maxQueryDepth)
+		}
+		if cost > maxQueryCost {
+			return fmt.Errorf("Query costs %d, more than the %d allowed", cost, maxQueryCost)
+		}
+	}
+
+	return nil
+}
+
+// queryCost works out how deep a selection set nests and what it costs.
+// Every field costs 1, and a people field also costs the number of people
+// it pages through, taken as maxConnectionFirst when first is a variable.
+// Fragments count wherever they are spread, and are only walked once, so
+// that fragments spreading each other many times over can't make the walk
+// itself expensive.
+type queryCost struct {
+	fragments map[string]*ast.FragmentDefinition
+	visiting  map[string]bool
+	walked    map[string][2]int
+}
+
+func (qc queryCost) selectionSet(set *ast.SelectionSet) (depth int, cost int) {
+	if set == nil {
+		return 0, 0
+	}
+
+	for _, sel := range set.Selections {
+		var d, c int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d, c = qc.selectionSet(sel.SelectionSet)
+			d, c = d+1, c+1
+			if sel.Name.Value == "people" {
+				c += connectionFirst(sel.Arguments)
+			}
+		case *ast.InlineFragment:
+			d, c = qc.selectionSet(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			// A fragment that spreads itself fails validation anyway.
+			name := sel.Name.Value
+			fd := qc.fragments[name]
+			if fd == nil || qc.visiting[name] {
+				continue
+			}
+			if w, ok := qc.walked[name]; ok {
+				d, c = w[0], w[1]
+				break
+			}
+			qc.visiting[name] = true
+			d, c = qc.selectionSet(fd.SelectionSet)
+			delete(qc.visiting, name)
+			qc.walked[name] = [2]int{d, c}
+		}
+
+		if d > depth {
+			depth = d
+		}
+		// Capping the cost keeps it from overflowing; past the limit, how
+		// far past doesn't matter.
+		cost += c
+		if cost > maxQueryCost {
+			cost = maxQueryCost + 1
+		}
+	}
+
+	return depth, cost
+}
+
+// connectionFirst is the first argument among args as far as the query text
+// tells. Values out of range fail when resolved, so they count as the most.
+func connectionFirst(args []*ast.Argument) int {
+	for _, arg := range args {
+		if arg.Name.Value != "first" {
+			continue
+		}
+		if v, ok := arg.Value.(*ast.IntValue); ok {
+			if n, err := strconv.Atoi(v.Value); err == nil && n >= 0 && n <= maxConnectionFirst {
+				return n
+			}
+		}
+		return maxConnectionFirst
+	}
+
+	return defaultConnectionFirst
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type graphqlTestResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string         `json:"message"`
+		Extensions map[string]any `json:"extensions"`
+	} `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, url string, query string, variables map[string]any) graphqlTestResponse {
+	body, _ := json.Marshal(map[string]any{"query": query, "variables": variables})
+	res, err := http.Post(url+"/graphql", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	var gr graphqlTestResponse
+	if err := json.NewDecoder(res.Body).Decode(&gr); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return gr
+}
+
+// countingStore counts the batched lookups made through it.
+type countingStore struct {
+	*MemoryStore
+	batches [][]int
+}
+
+func (cs *countingStore) peopleForIDs(ctx context.Context, ids []int) ([]Person, error) {
+	cs.batches = append(cs.batches, ids)
+	return cs.MemoryStore.peopleForIDs(ctx, ids)
+}
+
+func Test_graphqlPersonBatchesLookups(t *testing.T) {
+	ms := NewMemoryStore(0)
+	cs := &countingStore{MemoryStore: &ms}
+	server := httptest.NewServer(newTestHandler(cs))
+	defer server.Close()
+
+	gr := postGraphQL(t, server.URL, `{
+		a: person(id: 1) { firstname }
+		b: person(id: 2) { firstname lastname }
+		c: person(id: 99) { id }
+	}`, nil)
+
+	if len(gr.Errors) > 0 {
+		t.Fatalf("got errors %v", gr.Errors)
+	}
+
+	var a, b Person
+	json.Unmarshal(gr.Data["a"], &a)
+	json.Unmarshal(gr.Data["b"], &b)
+	if a.FirstName != "Bob" || b.FirstName != "Fred" || b.LastName != "Flintstone" {
+		t.Errorf("got a %s and b %s but expected Bob and Fred Flintstone", gr.Data["a"], gr.Data["b"])
+	}
+
+	if string(gr.Data["c"]) != "null" {
+		t.Errorf("got c %s but expected null for a missing person", gr.Data["c"])
+	}
+
+	if len(cs.batches) != 1 || len(cs.batches[0]) != 3 {
+		t.Errorf("got lookups %v but expected all three IDs in one batch", cs.batches)
+	}
+}
+
+func Test_graphqlPeopleConnection(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	type connection struct {
+		Edges []struct {
+			Cursor string `json:"cursor"`
+			Node   Person `json:"node"`
+		} `json:"edges"`
+		PageInfo   pageInfo `json:"pageInfo"`
+		TotalCount int      `json:"totalCount"`
+	}
+
+	query := `query ($after: String, $filter: PersonFilter) {
+		people(first: 2, after: $after, filter: $filter) {
+			edges { cursor node { id firstname } }
+			pageInfo { hasNextPage hasPreviousPage endCursor }
+			totalCount
+		}
+	}`
+
+	var page connection
+	gr := postGraphQL(t, server.URL, query, nil)
+	json.Unmarshal(gr.Data["people"], &page)
+
+	if len(page.Edges) != 2 || page.Edges[0].Node.ID != 1 || page.Edges[1].Node.ID != 2 || !page.PageInfo.HasNextPage || page.TotalCount != 3 {
+		t.Fatalf("got first page %+v but expected 1 and 2 of 3 with more to come", page)
+	}
+
+	gr = postGraphQL(t, server.URL, query, map[string]any{"after": *page.PageInfo.EndCursor})
+	json.Unmarshal(gr.Data["people"], &page)
+
+	if len(page.Edges) != 1 || page.Edges[0].Node.ID != 3 || page.PageInfo.HasNextPage || !page.PageInfo.HasPreviousPage {
+		t.Errorf("got second page %+v but expected only 3", page)
+	}
+
+	gr = postGraphQL(t, server.URL, query, map[string]any{"filter": map[string]any{"minAge": 45}})
+	json.Unmarshal(gr.Data["people"], &page)
+
+	if page.TotalCount != 2 || page.Edges[0].Node.FirstName != "Bob" || page.Edges[1].Node.FirstName != "Joan" {
+		t.Errorf("got %+v but expected Bob and Joan", page)
+	}
+}
+
+func Test_graphqlMutations(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	gr := postGraphQL(t, server.URL, `mutation {
+		createPerson(input: {id: 10, firstname: "Foo", lastname: "Bar", age: 30}) { id version }
+	}`, nil)
+	var created Person
+	json.Unmarshal(gr.Data["createPerson"], &created)
+	if created.ID != 10 || created.Version != 1 {
+		t.Fatalf("got %s and errors %v but expected person 10 at version 1", gr.Data["createPerson"], gr.Errors)
+	}
+
+	gr = postGraphQL(t, server.URL, `mutation { patchPerson(id: 10, version: 7, input: {age: 31}) { id } }`, nil)
+	if len(gr.Errors) != 1 || gr.Errors[0].Extensions["code"] != "PRECONDITION_FAILED" {
+		t.Errorf("got errors %v but expected PRECONDITION_FAILED", gr.Errors)
+	}
+
+	gr = postGraphQL(t, server.URL, `mutation { patchPerson(id: 10, version: 1, input: {age: 31}) { firstname age version } }`, nil)
+	var patched Person
+	json.Unmarshal(gr.Data["patchPerson"], &patched)
+	if patched.FirstName != "Foo" || patched.Age != 31 || patched.Version != 2 {
+		t.Errorf("got %s and errors %v but expected only the age to change", gr.Data["patchPerson"], gr.Errors)
+	}
+
+	gr = postGraphQL(t, server.URL, `mutation { deletePerson(id: 10) }`, nil)
+	if string(gr.Data["deletePerson"]) != "true" {
+		t.Errorf("got %s and errors %v but expected true", gr.Data["deletePerson"], gr.Errors)
+	}
+
+	gr = postGraphQL(t, server.URL, `mutation { deletePerson(id: 10) }`, nil)
+	if len(gr.Errors) != 1 || gr.Errors[0].Extensions["code"] != "NOT_FOUND" {
+		t.Errorf("got errors %v but expected NOT_FOUND", gr.Errors)
+	}
+
+	gr = postGraphQL(t, server.URL, `{ person(id: 10) { id } }`, nil)
+	if string(gr.Data["person"]) != "null" {
+		t.Errorf("got %s but expected a deleted person to be null", gr.Data["person"])
+	}
+}
+
+func Test_graphqlContactDetails(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	gr := postGraphQL(t, server.URL, `mutation {
+		patchPerson(id: 1, input: {email: "bob@example.com", phone: "+14155550123"}) { email phone dateOfBirth }
+	}`, nil)
+	exp := `{"dateOfBirth":null,"email":"bob@example.com","phone":"+14155550123"}`
+	if string(gr.Data["patchPerson"]) != exp {
+		t.Errorf("got %s and errors %v but expected %s", gr.Data["patchPerson"], gr.Errors, exp)
+	}
+
+	gr = postGraphQL(t, server.URL, `mutation { patchPerson(id: 2, input: {email: "BOB@example.com"}) { id } }`, nil)
+	if len(gr.Errors) != 1 || gr.Errors[0].Extensions["code"] != "CONFLICT" {
+		t.Errorf("got errors %v but expected CONFLICT", gr.Errors)
+	}
+
+	gr = postGraphQL(t, server.URL, `mutation { patchPerson(id: 2, input: {dateOfBirth: "yesterday"}) { id } }`, nil)
+	if len(gr.Errors) != 1 || gr.Errors[0].Extensions["code"] != "BAD_REQUEST" {
+		t.Errorf("got errors %v but expected BAD_REQUEST", gr.Errors)
+	}
+}
+
+func Test_graphqlUpdateKeepsAttributes(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	if _, err := ms.updatePerson(ctx, 1, Person{FirstName: "Bob", LastName: "Barker", Attributes: attributes{"department": "eng"}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	gr := postGraphQL(t, server.URL, `mutation { updatePerson(id: 1, input: {firstname: "Bob", lastname: "Smith"}) { lastname version } }`, nil)
+	if string(gr.Data["updatePerson"]) != `{"lastname":"Smith","version":3}` {
+		t.Fatalf("got %s and errors %v but expected Smith at version 3", gr.Data["updatePerson"], gr.Errors)
+	}
+
+	p, err := ms.personForID(ctx, 1, personQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Attributes["department"] != "eng" {
+		t.Errorf("got attributes %v but expected the update to keep department", p.Attributes)
+	}
+}
+
+func Test_handleGraphQLPOSTInvalidBody(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/graphql", "application/json", strings.NewReader(`{"query":`))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func Test_graphqlQueryLimits(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	deep := `{ __schema { types { name } } __type(name: "Person") { name ` +
+		strings.Repeat(`ofType { `, maxQueryDepth) + `name` + strings.Repeat(` }`, maxQueryDepth) + ` } }`
+
+	var pages strings.Builder
+	for i := 0; i <= maxQueryCost/maxConnectionFirst; i++ {
+		fmt.Fprintf(&pages, "p%d: people(first: %d) { totalCount } ", i, maxConnectionFirst)
+	}
+
+	fragments := `query { ...f0 } fragment f0 on Query { person(id: 1) { id } }`
+	for i := 1; i <= 64; i++ {
+		fragments += fmt.Sprintf(" fragment f%d on Query { ...f%d ...f%d }", i, i-1, i-1)
+	}
+	fragments = strings.Replace(fragments, "...f0 }", fmt.Sprintf("...f%d }", 64), 1)
+
+	for _, tc := range []struct {
+		query string
+		fails bool
+	}{
+		{query: `{ people(first: 100) { edges { node { id firstname } } totalCount } }`},
+		{query: deep, fails: true},
+		{query: "{ " + pages.String() + "}", fails: true},
+		{query: fragments, fails: true},
+	} {
+		gr := postGraphQL(t, server.URL, tc.query, nil)
+		failed := len(gr.Errors) > 0 && gr.Errors[0].Extensions["code"] == "BAD_REQUEST"
+		if failed != tc.fails {
+			t.Errorf("got errors %+v for %.60q but expected a limit error %t", gr.Errors, tc.query, tc.fails)
+		}
+	}
+}
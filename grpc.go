@@ -0,0 +1,291 @@
+package main
+
+//go:generate protoc -I proto --go_out=peoplepb --go_opt=paths=source_relative --go-grpc_out=peoplepb --go-grpc_opt=paths=source_relative people.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"api/peoplepb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcAddr is where the gRPC PeopleService listens, next to the REST API.
+const grpcAddr = ":9090"
+
+// peopleServer implements PeopleService over the same store as the REST
+// handlers.
+type peopleServer struct {
+	peoplepb.UnimplementedPeopleServiceServer
+	actx *AppContext
+}
+
+// newGRPCServer returns a server with PeopleService registered behind the
+// gRPC equivalents of requestMw, tenantMw and logMw.
+func newGRPCServer(actx *AppContext) *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcRequestUnary, grpcTenantUnary(actx), grpcLogUnary(actx)),
+		grpc.ChainStreamInterceptor(grpcRequestStream, grpcTenantStream(actx), grpcLogStream(actx)),
+	)
+	peoplepb.RegisterPeopleServiceServer(s, &peopleServer{actx: actx})
+
+	return s
+}
+
+// grpcRequestContext tags the call with a request ID and actor taken from
+// the x-request-id and x-actor metadata, the same way requestMw reads the
+// headers, and sends the request ID back in the response header.
+func grpcRequestContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	id := callerRequestID(firstMetadata(md, "x-request-id"))
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+
+	ctx = withRequestID(ctx, id)
+	return withActor(ctx, firstMetadata(md, "x-actor"))
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func grpcRequestUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	return handler(grpcRequestContext(ctx), req)
+}
+
+func grpcRequestStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextServerStream{ServerStream: ss, ctx: grpcRequestContext(ss.Context())})
+}
+
+// grpcTenantContext scopes the call to the tenant named by the
+// authorization and x-tenant-id metadata and the authority, the same way
+// tenantMw reads the headers and host.
+func grpcTenantContext(actx *AppContext, ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id, err := actx.tenants.resolve(tenantSource{
+		authorization: firstMetadata(md, "authorization"),
+		header:        firstMetadata(md, "x-tenant-id"),
+		host:          firstMetadata(md, ":authority"),
+	})
+	switch {
+	case errors.Is(err, errInvalidToken):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, errTenantMismatch), errors.Is(err, errTenantUntrusted):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return withIdentity(ctx, actx.tenants, id), nil
+}
+
+func grpcTenantUnary(actx *AppContext) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := grpcTenantContext(actx, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func grpcTenantStream(actx *AppContext) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := grpcTenantContext(actx, ss.Context())
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// contextServerStream replaces the context of a server stream.
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func grpcLogUnary(actx *AppContext) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		defer grpcLog(actx, ctx, info.FullMethod, time.Now())
+		return handler(ctx, req)
+	}
+}
+
+func grpcLogStream(actx *AppContext) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		defer grpcLog(actx, ss.Context(), info.FullMethod, time.Now())
+		return handler(srv, ss)
+	}
+}
+
+func grpcLog(actx *AppContext, ctx context.Context, method string, t time.Time) {
+	actx.logger.info(loggerPayload{
+		Duration:  time.Since(t).String(),
+		URL:       method,
+		Method:    "GRPC",
+		RequestID: requestIDFromContext(ctx),
+	})
+}
+
+// grpcError maps a store error to the status code matching the REST status.
+// Like writeStoreError, it only describes errors clients can act on; anything
+// else is logged and reported as Internal without its details, since it may
+// be a database error.
+func (s *peopleServer) grpcError(ctx context.Context, err error) error {
+	var ve *validationError
+	switch {
+	case errors.Is(err, errPersonNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errVersionMismatch), errors.Is(err, errPersonNotDeleted):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errEmailTaken), errors.Is(err, errPersonExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.As(err, &ve):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, "The request was canceled")
+	}
+
+	s.actx.logger.error(fmt.Errorf("request %s: %w", requestIDFromContext(ctx), err))
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, internalErrorDetail(err))
+	}
+	return status.Error(codes.Internal, internalErrorDetail(err))
+}
+
+func personToProto(p Person) *peoplepb.Person {
+	pp := &peoplepb.Person{
+		Id:          int64(p.ID),
+		Firstname:   p.FirstName,
+		Lastname:    p.LastName,
+		Age:         int32(p.Age),
+		Version:     int32(p.Version),
+		Email:       p.Email,
+		Phone:       p.Phone,
+		DateOfBirth: p.DateOfBirth,
+	}
+	if p.DeletedAt != nil {
+		pp.DeletedAt = timestamppb.New(*p.DeletedAt)
+	}
+
+	return pp
+}
+
+func personFromProto(pp *peoplepb.Person) Person {
+	return Person{
+		ID:          int(pp.GetId()),
+		FirstName:   pp.GetFirstname(),
+		LastName:    pp.GetLastname(),
+		Age:         int(pp.GetAge()),
+		Email:       pp.GetEmail(),
+		Phone:       pp.GetPhone(),
+		DateOfBirth: pp.GetDateOfBirth(),
+	}
+}
+
+func personQueryFromProto(includeDeleted bool, asOf *timestamppb.Timestamp) personQuery {
+	pq := personQuery{IncludeDeleted: includeDeleted}
+	if asOf != nil {
+		pq.AsOf = asOf.AsTime()
+	}
+
+	return pq
+}
+
+func (s *peopleServer) Get(ctx context.Context, req *peoplepb.GetPersonRequest) (*peoplepb.Person, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.actx.timeout)
+	defer cancel()
+
+	p, err := s.actx.storer.personForID(ctx, int(req.GetId()), personQueryFromProto(req.GetIncludeDeleted(), req.GetAsOf()))
+	if err != nil {
+		return nil, s.grpcError(ctx, err)
+	}
+
+	return personToProto(*p), nil
+}
+
+// List streams people as the store reads them. Like the JSON listing, it
+// may take as long as it needs, as long as no row takes longer than the
+// request timeout.
+func (s *peopleServer) List(req *peoplepb.ListPeopleRequest, stream peoplepb.PeopleService_ListServer) error {
+	ctx, touch, cancel := withIdleTimeout(stream.Context(), s.actx.timeout)
+	defer cancel()
+
+	err := s.actx.storer.eachPerson(ctx, personQueryFromProto(req.GetIncludeDeleted(), req.GetAsOf()), func(p Person) error {
+		touch()
+		return stream.Send(personToProto(p))
+	})
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return s.grpcError(ctx, idleError(ctx, err))
+	}
+
+	return nil
+}
+
+func (s *peopleServer) Create(ctx context.Context, req *peoplepb.CreatePersonRequest) (*peoplepb.Person, error) {
+	p := personFromProto(req.GetPerson())
+	if err := validatePerson(p); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.actx.timeout)
+	defer cancel()
+
+	up, err := s.actx.storer.addPerson(ctx, p)
+	if err != nil {
+		return nil, s.grpcError(ctx, err)
+	}
+
+	return personToProto(up), nil
+}
+
+func (s *peopleServer) Update(ctx context.Context, req *peoplepb.UpdatePersonRequest) (*peoplepb.Person, error) {
+	p := personFromProto(req.GetPerson())
+	if err := validatePerson(p); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.actx.timeout)
+	defer cancel()
+
+	p, version, err := keepAttributes(ctx, s.actx.storer, int(req.GetId()), p, int(req.GetVersion()))
+	if err != nil {
+		return nil, s.grpcError(ctx, err)
+	}
+
+	up, err := s.actx.storer.updatePerson(ctx, int(req.GetId()), p, version)
+	if err != nil {
+		return nil, s.grpcError(ctx, err)
+	}
+
+	return personToProto(up), nil
+}
+
+func (s *peopleServer) Delete(ctx context.Context, req *peoplepb.DeletePersonRequest) (*peoplepb.DeletePersonResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.actx.timeout)
+	defer cancel()
+
+	if err := s.actx.storer.deletePerson(ctx, int(req.GetId()), int(req.GetVersion())); err != nil {
+		return nil, s.grpcError(ctx, err)
+	}
+
+	return &peoplepb.DeletePersonResponse{}, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"api/peoplepb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestGRPCClient(t *testing.T, ss Storer) peoplepb.PeopleServiceClient {
+	return newTestGRPCClientLogging(t, ss, noopLogger{})
+}
+
+func newTestGRPCClientLogging(t *testing.T, ss Storer, l logger) peoplepb.PeopleServiceClient {
+	return newTestGRPCClientFor(t, &AppContext{
+		storer:  ss,
+		timeout: time.Second,
+		logger:  l,
+	})
+}
+
+func newTestGRPCClientFor(t *testing.T, actx *AppContext) peoplepb.PeopleServiceClient {
+	lis := bufconn.Listen(1024 * 1024)
+	s := newGRPCServer(actx)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("error dialing: %s", err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return peoplepb.NewPeopleServiceClient(conn)
+}
+
+func Test_peopleServerGet(t *testing.T) {
+	ms := NewMemoryStore(0)
+	client := newTestGRPCClient(t, &ms)
+	ctx := context.Background()
+
+	p, err := client.Get(ctx, &peoplepb.GetPersonRequest{Id: 1})
+	if err != nil {
+		t.Fatalf("error during Get: %s", err.Error())
+	}
+
+	if p.Firstname != "Bob" || p.Version != 1 {
+		t.Errorf("got %v but expected Bob at version 1", p)
+	}
+
+	_, err = client.Get(ctx, &peoplepb.GetPersonRequest{Id: 99})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v but expected NotFound", err)
+	}
+
+	// The test server doesn't trust x-tenant-id, so naming a tenant fails.
+	acme := metadata.AppendToOutgoingContext(ctx, "x-tenant-id", "acme")
+	_, err = client.Get(acme, &peoplepb.GetPersonRequest{Id: 1})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("got %v but expected PermissionDenied", err)
+	}
+}
+
+func Test_peopleServerList(t *testing.T) {
+	ms := NewMemoryStore(0)
+	client := newTestGRPCClient(t, &ms)
+
+	stream, err := client.List(context.Background(), &peoplepb.ListPeopleRequest{})
+	if err != nil {
+		t.Fatalf("error during List: %s", err.Error())
+	}
+
+	var names []string
+	for {
+		p, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error during Recv: %s", err.Error())
+		}
+		names = append(names, p.Firstname)
+	}
+
+	if len(names) != 3 {
+		t.Errorf("got %v but expected three people", names)
+	}
+}
+
+func Test_peopleServerListIdleTimeout(t *testing.T) {
+	slow := func(first time.Duration) StorerStub {
+		return StorerStub{
+			eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+				for i, wait := range []time.Duration{first, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond} {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					if err := fn(Person{ID: i, FirstName: "Foo", LastName: "Bar"}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+	list := func(ss Storer) (int, error) {
+		client := newTestGRPCClientFor(t, &AppContext{storer: ss, timeout: 30 * time.Millisecond, logger: noopLogger{}})
+		stream, err := client.List(context.Background(), &peoplepb.ListPeopleRequest{})
+		if err != nil {
+			return 0, err
+		}
+		var n int
+		for {
+			if _, err := stream.Recv(); err == io.EOF {
+				return n, nil
+			} else if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+
+	// Every row arrives within the 30ms timeout, but not all of them do.
+	if n, err := list(slow(10 * time.Millisecond)); err != nil || n != 5 {
+		t.Errorf("got %d people and error %v but expected all 5", n, err)
+	}
+
+	if _, err := list(slow(time.Second)); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got %v but expected DeadlineExceeded", err)
+	}
+}
+
+func Test_peopleServerWrites(t *testing.T) {
+	ms := NewMemoryStore(0)
+	client := newTestGRPCClient(t, &ms)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-actor", "grpc-client", "x-request-id", "req-1")
+
+	var header metadata.MD
+	created, err := client.Create(ctx, &peoplepb.CreatePersonRequest{Person: &peoplepb.Person{Id: 10, Firstname: "Foo", Lastname: "Bar"}}, grpc.Header(&header))
+	if err != nil {
+		t.Fatalf("error during Create: %s", err.Error())
+	}
+
+	if ids := header.Get("x-request-id"); len(ids) != 1 || ids[0] != "req-1" {
+		t.Errorf("got x-request-id %v but expected req-1", ids)
+	}
+
+	history, _ := ms.personHistory(withTenant(ctx, defaultTenant), 10)
+	if len(history) != 1 || history[0].Actor != "grpc-client" || history[0].RequestID != "req-1" {
+		t.Errorf("got history %+v but expected the create by grpc-client in req-1", history)
+	}
+
+	_, err = client.Create(ctx, &peoplepb.CreatePersonRequest{Person: &peoplepb.Person{Id: 11}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v but expected InvalidArgument", err)
+	}
+
+	_, err = client.Update(ctx, &peoplepb.UpdatePersonRequest{Id: 10, Version: created.Version + 1, Person: &peoplepb.Person{Firstname: "Foo", Lastname: "Baz"}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v but expected FailedPrecondition", err)
+	}
+
+	updated, err := client.Update(ctx, &peoplepb.UpdatePersonRequest{Id: 10, Version: created.Version, Person: &peoplepb.Person{Firstname: "Foo", Lastname: "Baz"}})
+	if err != nil {
+		t.Fatalf("error during Update: %s", err.Error())
+	}
+
+	if updated.Lastname != "Baz" || updated.Version != 2 {
+		t.Errorf("got %v but expected Baz at version 2", updated)
+	}
+
+	if _, err := client.Delete(ctx, &peoplepb.DeletePersonRequest{Id: 10}); err != nil {
+		t.Fatalf("error during Delete: %s", err.Error())
+	}
+
+	_, err = client.Delete(ctx, &peoplepb.DeletePersonRequest{Id: 10})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v but expected NotFound", err)
+	}
+}
+
+func Test_peopleServerUpdateKeepsAttributes(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	if _, err := ms.updatePerson(ctx, 1, Person{FirstName: "Bob", LastName: "Barker", Attributes: attributes{"department": "eng"}}, 1); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestGRPCClient(t, &ms)
+
+	updated, err := client.Update(context.Background(), &peoplepb.UpdatePersonRequest{Id: 1, Person: &peoplepb.Person{Firstname: "Bob", Lastname: "Smith"}})
+	if err != nil {
+		t.Fatalf("error during Update: %s", err.Error())
+	}
+	if updated.Lastname != "Smith" || updated.Version != 3 {
+		t.Errorf("got %v but expected Smith at version 3", updated)
+	}
+
+	p, err := ms.personForID(ctx, 1, personQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Attributes["department"] != "eng" {
+		t.Errorf("got attributes %v but expected the update to keep department", p.Attributes)
+	}
+}
+
+func Test_peopleServerErrors(t *testing.T) {
+	l := &recordingLogger{}
+	client := newTestGRPCClientLogging(t, StorerStub{
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
+			if id == 2 {
+				return &Person{ID: 2, FirstName: "Foo", LastName: "Bar", Version: 1}, nil
+			}
+			return nil, errors.New("ERROR: relation \"people\" does not exist (SQLSTATE 42P01)")
+		},
+		updatePersonStub: func(ctx context.Context, id int, p Person, version int) (Person, error) {
+			return Person{}, &validationError{Name: "attributes.level", Reason: "must be a number"}
+		},
+	}, l)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "req-1")
+
+	_, err := client.Get(ctx, &peoplepb.GetPersonRequest{Id: 1})
+	if st := status.Convert(err); st.Code() != codes.Internal || strings.Contains(st.Message(), "SQLSTATE") {
+		t.Errorf("got %v but expected Internal without the database error", err)
+	}
+	if len(l.errors) != 1 || !strings.Contains(l.errors[0].Error(), "req-1") {
+		t.Errorf("got logged errors %v but expected the database error for req-1", l.errors)
+	}
+
+	_, err = client.Update(ctx, &peoplepb.UpdatePersonRequest{Id: 2, Person: &peoplepb.Person{Firstname: "Foo", Lastname: "Bar"}})
+	if st := status.Convert(err); st.Code() != codes.InvalidArgument || st.Message() != "attributes.level must be a number" {
+		t.Errorf("got %v but expected InvalidArgument naming the attribute", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// idempotencyRecord is the stored outcome of the first request made with an
+// Idempotency-Key. Status is 0 while that request is still being handled.
+type idempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// idempotencyLease is how long a key stays reserved by a request still being
+// handled. It only has to outlast the handler: should the process die before
+// the request completes, retries get 409 for no longer than this.
+const idempotencyLease = time.Minute
+
+// replayedHeaders are the response headers kept alongside a stored response.
+var replayedHeaders = []string{"Content-Type", "ETag"}
+
+type appHandler func(actx *AppContext, w http.ResponseWriter, r *http.Request)
+
+// idempotent wraps a handler so that requests carrying an Idempotency-Key
+// header run at most once per key. Retries with the same body replay the
+// stored response, a different body gets 422 and a retry racing the first
+// request gets 409. Only successful responses are kept, for
+// actx.idempotencyTTL, so a failed request can be retried with the same key.
+func idempotent(h appHandler) appHandler {
+	return func(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			h(actx, w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx, cancel := context.WithTimeout(r.Context(), actx.timeout)
+		defer cancel()
+
+		rec := idempotencyRecord{
+			Key:         key,
+			Fingerprint: requestFingerprint(r, body),
+			ExpiresAt:   time.Now().Add(idempotencyLease),
+		}
+		existing, reserved, err := actx.storer.reserveIdempotencyKey(ctx, rec)
+		if err != nil {
+			writeStoreError(actx, w, r, err)
+			return
+		}
+
+		if !reserved {
+			replayIdempotent(w, r, rec, existing)
+			return
+		}
+
+		// The store is updated after the request, whose context may be done
+		// by then.
+		background := withTenant(context.Background(), tenantFromContext(r.Context()))
+
+		// The key is released unless the response is to be stored, including
+		// when h panics.
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(background, actx.timeout)
+			defer cancel()
+			if err := actx.storer.releaseIdempotencyKey(ctx, key); err != nil {
+				actx.logger.error(err)
+			}
+		}()
+
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		h(actx, cw, r)
+
+		if cw.status < 200 || cw.status > 299 {
+			return
+		}
+
+		ctx, cancel = context.WithTimeout(background, actx.timeout)
+		defer cancel()
+
+		rec.Status = cw.status
+		rec.ExpiresAt = time.Now().Add(actx.idempotencyTTL)
+		rec.Header = http.Header{}
+		for _, name := range replayedHeaders {
+			if v := cw.Header().Get(name); v != "" {
+				rec.Header.Set(name, v)
+			}
+		}
+		rec.Body = cw.body.Bytes()
+		completed = true
+		if err := actx.storer.completeIdempotencyKey(ctx, rec); err != nil {
+			actx.logger.error(err)
+		}
+	}
+}
+
+func replayIdempotent(w http.ResponseWriter, r *http.Request, rec idempotencyRecord, existing idempotencyRecord) {
+	if existing.Fingerprint != rec.Fingerprint {
+		writeError(w, r, http.StatusUnprocessableEntity, errors.New("Idempotency-Key was already used for a different request"))
+		return
+	}
+
+	if existing.Status == 0 {
+		writeError(w, r, http.StatusConflict, errors.New("A request with this Idempotency-Key is still in progress"))
+		return
+	}
+
+	for name, values := range existing.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.Status)
+	w.Write(existing.Body)
+}
+
+// requestFingerprint identifies a request by its method, path and body.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// captureWriter passes a response through while keeping a copy of it.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	cw.status = status
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postWithKey(t *testing.T, url string, key string, body string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodPost, url+"/people", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("New request error: %s", err.Error())
+	}
+	req.Header.Set("Idempotency-Key", key)
+
+	cli := &http.Client{}
+	res, err := cli.Do(req)
+	if err != nil {
+		t.Fatalf("Error during cli.Do: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Error reading body: %s", err.Error())
+	}
+
+	return res, string(b)
+}
+
+func Test_idempotentPOSTReplay(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := `{"id": 10, "firstname": "Foo", "lastname": "Bar", "age": 22}`
+	first, firstBody := postWithKey(t, server.URL, "abc", body)
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d: %s", first.StatusCode, http.StatusOK, firstBody)
+	}
+
+	second, secondBody := postWithKey(t, server.URL, "abc", body)
+	if second.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d: %s", second.StatusCode, http.StatusOK, secondBody)
+	}
+
+	if secondBody != firstBody {
+		t.Errorf("got replayed body %s but expected %s", secondBody, firstBody)
+	}
+
+	if second.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected replayed response to be marked")
+	}
+
+	if second.Header.Get("ETag") != first.Header.Get("ETag") {
+		t.Errorf("got ETag %s but expected %s", second.Header.Get("ETag"), first.Header.Get("ETag"))
+	}
+
+	if len(ms.tenants[defaultTenant].people) != 4 {
+		t.Errorf("got %d people but expected 4", len(ms.tenants[defaultTenant].people))
+	}
+
+	res, _ := postWithKey(t, server.URL, "abc", `{"id": 11, "firstname": "Other"}`)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+}
+
+func Test_idempotentPOSTFailureReleasesKey(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	// ID 1 is already taken, so the first attempt fails and must not be kept.
+	body := `{"id": 1, "firstname": "Foo"}`
+	res, _ := postWithKey(t, server.URL, "abc", body)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got status %d but expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+
+	if _, ok := ms.tenants[defaultTenant].idempotency["abc"]; ok {
+		t.Errorf("expected failed request to release its key")
+	}
+}
+
+func Test_idempotentPOSTExpired(t *testing.T) {
+	ms := NewMemoryStore(0)
+	actx := AppContext{
+		storer:         &ms,
+		timeout:        30 * time.Millisecond,
+		idempotencyTTL: time.Millisecond,
+		logger:         noopLogger{},
+	}
+
+	server := httptest.NewServer(NewHandler(actx))
+	defer server.Close()
+
+	postWithKey(t, server.URL, "abc", `{"id": 10, "firstname": "Foo"}`)
+	time.Sleep(5 * time.Millisecond)
+
+	res, _ := postWithKey(t, server.URL, "abc", `{"id": 11, "firstname": "Foo"}`)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	if res.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected expired key to run the request again")
+	}
+}
+
+func Test_idempotentPanicReleasesKey(t *testing.T) {
+	ms := NewMemoryStore(0)
+	actx := &AppContext{storer: &ms, timeout: time.Second, idempotencyTTL: time.Minute, logger: noopLogger{}}
+	h := idempotent(func(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+		panic("handler failed")
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/people", strings.NewReader(`{"id": 10}`))
+	req = req.WithContext(withTenant(req.Context(), defaultTenant))
+	req.Header.Set("Idempotency-Key", "abc")
+	func() {
+		defer func() { recover() }()
+		h(actx, httptest.NewRecorder(), req)
+	}()
+
+	if _, ok := ms.tenants[defaultTenant].idempotency["abc"]; ok {
+		t.Errorf("expected a panicking request to release its key")
+	}
+}
+
+func Test_idempotencyLease(t *testing.T) {
+	ms := NewMemoryStore(0)
+	actx := &AppContext{storer: &ms, timeout: time.Second, idempotencyTTL: time.Hour, logger: noopLogger{}}
+	var leased time.Time
+	h := idempotent(func(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+		leased = ms.tenants[defaultTenant].idempotency["abc"].ExpiresAt
+		w.Write([]byte("{}"))
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/people", strings.NewReader(`{"id": 10}`))
+	req = req.WithContext(withTenant(req.Context(), defaultTenant))
+	req.Header.Set("Idempotency-Key", "abc")
+	h(actx, httptest.NewRecorder(), req)
+
+	if until := time.Until(leased); until > idempotencyLease {
+		t.Errorf("got a reservation expiring in %s but expected at most %s", until, idempotencyLease)
+	}
+	if until := time.Until(ms.tenants[defaultTenant].idempotency["abc"].ExpiresAt); until < 59*time.Minute {
+		t.Errorf("got a stored response expiring in %s but expected the TTL of an hour", until)
+	}
+}
+
+func Test_deleteExpiredIdempotencyKeys(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	for key, expires := range map[string]time.Time{"old": time.Now().Add(-time.Second), "new": time.Now().Add(time.Hour)} {
+		if _, _, err := ms.reserveIdempotencyKey(ctx, idempotencyRecord{Key: key, ExpiresAt: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actx := AppContext{storer: &ms, timeout: time.Second, logger: noopLogger{}}
+	purgeOnce(ctx, actx, 24*time.Hour)
+
+	if _, ok := ms.tenants[defaultTenant].idempotency["old"]; ok {
+		t.Errorf("expected the purge to delete the expired key")
+	}
+	if _, ok := ms.tenants[defaultTenant].idempotency["new"]; !ok {
+		t.Errorf("expected the purge to keep the unexpired key")
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mediaCSV    = "text/csv"
+	mediaNDJSON = "application/x-ndjson"
+
+	// exportFlushRows is how many rows are written between flushes.
+	exportFlushRows = 100
+
+	// exportTimeout bounds an export in place of the request timeout, which
+	// a large table outlasts.
+	exportTimeout = 10 * time.Minute
+
+	// maxImportBytes bounds an upload, so that the reader gives up on a body
+	// that could never hold maxBatchOperations acceptable rows.
+	maxImportBytes = 64 << 20
+)
+
+var errImportTooLarge = fmt.Errorf("Import has more than %d rows", maxBatchOperations)
+
+// personColumns are the CSV columns of an export, and the fields an import
+// can map its columns onto.
+var personColumns = []string{"id", "firstname", "lastname", "age", "version", "email", "phone", "date_of_birth"}
+
+// exportPeople streams every person as CSV or NDJSON, flushing as it goes so
+// the table is never held in memory. Once the first row is written the status
+// can no longer change, so a failure part way through is only logged and the
+// response ends short.
+func exportPeople(actx *AppContext, w http.ResponseWriter, r *http.Request, mediaType string, pq personQuery) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", mediaType)
+	flusher, _ := w.(http.Flusher)
+
+	var write func(p Person) error
+	var flush func() error
+	switch mediaType {
+	case mediaCSV:
+		w.Header().Set("Content-Disposition", `attachment; filename="people.csv"`)
+		cw := csv.NewWriter(w)
+		if err := cw.Write(personColumns); err != nil {
+			actx.logger.error(err)
+			return
+		}
+		write = func(p Person) error {
+			return cw.Write([]string{strconv.Itoa(p.ID), p.FirstName, p.LastName, strconv.Itoa(p.Age), strconv.Itoa(p.Version), p.Email, p.Phone, p.DateOfBirth})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		encoder := json.NewEncoder(w)
+		write = func(p Person) error {
+			return encoder.Encode(p)
+		}
+		flush = func() error {
+			return nil
+		}
+	}
+
+	rows := 0
+	err := actx.storer.eachPerson(ctx, pq, func(p Person) error {
+		if err := write(p); err != nil {
+			return err
+		}
+
+		rows++
+		if rows%exportFlushRows == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		actx.logger.error(fmt.Errorf("export stopped after %d rows: %w", rows, err))
+	}
+}
+
+// importRowError reports why a row of an import was rejected. Rows count
+// from 1 and exclude the CSV header line.
+type importRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type importResponse struct {
+	DryRun   bool             `json:"dry_run"`
+	Mode     string           `json:"mode"`
+	Rows     int              `json:"rows"`
+	Imported int              `json:"imported"`
+	Errors   []importRowError `json:"errors"`
+}
+
+// handlePeopleImportPOST creates people from a CSV or NDJSON upload. CSV
+// columns are matched to Person fields by header name, and ?map=Column:field
+// renames a column. Every row is validated first; in the default atomic mode
+// a single bad row rejects the upload, while mode=best_effort imports the
+// rows that are valid. With dry_run=true nothing is written. The upload is
+// read row by row and rejected as soon as it has too many.
+func handlePeopleImportPOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = batchAtomic
+	}
+	if mode != batchAtomic && mode != batchBestEffort {
+		writeError(w, r, http.StatusBadRequest, fmt.Errorf("Unknown import mode: %q", mode))
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, errors.New("Content-Type must be text/csv or application/x-ndjson"))
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	var people []Person
+	var rows []int
+	var rowErrs []importRowError
+	switch mediaType {
+	case mediaCSV:
+		mapping, mapErr := columnMapping(query["map"])
+		if mapErr != nil {
+			writeError(w, r, http.StatusBadRequest, mapErr)
+			return
+		}
+		people, rows, rowErrs, err = readPeopleCSV(body, mapping)
+	case mediaNDJSON:
+		people, rows, rowErrs, err = readPeopleNDJSON(body)
+	default:
+		writeError(w, r, http.StatusUnsupportedMediaType, errors.New("Content-Type must be text/csv or application/x-ndjson"))
+		return
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("Import is larger than %d bytes", maxImportBytes))
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	res := importResponse{
+		DryRun: dryRun,
+		Mode:   mode,
+		Rows:   len(people) + len(rowErrs),
+		Errors: rowErrs,
+	}
+
+	if dryRun || len(people) == 0 || (mode == batchAtomic && len(rowErrs) > 0) {
+		writeImportResponse(w, r, res)
+		return
+	}
+
+	ops := make([]batchOperation, len(people))
+	for i, p := range people {
+		ops[i] = batchOperation{Op: batchCreate, Person: p}
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	results, err := actx.storer.applyBatch(ctx, ops, mode == batchAtomic)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	for i, br := range results {
+		if br.Err != nil {
+			res.Errors = append(res.Errors, importRowError{Row: rows[i], Error: clientErrorMessage(actx, r, br.Err)})
+			continue
+		}
+		res.Imported++
+	}
+
+	if mode == batchAtomic && len(res.Errors) > 0 {
+		res.Imported = 0
+	}
+
+	writeImportResponse(w, r, res)
+}
+
+// writeImportResponse reports an import. An atomic import with invalid rows
+// imports nothing, so it is a problem carrying the report and row errors.
+func writeImportResponse(w http.ResponseWriter, r *http.Request, res importResponse) {
+	if res.Errors == nil {
+		res.Errors = []importRowError{}
+	}
+
+	if res.Mode == batchAtomic && len(res.Errors) > 0 {
+		p := newProblem(r, http.StatusUnprocessableEntity, fmt.Errorf("%d of %d rows are invalid, so none were imported", len(res.Errors), res.Rows))
+		p.Extensions = map[string]any{
+			"dry_run":  res.DryRun,
+			"mode":     res.Mode,
+			"rows":     res.Rows,
+			"imported": res.Imported,
+			"errors":   res.Errors,
+		}
+		writeProblem(w, p)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// columnMapping parses ?map=Column:field pairs into a lookup from the
+// normalised column name to a Person field.
+func columnMapping(pairs []string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, c := range personColumns {
+		mapping[c] = c
+	}
+
+	for _, pair := range pairs {
+		column, field, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("Invalid column mapping: %q", pair)
+		}
+
+		field = strings.ToLower(strings.TrimSpace(field))
+		known := false
+		for _, c := range personColumns {
+			known = known || c == field
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown field in column mapping: %q", field)
+		}
+
+		mapping[normaliseColumn(column)] = field
+	}
+
+	return mapping, nil
+}
+
+func normaliseColumn(c string) string {
+	return strings.ToLower(strings.TrimSpace(c))
+}
+
+// readPeopleCSV parses and validates a CSV upload, returning the valid
+// people alongside the row each came from. Columns that don't map to a field
+// are ignored. It stops with errImportTooLarge after maxBatchOperations rows.
+func readPeopleCSV(body io.Reader, mapping map[string]string) ([]Person, []int, []importRowError, error) {
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Unable to read CSV header: %w", err)
+	}
+
+	fields := make([]string, len(header))
+	for i, column := range header {
+		fields[i] = mapping[normaliseColumn(column)]
+	}
+
+	var people []Person
+	var rows []int
+	var rowErrs []importRowError
+	for row := 1; ; row++ {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if len(people)+len(rowErrs) == maxBatchOperations {
+			return nil, nil, nil, errImportTooLarge
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return nil, nil, nil, err
+			}
+			rowErrs = append(rowErrs, importRowError{Row: row, Error: err.Error()})
+			continue
+		}
+
+		p, err := personFromRecord(fields, record)
+		if err == nil {
+			err = validatePerson(p)
+		}
+		if err != nil {
+			rowErrs = append(rowErrs, importRowError{Row: row, Error: err.Error()})
+			continue
+		}
+
+		people = append(people, p)
+		rows = append(rows, row)
+	}
+
+	return people, rows, rowErrs, nil
+}
+
+func personFromRecord(fields []string, record []string) (Person, error) {
+	var p Person
+	for i, value := range record {
+		if i >= len(fields) {
+			break
+		}
+
+		var err error
+		switch fields[i] {
+		case "id":
+			p.ID, err = parseIntColumn(value)
+		case "firstname":
+			p.FirstName = value
+		case "lastname":
+			p.LastName = value
+		case "age":
+			p.Age, err = parseIntColumn(value)
+		case "email":
+			p.Email = value
+		case "phone":
+			p.Phone = value
+		case "date_of_birth":
+			p.DateOfBirth = value
+		}
+
+		if err != nil {
+			return p, fmt.Errorf("Invalid %s: %q", fields[i], value)
+		}
+	}
+
+	return p, nil
+}
+
+func parseIntColumn(value string) (int, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(strings.TrimSpace(value))
+}
+
+// readPeopleNDJSON parses and validates an NDJSON upload, one person per
+// line. Blank lines are skipped but still counted as rows. It stops with
+// errImportTooLarge after maxBatchOperations people.
+func readPeopleNDJSON(body io.Reader) ([]Person, []int, []importRowError, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var people []Person
+	var rows []int
+	var rowErrs []importRowError
+	for row := 1; scanner.Scan(); row++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if len(people)+len(rowErrs) == maxBatchOperations {
+			return nil, nil, nil, errImportTooLarge
+		}
+
+		var p Person
+		err := json.Unmarshal([]byte(line), &p)
+		if err == nil {
+			err = validatePerson(p)
+		}
+		if err != nil {
+			rowErrs = append(rowErrs, importRowError{Row: row, Error: err.Error()})
+			continue
+		}
+
+		people = append(people, p)
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return people, rows, rowErrs, nil
+}
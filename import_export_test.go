@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_handlePeopleGETExport(t *testing.T) {
+	ss := StorerStub{
+		eachPersonStub: func(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+			people := []Person{
+				{ID: 1, FirstName: "Foo", LastName: "Bar, Jr", Age: 22, Version: 1, Email: "foo@example.com", Phone: "+14155550123", DateOfBirth: "2000-01-02"},
+				{ID: 2, FirstName: "Bin", LastName: "Baz", Age: 24, Version: 3},
+			}
+			for _, p := range people {
+				if err := fn(p); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	h := newTestHandler(ss)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		accept  string
+		exptype string
+		expbody string
+	}{
+		{
+			accept:  "text/csv",
+			exptype: "text/csv",
+			expbody: "id,firstname,lastname,age,version,email,phone,date_of_birth\n1,Foo,\"Bar, Jr\",22,1,foo@example.com,+14155550123,2000-01-02\n2,Bin,Baz,24,3,,,\n",
+		},
+		{
+			accept:  "application/json;q=0.5, application/x-ndjson",
+			exptype: "application/x-ndjson",
+			expbody: `{"id":1,"firstname":"Foo","lastname":"Bar, Jr","age":22,"version":1,"email":"foo@example.com","phone":"+14155550123","date_of_birth":"2000-01-02"}` + "\n" +
+				`{"id":2,"firstname":"Bin","lastname":"Baz","age":24,"version":3}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/people", nil)
+		if err != nil {
+			t.Fatalf("New request error: %s", err.Error())
+		}
+		req.Header.Set("Accept", tt.accept)
+
+		cli := &http.Client{}
+		res, err := cli.Do(req)
+		if err != nil {
+			t.Fatalf("Error during cli.Do: %s", err.Error())
+		}
+
+		b, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("Error reading body: %s", err.Error())
+		}
+
+		if got := res.Header.Get("Content-Type"); got != tt.exptype {
+			t.Errorf("got Content-Type %s but expected %s", got, tt.exptype)
+		}
+
+		if string(b) != tt.expbody {
+			t.Errorf("got body %q but expected %q", string(b), tt.expbody)
+		}
+	}
+}
+
+func postImport(t *testing.T, url string, contentType string, body string) (*http.Response, importResponse) {
+	res, err := http.Post(url, contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var ir importResponse
+	decoder := json.NewDecoder(res.Body)
+	if err := decoder.Decode(&ir); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return res, ir
+}
+
+func Test_handlePeopleImportCSV(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := "ID,Given Name,Surname,Age,Notes\n" +
+		"10,Foo,Bar,22,ignored\n" +
+		"11,,Baz,24,\n" +
+		"12,Bin,Baz,old,\n" +
+		"13,Qux,Quux,30,\n"
+	url := server.URL + "/people/import?map=Given%20Name:firstname&map=Surname:lastname"
+
+	res, ir := postImport(t, url+"&dry_run=true", "text/csv", body)
+	if res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	experrs := []int{2, 3}
+	if ir.Rows != 4 || len(ir.Errors) != len(experrs) {
+		t.Fatalf("got %d rows and errors %v but expected 4 rows and errors on %v", ir.Rows, ir.Errors, experrs)
+	}
+	for i, row := range experrs {
+		if ir.Errors[i].Row != row {
+			t.Errorf("got error on row %d but expected row %d", ir.Errors[i].Row, row)
+		}
+	}
+
+	res, ir = postImport(t, url, "text/csv", body)
+	if res.StatusCode != http.StatusUnprocessableEntity || ir.Imported != 0 || len(ms.tenants[defaultTenant].people) != 3 {
+		t.Errorf("expected atomic import with bad rows to import nothing, got %d imported", ir.Imported)
+	}
+
+	res, ir = postImport(t, url+"&mode=best_effort", "text/csv", body)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	if ir.Imported != 2 || len(ms.tenants[defaultTenant].people) != 5 {
+		t.Errorf("got %d imported and %d people but expected 2 and 5", ir.Imported, len(ms.tenants[defaultTenant].people))
+	}
+
+	if p := ms.tenants[defaultTenant].people[3]; p.ID != 10 || p.FirstName != "Foo" || p.LastName != "Bar" || p.Age != 22 {
+		t.Errorf("got imported person %v", p)
+	}
+}
+
+func Test_handlePeopleImportCSVContact(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := "id,firstname,lastname,email,phone,date_of_birth\n" +
+		"10,Foo,Bar,foo@example.com,+14155550123,2000-01-02\n" +
+		"11,Bin,Baz,,555-0123,\n"
+	res, ir := postImport(t, server.URL+"/people/import?mode=best_effort", "text/csv", body)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	if ir.Imported != 1 || len(ir.Errors) != 1 || ir.Errors[0].Row != 2 {
+		t.Fatalf("got %d imported and errors %v but expected the bad phone number on row 2 rejected", ir.Imported, ir.Errors)
+	}
+
+	p := ms.tenants[defaultTenant].people[3]
+	if p.Email != "foo@example.com" || p.Phone != "+14155550123" || p.DateOfBirth != "2000-01-02" {
+		t.Errorf("got imported person %v but expected their contact details", p)
+	}
+}
+
+func Test_handlePeopleImportNDJSON(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	body := `{"id": 10, "firstname": "Foo", "lastname": "Bar"}` + "\n\n" +
+		`{"id": 11, "firstname": "Bin", "lastname": "Baz", "age": 3}` + "\n"
+	res, ir := postImport(t, server.URL+"/people/import", "application/x-ndjson", body)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d but expected %d: %v", res.StatusCode, http.StatusOK, ir.Errors)
+	}
+
+	if ir.Imported != 2 || len(ms.tenants[defaultTenant].people) != 5 {
+		t.Errorf("got %d imported and %d people but expected 2 and 5", ir.Imported, len(ms.tenants[defaultTenant].people))
+	}
+
+	res, err := http.Post(server.URL+"/people/import", "application/xml", strings.NewReader("<people/>"))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
+
+// endlessPeople is an NDJSON upload that never ends.
+type endlessPeople struct{}
+
+func (endlessPeople) Read(b []byte) (int, error) {
+	line := `{"firstname": "Foo", "lastname": "Bar"}` + "\n"
+	n := 0
+	for n+len(line) <= len(b) {
+		n += copy(b[n:], line)
+	}
+	return n, nil
+}
+
+func Test_readPeopleTooLarge(t *testing.T) {
+	if _, _, _, err := readPeopleNDJSON(endlessPeople{}); !errors.Is(err, errImportTooLarge) {
+		t.Errorf("got error %v but expected %v", err, errImportTooLarge)
+	}
+
+	csv := "firstname,lastname\n" + strings.Repeat("Foo,Bar\n", maxBatchOperations+1)
+	if _, _, _, err := readPeopleCSV(strings.NewReader(csv), map[string]string{"firstname": "firstname", "lastname": "lastname"}); !errors.Is(err, errImportTooLarge) {
+		t.Errorf("got error %v but expected %v", err, errImportTooLarge)
+	}
+
+	csv = "firstname,lastname\n" + strings.Repeat("Foo,Bar\n", maxBatchOperations)
+	if _, _, _, err := readPeopleCSV(strings.NewReader(csv), map[string]string{"firstname": "firstname", "lastname": "lastname"}); err != nil {
+		t.Errorf("got error %v for %d rows but expected none", err, maxBatchOperations)
+	}
+}
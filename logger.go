@@ -6,19 +6,30 @@ import (
 )
 
 type loggerPayload struct {
-	Duration string `json:"duration"`
-	URL      string `json:"url"`
-	Method   string `json:"method"`
+	Duration  string `json:"duration"`
+	URL       string `json:"url"`
+	Method    string `json:"method"`
+	RequestID string `json:"request_id"`
+}
+
+// logEvent is something the API did of its own accord rather than in
+// answer to a request, such as a purge.
+type logEvent struct {
+	Event  string `json:"event"`
+	Tenant string `json:"tenant,omitempty"`
+	Count  int    `json:"count"`
 }
 
 type logger interface {
 	info(l loggerPayload)
+	event(e logEvent)
 	error(error)
 }
 
 type noopLogger struct{}
 
 func (j noopLogger) info(p loggerPayload) {}
+func (j noopLogger) event(e logEvent)     {}
 func (j noopLogger) error(e error)        {}
 
 type jsonLogger struct{}
@@ -33,6 +44,16 @@ func (j jsonLogger) info(p loggerPayload) {
 	fmt.Println(string(b))
 }
 
+func (j jsonLogger) event(e logEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println(fmt.Errorf("logger error: %v\n", err))
+		return
+	}
+
+	fmt.Println(string(b))
+}
+
 func (j jsonLogger) error(e error) {
 	fmt.Println("{\"error\" : \"", e.Error(), "\"}")
 }
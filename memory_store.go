@@ -3,151 +3,1088 @@ package main
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// MemoryStore keeps each tenant's data apart in a memoryTenant of its own,
+// and every method works on the tenant in its ctx only.
 type MemoryStore struct {
-	people       []Person
+	mu           *sync.Mutex
+	tenants      map[string]*memoryTenant
 	sleepSeconds int
 }
 
+type memoryTenant struct {
+	people           []Person
+	audit            []auditEvent
+	validFrom        map[int]time.Time
+	versions         []personVersion
+	changes          []changeEvent
+	lastChange       int64
+	addresses        []address
+	lastAddress      int
+	relationships    []relationship
+	lastRelationship int
+	schemas          []attributeSchema
+	webhooks         []webhook
+	deliveries       []webhookDelivery
+	lastWebhook      int
+	lastDelivery     int64
+	idempotency      map[string]idempotencyRecord
+}
+
+// NewMemoryStore returns a store whose default tenant holds a few people
+// and whose other tenants start out empty.
 func NewMemoryStore(sleepSeconds int) MemoryStore {
 	people := []Person{
-		{ID: 1, FirstName: "Bob", LastName: "Barker", Age: 53},
-		{ID: 2, FirstName: "Fred", LastName: "Flintstone", Age: 44},
-		{ID: 3, FirstName: "Joan", LastName: "Jet", Age: 49},
+		{ID: 1, FirstName: "Bob", LastName: "Barker", Age: 53, Version: 1},
+		{ID: 2, FirstName: "Fred", LastName: "Flintstone", Age: 44, Version: 1},
+		{ID: 3, FirstName: "Joan", LastName: "Jet", Age: 49, Version: 1},
+	}
+
+	td := newMemoryTenant()
+	now := time.Now()
+	for _, p := range people {
+		td.validFrom[p.ID] = now
 	}
+	td.people = people
 
-	return MemoryStore{people: people, sleepSeconds: sleepSeconds}
+	return MemoryStore{
+		mu:           &sync.Mutex{},
+		tenants:      map[string]*memoryTenant{defaultTenant: td},
+		sleepSeconds: sleepSeconds,
+	}
 }
 
-func (m MemoryStore) allPeople(ctx context.Context) ([]Person, error) {
-	ch := make(chan []Person, 0)
+func newMemoryTenant() *memoryTenant {
+	return &memoryTenant{
+		validFrom:   map[int]time.Time{},
+		idempotency: map[string]idempotencyRecord{},
+	}
+}
 
-	go func() {
-		time.Sleep(time.Duration(m.sleepSeconds) * time.Second)
-		ch <- m.people
-	}()
+// tenant returns the data of a tenant. A tenant nothing has been written to
+// yet gets empty data, which is only kept when create is set, so that reads
+// naming any number of tenants don't grow the store. It must be called with
+// m.mu held.
+func (m *MemoryStore) tenant(id string, create bool) *memoryTenant {
+	td, ok := m.tenants[id]
+	if !ok {
+		td = newMemoryTenant()
+		if create {
+			m.tenants[id] = td
+		}
+	}
 
-	select {
-	case people := <-ch:
-		return people, nil
-	case <-ctx.Done():
-		return []Person{}, ctx.Err()
+	return td
+}
+
+func (m *MemoryStore) tenantIDs(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []string
+	for id := range m.tenants {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// personVersion is a replaced version of a person and the system time range
+// [From, To) it was current for. The current version of each person in
+// td.people is valid from td.validFrom onwards.
+type personVersion struct {
+	Person Person
+	From   time.Time
+	To     time.Time
 }
 
-func (m MemoryStore) personForID(ctx context.Context, id int) (*Person, error) {
+// memoryOp runs fn on the data of the tenant in ctx, under the store lock
+// after the simulated latency, returning early with the context error if
+// ctx is done first. fn sees a tenant that has had nothing written as empty,
+// and anything it changes there is dropped; methods that can add a tenant's
+// first data use memoryWrite instead. A ctx without a tenant fails with
+// errNoTenant.
+func memoryOp[T any](ctx context.Context, m *MemoryStore, fn func(td *memoryTenant) (T, error)) (T, error) {
+	return memoryRun(ctx, m, false, fn)
+}
+
+// memoryWrite is memoryOp for methods that add data, keeping the tenant once
+// they have.
+func memoryWrite[T any](ctx context.Context, m *MemoryStore, fn func(td *memoryTenant) (T, error)) (T, error) {
+	return memoryRun(ctx, m, true, fn)
+}
+
+func memoryRun[T any](ctx context.Context, m *MemoryStore, create bool, fn func(td *memoryTenant) (T, error)) (T, error) {
+	tenant := tenantFromContext(ctx)
+	if tenant == "" {
+		var zero T
+		return zero, errNoTenant
+	}
+
 	type ret struct {
-		person *Person
-		error  error
+		value T
+		error error
 	}
 
 	ch := make(chan ret, 1)
 
 	go func() {
 		time.Sleep(time.Duration(m.sleepSeconds) * time.Second)
-		for _, person := range m.people {
-			if person.ID == id {
-				ch <- ret{&person, nil}
-				return
-			}
-		}
-
-		ch <- ret{nil, fmt.Errorf("Person not found for id: %d", id)}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		v, err := fn(m.tenant(tenant, create))
+		ch <- ret{v, err}
 	}()
 
 	select {
 	case ret := <-ch:
-		return ret.person, ret.error
+		return ret.value, ret.error
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+// eachPerson calls fn for a copy of the matching people, taken up front so
+// that fn runs without the lock held.
+func (m *MemoryStore) eachPerson(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+	people, err := memoryOp(ctx, m, func(td *memoryTenant) ([]Person, error) {
+		var people []Person
+		for _, p := range td.peopleAt(pq.AsOf) {
+			if pq.matches(p) {
+				people = append(people, p)
+			}
+		}
+
+		return people, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range people {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(p); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+func (m *MemoryStore) pagePeople(ctx context.Context, f personFilter, after int, limit int) (peoplePage, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (peoplePage, error) {
+		var page peoplePage
+		people := td.peopleAt(f.AsOf)
+		for i := len(people) - 1; i >= 0; i-- {
+			p := people[i]
+			if !f.matches(p) {
+				continue
+			}
+
+			page.Total++
+			switch {
+			case p.ID <= after:
+				page.Before++
+			case len(page.People) < limit:
+				page.People = append(page.People, p)
+			}
+		}
+
+		return page, nil
+	})
+}
+
+func (m *MemoryStore) personForID(ctx context.Context, id int, pq personQuery) (*Person, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (*Person, error) {
+		for _, person := range td.peopleAt(pq.AsOf) {
+			if person.ID == id && pq.matches(person) {
+				return &person, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+	})
+}
+
+func (m *MemoryStore) peopleForIDs(ctx context.Context, ids []int) ([]Person, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]Person, error) {
+		wanted := map[int]bool{}
+		for _, id := range ids {
+			wanted[id] = true
+		}
+
+		var people []Person
+		for _, p := range td.people {
+			if wanted[p.ID] && p.DeletedAt == nil {
+				p.deriveAge(time.Now())
+				people = append(people, p)
+			}
+		}
+
+		return people, nil
+	})
+}
+
+func (m *MemoryStore) searchPeople(ctx context.Context, q string, limit int) ([]searchResult, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]searchResult, error) {
+		var results []searchResult
+		for _, p := range td.people {
+			if p.DeletedAt != nil {
+				continue
+			}
+			if score, ok := scorePerson(p, q); ok {
+				p.deriveAge(time.Now())
+				results = append(results, searchResult{Person: p, Score: score})
+			}
+		}
+
+		sort.SliceStable(results, func(i, j int) bool {
+			if results[i].Score != results[j].Score {
+				return results[i].Score > results[j].Score
+			}
+			return results[i].Person.ID < results[j].Person.ID
+		})
+
+		if len(results) > limit {
+			results = results[:limit]
+		}
+		return results, nil
+	})
 }
 
 func (m *MemoryStore) addPerson(ctx context.Context, p Person) (Person, error) {
-	type ret struct {
-		person Person
-		error  error
+	up, err := memoryWrite(ctx, m, func(td *memoryTenant) (Person, error) {
+		return td.insert(p, auditInfoFromContext(ctx))
+	})
+	if err != nil {
+		return p, err
 	}
 
-	ch := make(chan ret, 1)
+	return up, nil
+}
 
-	go func() {
-		time.Sleep(time.Duration(m.sleepSeconds) * time.Second)
-		for _, i := range m.people {
-			if i.ID == p.ID {
-				ch <- ret{p, fmt.Errorf("The person ID is alread taken: %v", p)}
-				return
+func (m *MemoryStore) deletePerson(ctx context.Context, id int, version int) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		return struct{}{}, td.remove(id, version, auditInfoFromContext(ctx))
+	})
+
+	return err
+}
+
+func (m *MemoryStore) updatePerson(ctx context.Context, id int, p Person, version int) (Person, error) {
+	up, err := memoryOp(ctx, m, func(td *memoryTenant) (Person, error) {
+		return td.replace(id, p, version, auditInfoFromContext(ctx))
+	})
+	if err != nil {
+		return p, err
+	}
+
+	return up, nil
+}
+
+// insert, replace and remove change td.people in place, recording an audit
+// event for each change, and must be called with m.mu held.
+func (td *memoryTenant) insert(p Person, a auditInfo) (Person, error) {
+	for _, i := range td.people {
+		if i.ID == p.ID {
+			return p, fmt.Errorf("%w: %d", errPersonExists, p.ID)
+		}
+	}
+
+	if err := td.checkEmail(p.Email, p.ID); err != nil {
+		return p, err
+	}
+
+	attrs, err := checkAttributes(p.Attributes, td.schemas)
+	if err != nil {
+		return p, err
+	}
+
+	p.Attributes = attrs
+	p.deriveAge(time.Now())
+	p.Version = 1
+	td.people = append(td.people, p)
+	td.validFrom[p.ID] = time.Now()
+	td.record(auditCreate, p.ID, nil, &p, a)
+	return p, nil
+}
+
+func (td *memoryTenant) replace(id int, p Person, version int, a auditInfo) (Person, error) {
+	for i, ep := range td.people {
+		if ep.ID == id && ep.DeletedAt == nil {
+			if version != 0 && ep.Version != version {
+				return p, errVersionMismatch
+			}
+			if err := td.checkEmail(p.Email, id); err != nil {
+				return p, err
+			}
+			attrs, err := checkAttributes(p.Attributes, td.schemas)
+			if err != nil {
+				return p, err
 			}
+			p.Attributes = attrs
+			p.deriveAge(time.Now())
+			p.ID = id
+			p.Version = ep.Version + 1
+			td.people[i] = p
+			td.supersede(ep)
+			td.record(auditUpdate, id, &ep, &p, a)
+			return p, nil
 		}
+	}
 
-		m.people = append(m.people, p)
-		ch <- ret{p, nil}
-	}()
+	return p, fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+}
 
-	select {
-	case ret := <-ch:
-		return ret.person, ret.error
-	case <-ctx.Done():
-		return p, ctx.Err()
+// checkEmail fails with errEmailTaken when anyone but the person with id,
+// deleted or not, has email. Emails compare without regard to case.
+func (td *memoryTenant) checkEmail(email string, id int) error {
+	if email == "" {
+		return nil
 	}
+
+	for _, p := range td.people {
+		if p.ID != id && strings.EqualFold(p.Email, email) {
+			return fmt.Errorf("%w: %s", errEmailTaken, email)
+		}
+	}
+
+	return nil
 }
 
-func (m *MemoryStore) deletePerson(ctx context.Context, id int) error {
-	ch := make(chan error, 1)
+// remove only marks the person deleted; purge drops them from td.people.
+func (td *memoryTenant) remove(id int, version int, a auditInfo) error {
+	for i, p := range td.people {
+		if p.ID == id && p.DeletedAt == nil {
+			if version != 0 && p.Version != version {
+				return errVersionMismatch
+			}
+			now := time.Now()
+			dp := p
+			dp.DeletedAt = &now
+			dp.Version++
+			td.people[i] = dp
+			td.supersede(p)
+			td.record(auditDelete, id, &p, &dp, a)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+}
 
-	go func() {
-		time.Sleep(time.Duration(m.sleepSeconds) * time.Second)
-		for i, p := range m.people {
-			if p.ID == id {
-				m.people = delete_at_index(m.people, i)
-				ch <- nil
-				return
+func (m *MemoryStore) restorePerson(ctx context.Context, id int) (Person, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (Person, error) {
+		for i, p := range td.people {
+			if p.ID != id {
+				continue
 			}
+
+			if p.DeletedAt == nil {
+				return p, fmt.Errorf("%w: %d", errPersonNotDeleted, id)
+			}
+
+			rp := p
+			rp.DeletedAt = nil
+			rp.Version++
+			td.people[i] = rp
+			td.supersede(p)
+			td.record(auditRestore, id, &p, &rp, auditInfoFromContext(ctx))
+			return rp, nil
 		}
 
-		ch <- fmt.Errorf("No person exists for ID: %d", id)
-	}()
+		return Person{}, fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+	})
+}
 
-	select {
-	case err := <-ch:
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+func (m *MemoryStore) purgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (int, error) {
+		a := auditInfoFromContext(ctx)
+		kept := td.people[:0]
+		purged := 0
+		for _, p := range td.people {
+			if p.DeletedAt != nil && p.DeletedAt.Before(before) {
+				p := p
+				td.supersede(p)
+				delete(td.validFrom, p.ID)
+				td.record(auditPurge, p.ID, &p, nil, a)
+				purged++
+				continue
+			}
+			kept = append(kept, p)
+		}
+		td.people = kept
+
+		var addresses []address
+		for _, a := range td.addresses {
+			if _, ok := td.validFrom[a.PersonID]; ok {
+				addresses = append(addresses, a)
+			}
+		}
+		td.addresses = addresses
+
+		var relationships []relationship
+		for _, rel := range td.relationships {
+			_, person := td.validFrom[rel.PersonID]
+			_, related := td.validFrom[rel.RelatedID]
+			if person && related {
+				relationships = append(relationships, rel)
+			}
+		}
+		td.relationships = relationships
+
+		return purged, nil
+	})
+}
+
+// supersede closes off the current version of a person, which is about to be
+// replaced or removed.
+func (td *memoryTenant) supersede(old Person) {
+	now := time.Now()
+	td.versions = append(td.versions, personVersion{Person: old, From: td.validFrom[old.ID], To: now})
+	td.validFrom[old.ID] = now
+}
+
+// peopleAt returns everyone as they stood at t, or the current people when
+// t is zero, highest ID first as PostgresStore lists them.
+func (td *memoryTenant) peopleAt(t time.Time) []Person {
+	now := time.Now()
+	var people []Person
+	for _, p := range td.people {
+		if t.IsZero() || !td.validFrom[p.ID].After(t) {
+			p.deriveAge(now)
+			people = append(people, p)
+		}
+	}
+
+	if !t.IsZero() {
+		for _, v := range td.versions {
+			if !v.From.After(t) && t.Before(v.To) {
+				p := v.Person
+				p.deriveAge(now)
+				people = append(people, p)
+			}
+		}
 	}
+
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].ID > people[j].ID
+	})
+
+	return people
 }
 
-func (m *MemoryStore) updatePerson(ctx context.Context, id int, p Person) (Person, error) {
-	type ret struct {
-		person Person
-		error  error
+// record adds the audit event and the change feed event for a change, and
+// queues its webhook deliveries.
+func (td *memoryTenant) record(action string, id int, before *Person, after *Person, a auditInfo) {
+	now := time.Now()
+	td.audit = append(td.audit, auditEvent{
+		ID:        len(td.audit) + 1,
+		PersonID:  id,
+		Action:    action,
+		Actor:     a.Actor,
+		RequestID: a.RequestID,
+		Timestamp: now,
+		Before:    before,
+		After:     after,
+	})
+	td.lastChange++
+	e := changeEvent{
+		Cursor:    changeCursor{ID: td.lastChange},
+		PersonID:  id,
+		Action:    action,
+		Person:    after,
+		Timestamp: now,
 	}
+	td.changes = append(td.changes, e)
 
-	ch := make(chan ret, 1)
+	event := sseEventTypes[action]
+	for _, wh := range td.webhooks {
+		if !wh.wants(event) {
+			continue
+		}
 
-	go func() {
-		time.Sleep(time.Duration(m.sleepSeconds) * time.Second)
-		for i, ep := range m.people {
-			if ep.ID == id {
-				p.ID = id
-				m.people[i] = p
-				ch <- ret{p, nil}
-				return
+		td.lastDelivery++
+		td.deliveries = append(td.deliveries, webhookDelivery{
+			ID:            td.lastDelivery,
+			WebhookID:     wh.ID,
+			EventID:       e.Cursor.ID,
+			Event:         event,
+			PersonID:      id,
+			Person:        after,
+			Status:        deliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		})
+	}
+}
+
+func (m *MemoryStore) applyBatch(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error) {
+	return memoryWrite(ctx, m, func(td *memoryTenant) ([]batchResult, error) {
+		a := auditInfoFromContext(ctx)
+		before := append([]Person{}, td.people...)
+		audited := len(td.audit)
+		changed := len(td.changes)
+		lastChange := td.lastChange
+		delivered := len(td.deliveries)
+		versioned := len(td.versions)
+		validFrom := map[int]time.Time{}
+		for id, t := range td.validFrom {
+			validFrom[id] = t
+		}
+		results := make([]batchResult, len(ops))
+		failed := false
+		for i, op := range ops {
+			results[i] = batchResult{Index: i, Op: op.Op}
+			var p Person
+			var err error
+			switch op.Op {
+			case batchCreate:
+				p, err = td.insert(op.Person, a)
+			case batchUpdate:
+				p, err = td.replace(op.ID, op.Person, op.Version, a)
+			case batchDelete:
+				err = td.remove(op.ID, op.Version, a)
+			}
+
+			if err != nil {
+				results[i].Err = err
+				failed = true
+				continue
+			}
+
+			if op.Op != batchDelete {
+				results[i].Person = &p
 			}
 		}
 
-		ch <- ret{p, fmt.Errorf("No person exists for ID: %d", id)}
-	}()
+		if atomic && failed {
+			td.people = before
+			td.audit = td.audit[:audited]
+			td.changes = td.changes[:changed]
+			td.lastChange = lastChange
+			td.deliveries = td.deliveries[:delivered]
+			td.versions = td.versions[:versioned]
+			td.validFrom = validFrom
+		}
 
-	select {
-	case ret := <-ch:
-		return ret.person, ret.error
-	case <-ctx.Done():
-		return p, ctx.Err()
+		return results, nil
+	})
+}
+
+func (m *MemoryStore) personHistory(ctx context.Context, id int) ([]auditEvent, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]auditEvent, error) {
+		var events []auditEvent
+		for _, e := range td.audit {
+			if e.PersonID == id {
+				events = append(events, e)
+			}
+		}
+
+		return events, nil
+	})
+}
+
+func (m *MemoryStore) changesSince(ctx context.Context, after changeCursor, limit int) ([]changeEvent, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]changeEvent, error) {
+		var events []changeEvent
+		for _, e := range td.changes {
+			if e.Cursor.ID > after.ID && len(events) < limit {
+				events = append(events, e)
+			}
+		}
+
+		return events, nil
+	})
+}
+
+func (m *MemoryStore) latestChangeCursor(ctx context.Context) (changeCursor, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (changeCursor, error) {
+		return changeCursor{ID: td.lastChange}, nil
+	})
+}
+
+func (m *MemoryStore) pruneChanges(ctx context.Context, before time.Time) (int, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (int, error) {
+		n := 0
+		for n < len(td.changes) && td.changes[n].Timestamp.Before(before) {
+			n++
+		}
+		td.changes = append([]changeEvent(nil), td.changes[n:]...)
+
+		return n, nil
+	})
+}
+
+// currentPerson fails with errPersonNotFound unless the person with id
+// exists and is not deleted. It must be called with m.mu held.
+func (td *memoryTenant) currentPerson(id int) error {
+	for _, p := range td.people {
+		if p.ID == id && p.DeletedAt == nil {
+			return nil
+		}
 	}
+
+	return fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+}
+
+func (m *MemoryStore) personAddresses(ctx context.Context, personID int) ([]address, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]address, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return nil, err
+		}
+
+		var addresses []address
+		for _, a := range td.addresses {
+			if a.PersonID == personID {
+				addresses = append(addresses, a)
+			}
+		}
+
+		return addresses, nil
+	})
+}
+
+func (m *MemoryStore) addressForID(ctx context.Context, personID int, id int) (*address, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (*address, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return nil, err
+		}
+
+		for _, a := range td.addresses {
+			if a.ID == id && a.PersonID == personID {
+				return &a, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w for ID: %d", errAddressNotFound, id)
+	})
+}
+
+func (m *MemoryStore) addAddress(ctx context.Context, personID int, a address) (address, error) {
+	return memoryWrite(ctx, m, func(td *memoryTenant) (address, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return a, err
+		}
+
+		td.lastAddress++
+		a.ID = td.lastAddress
+		a.PersonID = personID
+		td.addresses = append(td.addresses, a)
+		return a, nil
+	})
+}
+
+func (m *MemoryStore) updateAddress(ctx context.Context, personID int, id int, a address) (address, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (address, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return a, err
+		}
+
+		for i, ea := range td.addresses {
+			if ea.ID == id && ea.PersonID == personID {
+				a.ID = id
+				a.PersonID = personID
+				td.addresses[i] = a
+				return a, nil
+			}
+		}
+
+		return a, fmt.Errorf("%w for ID: %d", errAddressNotFound, id)
+	})
 }
 
-func delete_at_index(people []Person, index int) []Person {
-	return append(people[:index], people[(index+1):]...)
+func (m *MemoryStore) deleteAddress(ctx context.Context, personID int, id int) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return struct{}{}, err
+		}
+
+		for i, a := range td.addresses {
+			if a.ID == id && a.PersonID == personID {
+				td.addresses = append(td.addresses[:i], td.addresses[i+1:]...)
+				return struct{}{}, nil
+			}
+		}
+
+		return struct{}{}, fmt.Errorf("%w for ID: %d", errAddressNotFound, id)
+	})
+
+	return err
+}
+
+func (m *MemoryStore) personRelationships(ctx context.Context, personID int, typ string) ([]relationship, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]relationship, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return nil, err
+		}
+
+		var relationships []relationship
+		for _, rel := range td.relationships {
+			if typ != "" && rel.Type != typ {
+				continue
+			}
+
+			other := rel.RelatedID
+			if rel.RelatedID == personID {
+				other = rel.PersonID
+			} else if rel.PersonID != personID {
+				continue
+			}
+			if td.currentPerson(other) == nil {
+				relationships = append(relationships, rel)
+			}
+		}
+
+		return relationships, nil
+	})
+}
+
+func (m *MemoryStore) addRelationship(ctx context.Context, rel relationship) (relationship, error) {
+	return memoryWrite(ctx, m, func(td *memoryTenant) (relationship, error) {
+		if err := td.currentPerson(rel.PersonID); err != nil {
+			return rel, err
+		}
+		if err := td.currentPerson(rel.RelatedID); err != nil {
+			return rel, err
+		}
+		if err := relationshipConflict(rel, td.relationships); err != nil {
+			return rel, err
+		}
+
+		// Following the hierarchy up from the new superior must not lead
+		// back to the person.
+		if relationshipTypes[rel.Type].hierarchical {
+			seen := map[int]bool{}
+			for id := rel.RelatedID; !seen[id]; {
+				if id == rel.PersonID {
+					return rel, fmt.Errorf("%w: %d is under %d", errRelationshipCycle, rel.RelatedID, rel.PersonID)
+				}
+				seen[id] = true
+				for _, e := range td.relationships {
+					if e.Type == rel.Type && e.PersonID == id {
+						id = e.RelatedID
+						break
+					}
+				}
+			}
+		}
+
+		td.lastRelationship++
+		rel.ID = td.lastRelationship
+		rel.CreatedAt = time.Now()
+		td.relationships = append(td.relationships, rel)
+		return rel, nil
+	})
+}
+
+func (m *MemoryStore) deleteRelationship(ctx context.Context, personID int, id int) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		if err := td.currentPerson(personID); err != nil {
+			return struct{}{}, err
+		}
+
+		for i, rel := range td.relationships {
+			if rel.ID == id && (rel.PersonID == personID || rel.RelatedID == personID) {
+				td.relationships = append(td.relationships[:i], td.relationships[i+1:]...)
+				return struct{}{}, nil
+			}
+		}
+
+		return struct{}{}, fmt.Errorf("%w for ID: %d", errRelationshipNotFound, id)
+	})
+
+	return err
+}
+
+// reportsUnder goes through the hierarchy a level at a time, so the reports
+// come out by depth, and sorts each level by ID.
+func (m *MemoryStore) reportsUnder(ctx context.Context, managerID int) ([]report, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]report, error) {
+		if err := td.currentPerson(managerID); err != nil {
+			return nil, err
+		}
+
+		current := map[int]Person{}
+		for _, p := range td.people {
+			if p.DeletedAt == nil {
+				p.deriveAge(time.Now())
+				current[p.ID] = p
+			}
+		}
+
+		var reports []report
+		seen := map[int]bool{managerID: true}
+		managers := []int{managerID}
+		for depth := 1; len(managers) > 0; depth++ {
+			var level []report
+			for _, rel := range td.relationships {
+				if rel.Type != relationshipManager || seen[rel.PersonID] {
+					continue
+				}
+				p, ok := current[rel.PersonID]
+				if !ok {
+					continue
+				}
+				for _, id := range managers {
+					if rel.RelatedID == id {
+						level = append(level, report{Person: p, ManagerID: id, Depth: depth})
+					}
+				}
+			}
+			sort.Slice(level, func(i, j int) bool { return level[i].Person.ID < level[j].Person.ID })
+
+			managers = nil
+			for _, r := range level {
+				seen[r.Person.ID] = true
+				managers = append(managers, r.Person.ID)
+			}
+			reports = append(reports, level...)
+		}
+
+		return reports, nil
+	})
+}
+
+func (m *MemoryStore) attributeSchemas(ctx context.Context) ([]attributeSchema, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]attributeSchema, error) {
+		return append([]attributeSchema(nil), td.schemas...), nil
+	})
+}
+
+func (m *MemoryStore) attributeSchemaForKey(ctx context.Context, key string) (*attributeSchema, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (*attributeSchema, error) {
+		for _, s := range td.schemas {
+			if s.Key == key {
+				return &s, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w for key: %s", errAttributeSchemaNotFound, key)
+	})
+}
+
+// putAttributeSchema keeps td.schemas sorted by key, as PostgresStore lists
+// them.
+func (m *MemoryStore) putAttributeSchema(ctx context.Context, s attributeSchema) (attributeSchema, error) {
+	return memoryWrite(ctx, m, func(td *memoryTenant) (attributeSchema, error) {
+		s.UpdatedAt = time.Now()
+		i := sort.Search(len(td.schemas), func(i int) bool { return td.schemas[i].Key >= s.Key })
+		if i < len(td.schemas) && td.schemas[i].Key == s.Key {
+			td.schemas[i] = s
+			return s, nil
+		}
+
+		td.schemas = append(td.schemas, attributeSchema{})
+		copy(td.schemas[i+1:], td.schemas[i:])
+		td.schemas[i] = s
+		return s, nil
+	})
+}
+
+func (m *MemoryStore) deleteAttributeSchema(ctx context.Context, key string) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		for i, s := range td.schemas {
+			if s.Key == key {
+				td.schemas = append(td.schemas[:i], td.schemas[i+1:]...)
+				return struct{}{}, nil
+			}
+		}
+
+		return struct{}{}, fmt.Errorf("%w for key: %s", errAttributeSchemaNotFound, key)
+	})
+
+	return err
+}
+
+func (m *MemoryStore) addWebhook(ctx context.Context, wh webhook) (webhook, error) {
+	return memoryWrite(ctx, m, func(td *memoryTenant) (webhook, error) {
+		td.lastWebhook++
+		wh.ID = td.lastWebhook
+		wh.Events = append([]string{}, wh.Events...)
+		wh.CreatedAt = time.Now()
+		td.webhooks = append(td.webhooks, wh)
+		return wh, nil
+	})
+}
+
+func (m *MemoryStore) allWebhooks(ctx context.Context) ([]webhook, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]webhook, error) {
+		return append([]webhook{}, td.webhooks...), nil
+	})
+}
+
+func (m *MemoryStore) webhookForID(ctx context.Context, id int) (*webhook, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (*webhook, error) {
+		for _, wh := range td.webhooks {
+			if wh.ID == id {
+				return &wh, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%w for ID: %d", errWebhookNotFound, id)
+	})
+}
+
+func (m *MemoryStore) updateWebhook(ctx context.Context, id int, wh webhook) (webhook, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (webhook, error) {
+		for i, ewh := range td.webhooks {
+			if ewh.ID == id {
+				wh.ID = id
+				wh.Events = append([]string{}, wh.Events...)
+				wh.CreatedAt = ewh.CreatedAt
+				if wh.Secret == "" {
+					wh.Secret = ewh.Secret
+				}
+				td.webhooks[i] = wh
+				return wh, nil
+			}
+		}
+
+		return wh, fmt.Errorf("%w for ID: %d", errWebhookNotFound, id)
+	})
+}
+
+func (m *MemoryStore) deleteWebhook(ctx context.Context, id int) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		for i, wh := range td.webhooks {
+			if wh.ID != id {
+				continue
+			}
+
+			td.webhooks = append(td.webhooks[:i], td.webhooks[i+1:]...)
+			kept := td.deliveries[:0]
+			for _, d := range td.deliveries {
+				if d.WebhookID != id {
+					kept = append(kept, d)
+				}
+			}
+			td.deliveries = kept
+			return struct{}{}, nil
+		}
+
+		return struct{}{}, fmt.Errorf("%w for ID: %d", errWebhookNotFound, id)
+	})
+
+	return err
+}
+
+func (m *MemoryStore) webhookDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]webhookDelivery, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]webhookDelivery, error) {
+		var deliveries []webhookDelivery
+		for i := len(td.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+			d := td.deliveries[i]
+			if (webhookID == 0 || d.WebhookID == webhookID) && (status == "" || d.Status == status) {
+				deliveries = append(deliveries, d)
+			}
+		}
+
+		return deliveries, nil
+	})
+}
+
+func (m *MemoryStore) claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) ([]webhookDelivery, error) {
+		now := time.Now()
+		var claimed []webhookDelivery
+		for i := range td.deliveries {
+			d := &td.deliveries[i]
+			if len(claimed) == limit {
+				break
+			}
+			if d.Status != deliveryPending || d.NextAttemptAt.After(now) {
+				continue
+			}
+
+			for _, wh := range td.webhooks {
+				if wh.ID == d.WebhookID && wh.Active {
+					d.NextAttemptAt = now.Add(lease)
+					c := *d
+					c.URL = wh.URL
+					c.Secret = wh.Secret
+					claimed = append(claimed, c)
+				}
+			}
+		}
+
+		return claimed, nil
+	})
+}
+
+func (m *MemoryStore) recordWebhookAttempt(ctx context.Context, d webhookDelivery) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		for i := range td.deliveries {
+			if td.deliveries[i].ID == d.ID {
+				d.URL = ""
+				d.Secret = ""
+				td.deliveries[i] = d
+			}
+		}
+
+		return struct{}{}, nil
+	})
+
+	return err
+}
+
+func (m *MemoryStore) reserveIdempotencyKey(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	type ret struct {
+		record   idempotencyRecord
+		reserved bool
+	}
+
+	r, err := memoryWrite(ctx, m, func(td *memoryTenant) (ret, error) {
+		existing, ok := td.idempotency[rec.Key]
+		if ok && time.Now().Before(existing.ExpiresAt) {
+			return ret{existing, false}, nil
+		}
+
+		td.idempotency[rec.Key] = rec
+		return ret{rec, true}, nil
+	})
+
+	return r.record, r.reserved, err
+}
+
+func (m *MemoryStore) completeIdempotencyKey(ctx context.Context, rec idempotencyRecord) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		td.idempotency[rec.Key] = rec
+		return struct{}{}, nil
+	})
+
+	return err
+}
+
+func (m *MemoryStore) releaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := memoryOp(ctx, m, func(td *memoryTenant) (struct{}, error) {
+		delete(td.idempotency, key)
+		return struct{}{}, nil
+	})
+
+	return err
+}
+
+func (m *MemoryStore) deleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	return memoryOp(ctx, m, func(td *memoryTenant) (int, error) {
+		now := time.Now()
+		n := 0
+		for key, rec := range td.idempotency {
+			if !now.Before(rec.ExpiresAt) {
+				delete(td.idempotency, key)
+				n++
+			}
+		}
+
+		return n, nil
+	})
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestMemoryStoreUpdatePersonVersion(t *testing.T) {
+	m := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+
+	// Every writer expects version 1, so exactly one may win.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(age int) {
+			defer wg.Done()
+			_, err := m.updatePerson(ctx, 1, Person{FirstName: "Bob", LastName: "Barker", Age: age}, 1)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	var ok, mismatched int
+	for err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case errors.Is(err, errVersionMismatch):
+			mismatched++
+		default:
+			t.Errorf("unexpected error: %s", err.Error())
+		}
+	}
+
+	if ok != 1 || mismatched != 9 {
+		t.Errorf("got %d successful and %d mismatched updates but expected 1 and 9", ok, mismatched)
+	}
+
+	p, err := m.personForID(ctx, 1, personQuery{})
+	if err != nil {
+		t.Errorf("error during personForID: %s", err.Error())
+		return
+	}
+
+	if p.Version != 2 {
+		t.Errorf("got version %d but expected 2", p.Version)
+	}
+
+	if err := m.deletePerson(ctx, 1, 1); !errors.Is(err, errVersionMismatch) {
+		t.Errorf("got error %v but expected %v", err, errVersionMismatch)
+	}
+}
@@ -1,17 +1,22 @@
 package main
 
 import (
-	"context"
 	"net/http"
 	"time"
 )
 
-func jsonMw(h http.Handler) http.Handler {
+// requestMw tags the request with an ID, reusing the caller's X-Request-ID
+// when there is a usable one, and with the actor named in X-Actor. X-Actor is
+// taken on trust, so it should only reach the API through a proxy that sets
+// it; once tokens are required, tenantMw replaces it with the token subject.
+func requestMw(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.Background()
-		r = r.WithContext(ctx)
-		w.Header().Add("Content-Type", "application/json")
-		h.ServeHTTP(w, r)
+		id := callerRequestID(r.Header.Get("X-Request-ID"))
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := withRequestID(r.Context(), id)
+		ctx = withActor(ctx, r.Header.Get("X-Actor"))
+		h.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
@@ -19,9 +24,10 @@ func logMw(actx AppContext, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func(t time.Time) {
 			l := loggerPayload{
-				Duration: time.Since(t).String(),
-				URL:      r.URL.String(),
-				Method:   r.Method,
+				Duration:  time.Since(t).String(),
+				URL:       r.URL.String(),
+				Method:    r.Method,
+				RequestID: requestIDFromContext(r.Context()),
 			}
 
 			actx.logger.info(l)
@@ -0,0 +1,42 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openapiSpec describes every route. openapi_test.go checks the handlers'
+// responses against it, so change the two together.
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+// swaggerUIPage renders openapi.json with Swagger UI loaded from a CDN.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>People API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+func handleOpenAPIGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", mediaJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(openapiSpec)
+}
+
+func handleDocsGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(swaggerUIPage))
+}
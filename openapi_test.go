@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// openapiDoc is the part of openapi.json the conformance test reads. The
+// response schemas are compiled from the spec itself, found by their JSON
+// pointers in it.
+type openapiDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Responses map[string]apiReply `json:"responses"`
+	} `json:"components"`
+
+	compiler *jsonschema.Compiler
+	schemas  map[string]*jsonschema.Schema
+}
+
+type apiOperation struct {
+	Responses map[string]apiReply `json:"responses"`
+}
+
+type apiReply struct {
+	Ref     string                     `json:"$ref"`
+	Content map[string]json.RawMessage `json:"content"`
+}
+
+func loadOpenAPI(t *testing.T) *openapiDoc {
+	doc := &openapiDoc{schemas: map[string]*jsonschema.Schema{}}
+	if err := json.Unmarshal(openapiSpec, doc); err != nil {
+		t.Fatalf("error during unmarshal of openapi.json: %s", err.Error())
+	}
+
+	var spec any
+	if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+		t.Fatalf("error during unmarshal of openapi.json: %s", err.Error())
+	}
+	closeSchemas(spec)
+	strict, _ := json.Marshal(spec)
+
+	doc.compiler = jsonschema.NewCompiler()
+	doc.compiler.Draft = jsonschema.Draft2020
+	doc.compiler.AssertFormat = true
+	if err := doc.compiler.AddResource("openapi.json", bytes.NewReader(strict)); err != nil {
+		t.Fatalf("error adding openapi.json: %s", err.Error())
+	}
+
+	return doc
+}
+
+// closeSchemas rejects properties a schema doesn't list, unless it says
+// otherwise with additionalProperties, so a response can't grow a field the
+// spec doesn't document.
+func closeSchemas(v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		_, listed := v["properties"].(map[string]any)
+		_, open := v["additionalProperties"]
+		if listed && !open {
+			v["unevaluatedProperties"] = false
+		}
+		for _, child := range v {
+			closeSchemas(child)
+		}
+	case []any:
+		for _, child := range v {
+			closeSchemas(child)
+		}
+	}
+}
+
+// validate checks v against the schema at pointer in the spec.
+func (doc *openapiDoc) validate(pointer string, v any) error {
+	schema, ok := doc.schemas[pointer]
+	if !ok {
+		var err error
+		if schema, err = doc.compiler.Compile("openapi.json#" + pointer); err != nil {
+			return err
+		}
+		doc.schemas[pointer] = schema
+	}
+
+	return schema.Validate(v)
+}
+
+// jsonPointer joins tokens into a JSON pointer, escaping each.
+func jsonPointer(tokens ...string) string {
+	var b strings.Builder
+	for _, t := range tokens {
+		b.WriteString("/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(t))
+	}
+
+	return b.String()
+}
+
+var templateParam = regexp.MustCompile(`\\\{[^}]+\\\}`)
+
+// route finds the path template a request path belongs to, preferring the
+// template with the fewest parameters so /people/changes beats /people/{id}.
+func (doc *openapiDoc) route(path string) (string, bool) {
+	best, params := "", -1
+	for tmpl := range doc.Paths {
+		re := templateParam.ReplaceAllString(regexp.QuoteMeta(tmpl), `[^/:]+`)
+		if !regexp.MustCompile("^" + re + "$").MatchString(path) {
+			continue
+		}
+		n := strings.Count(tmpl, "{")
+		if params == -1 || n < params {
+			best, params = tmpl, n
+		}
+	}
+
+	return best, params != -1
+}
+
+func (doc *openapiDoc) operation(tmpl, method string) (*apiOperation, bool) {
+	raw, ok := doc.Paths[tmpl][strings.ToLower(method)]
+	if !ok {
+		return nil, false
+	}
+
+	var op apiOperation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		return nil, false
+	}
+
+	return &op, true
+}
+
+// reply follows a $ref to a shared response, returning the response and
+// the pointer to it.
+func (doc *openapiDoc) reply(r apiReply, pointer string) (apiReply, string) {
+	if r.Ref != "" {
+		name := strings.TrimPrefix(r.Ref, "#/components/responses/")
+		return doc.Components.Responses[name], jsonPointer("components", "responses", name)
+	}
+
+	return r, pointer
+}
+
+// conforms checks that the response to a request is one openapi.json
+// documents, returning the operation it belongs to.
+func (doc *openapiDoc) conforms(r *http.Request, res *http.Response, body []byte) (string, error) {
+	// API paths are documented relative to the /v1 and /v2 servers.
+	path := r.URL.Path
+	for _, v := range apiVersions {
+		if rest, ok := strings.CutPrefix(path, "/"+v.name+"/"); ok {
+			path = "/" + rest
+		}
+	}
+
+	tmpl, ok := doc.route(path)
+	if !ok {
+		if res.StatusCode == http.StatusNotFound {
+			return "", doc.conformsTo(doc.Components.Responses["NotFound"], jsonPointer("components", "responses", "NotFound"), "404", res, body)
+		}
+		return "", fmt.Errorf("no path in the spec matches %s", path)
+	}
+	key := r.Method + " " + tmpl
+
+	op, ok := doc.operation(tmpl, r.Method)
+	if !ok {
+		if res.StatusCode == http.StatusMethodNotAllowed {
+			return key, doc.conformsTo(doc.Components.Responses["MethodNotAllowed"], jsonPointer("components", "responses", "MethodNotAllowed"), key, res, body)
+		}
+		return key, fmt.Errorf("%s is not in the spec", key)
+	}
+
+	code := fmt.Sprint(res.StatusCode)
+	rep, ok := op.Responses[code]
+	if !ok {
+		return key, fmt.Errorf("%s does not document status %d", key, res.StatusCode)
+	}
+
+	rep, pointer := doc.reply(rep, jsonPointer("paths", tmpl, strings.ToLower(r.Method), "responses", code))
+	return key, doc.conformsTo(rep, pointer, key, res, body)
+}
+
+// conformsTo checks a response against one documented response, found at
+// pointer in the spec.
+func (doc *openapiDoc) conformsTo(rep apiReply, pointer string, key string, res *http.Response, body []byte) error {
+	if len(rep.Content) == 0 {
+		if len(body) != 0 {
+			return fmt.Errorf("%s %d should have no body", key, res.StatusCode)
+		}
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("%s %d has Content-Type %q", key, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	if _, ok := rep.Content[mediaType]; !ok {
+		return fmt.Errorf("%s %d does not document %s", key, res.StatusCode, mediaType)
+	}
+
+	if mediaType != "application/json" {
+		return nil
+	}
+
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("%s %d: %s", key, res.StatusCode, err.Error())
+	}
+
+	if err := doc.validate(pointer+jsonPointer("content", mediaType, "schema"), v); err != nil {
+		return fmt.Errorf("%s %d: %w", key, res.StatusCode, err)
+	}
+
+	return nil
+}
+
+func Test_openapiConformance(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(NewHandler(AppContext{
+		storer:         &ms,
+		timeout:        time.Second,
+		idempotencyTTL: time.Minute,
+		logger:         noopLogger{},
+		swaggerUI:      true,
+	}))
+	defer server.Close()
+
+	type header = map[string]string
+	// Later requests depend on earlier ones, so the order matters.
+	for _, tc := range []struct {
+		method  string
+		path    string
+		body    string
+		headers header
+		status  int
+	}{
+		{"GET", "/", "", nil, 200},
+		{"POST", "/v1/people", `{"id": 5, "firstname": "Foo", "lastname": "Bar", "age": 22}`, nil, 200},
+		{"POST", "/v1/people", `{"id": 5`, nil, 400},
+		{"POST", "/v1/people", `{"id": 6, "firstname": "Bin", "lastname": "Baz"}`, header{"Idempotency-Key": "k"}, 200},
+		{"POST", "/v1/people", `{"id": 7, "firstname": "Bin", "lastname": "Baz"}`, header{"Idempotency-Key": "k"}, 422},
+		{"GET", "/v1/people", "", nil, 200},
+		{"GET", "/v1/people", "", header{"Accept": "text/csv"}, 200},
+		{"GET", "/v1/people", "", header{"Accept": "application/yaml"}, 200},
+		{"GET", "/v1/people", "", header{"Accept": "image/png"}, 406},
+		{"GET", "/v1/people?as_of=yesterday", "", nil, 400},
+		{"GET", "/v1/people/1", "", nil, 200},
+		{"GET", "/v1/people/1", "", header{"If-None-Match": `"1"`}, 304},
+		{"GET", "/v1/people/1", "", header{"Accept": "application/xml"}, 200},
+		{"GET", "/v1/people/1", "", header{"Accept": "text/plain"}, 406},
+		{"GET", "/v1/people/99", "", nil, 404},
+		{"PUT", "/v1/people/1", `{"firstname": "Foo", "lastname": "Baz", "age": 23}`, header{"If-Match": `"7"`}, 412},
+		{"PUT", "/v1/people/1", `{"firstname": "Foo", "lastname": "Baz", "age": 23}`, nil, 200},
+		{"PATCH", "/v1/people/1", `{"age": 24}`, nil, 200},
+		{"PATCH", "/v1/people/1", `age: 24`, header{"Content-Type": "application/yaml", "Accept": "application/msgpack"}, 200},
+		{"PATCH", "/v1/people/1", `age=24`, header{"Content-Type": "application/x-www-form-urlencoded"}, 415},
+		{"GET", "/v1/people/1/history", "", nil, 200},
+		{"PATCH", "/v1/people/1", `{"email": "foo@example.com", "phone": "+14155550123", "date_of_birth": "1990-04-30"}`, nil, 200},
+		{"PATCH", "/v1/people/2", `{"email": "FOO@example.com"}`, nil, 409},
+		{"PATCH", "/v1/people/2", `{"phone": "555-0123"}`, nil, 400},
+		{"POST", "/v1/people/1/addresses", `{"label": "home", "line1": "1 Main St", "city": "Springfield", "country": "us"}`, nil, 200},
+		{"POST", "/v1/people/1/addresses", `{"line1": "1 Main St", "city": "Springfield"}`, nil, 400},
+		{"GET", "/v1/people/1/addresses", "", nil, 200},
+		{"GET", "/v1/people/1/addresses/1", "", nil, 200},
+		{"PUT", "/v1/people/1/addresses/1", `{"line1": "2 Main St", "city": "Springfield", "country": "US"}`, nil, 200},
+		{"GET", "/v1/people/2/addresses/1", "", nil, 404},
+		{"DELETE", "/v1/people/1/addresses/1", "", nil, 200},
+		{"POST", "/v1/people/2/relationships", `{"type": "manager", "related_id": 1}`, nil, 200},
+		{"POST", "/v1/people/1/relationships", `{"type": "manager", "related_id": 2}`, nil, 409},
+		{"POST", "/v1/people/1/relationships", `{"type": "friend", "related_id": 2}`, nil, 400},
+		{"GET", "/v1/people/1/relationships?type=manager", "", nil, 200},
+		{"GET", "/v1/people/1/reports", "", nil, 200},
+		{"DELETE", "/v1/people/1/relationships/1", "", nil, 200},
+		{"PUT", "/v1/admin/attributes/level", `{"schema": {"type": "integer", "minimum": 1}}`, nil, 200},
+		{"PUT", "/v1/admin/attributes/level", `{"schema": {"type": 5}}`, nil, 400},
+		{"GET", "/v1/admin/attributes", "", nil, 200},
+		{"GET", "/v1/admin/attributes/level", "", nil, 200},
+		{"PATCH", "/v1/people/1", `{"attributes": {"department": "eng", "level": 3}}`, nil, 200},
+		{"PATCH", "/v1/people/1", `{"attributes": {"level": 0}}`, nil, 400},
+		{"GET", "/v1/people?attr.department=eng&attr.level=3", "", nil, 200},
+		{"GET", "/v1/people?attr.bad.key=1", "", nil, 400},
+		{"DELETE", "/v1/admin/attributes/level", "", nil, 200},
+		{"GET", "/v1/admin/attributes/level", "", nil, 404},
+		{"GET", "/v1/people/changes?limit=2", "", nil, 200},
+		{"GET", "/v1/people/changes?since=nonsense", "", nil, 400},
+		{"GET", "/v1/people/events", "", nil, 503},
+		{"GET", "/v1/people/search?q=barkr", "", nil, 200},
+		{"GET", "/v1/people/search?q=%21", "", nil, 400},
+		{"POST", "/v1/people/import", "id,firstname,lastname,age\n10,Qux,Quux,30\n", header{"Content-Type": "text/csv"}, 200},
+		{"POST", "/v1/people/import", "id,firstname,lastname,age\n11,,Quux,30\n", header{"Content-Type": "text/csv"}, 422},
+		{"POST", "/v1/people/import", "{}", header{"Content-Type": "application/json"}, 415},
+		{"POST", "/v1/people:batch", `{"operations": [{"op": "create", "person": {"id": 20, "firstname": "A", "lastname": "B"}}]}`, nil, 200},
+		{"POST", "/v1/people:batch", `{"operations": [{"op": "delete", "id": 99}]}`, nil, 400},
+		{"POST", "/graphql", `{"query": "{ person(id: 1) { id firstname } }"}`, nil, 200},
+		{"POST", "/graphql", `{"query": `, nil, 400},
+		{"POST", "/v1/webhooks", `{"url": "https://example.com/hook", "events": ["person.created"]}`, nil, 200},
+		{"POST", "/v1/webhooks", `{"url": "ftp://example.com/hook"}`, nil, 400},
+		{"GET", "/v1/webhooks", "", nil, 200},
+		{"GET", "/v1/webhooks/1", "", nil, 200},
+		{"PUT", "/v1/webhooks/1", `{"url": "https://example.com/other"}`, nil, 200},
+		{"POST", "/v1/people", `{"id": 4, "firstname": "Foo", "lastname": "Bar"}`, nil, 200},
+		{"GET", "/v1/webhooks/1/deliveries", "", nil, 200},
+		{"GET", "/v1/webhooks/dead_letters", "", nil, 200},
+		{"DELETE", "/v1/webhooks/1", "", nil, 200},
+		{"GET", "/v1/webhooks/1", "", nil, 404},
+		{"DELETE", "/v1/people/1", "", header{"If-Match": `"1"`}, 412},
+		{"DELETE", "/v1/people/1", "", nil, 200},
+		{"POST", "/v1/people/1:restore", "", nil, 200},
+		{"POST", "/v1/people/1:restore", "", nil, 409},
+		{"GET", "/openapi.json", "", nil, 200},
+		{"GET", "/docs", "", nil, 200},
+		{"GET", "/v1/people/1/extra", "", nil, 404},
+		{"DELETE", "/v1/people", "", nil, 405},
+	} {
+		req, _ := http.NewRequest(tc.method, server.URL+tc.path, strings.NewReader(tc.body))
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", tc.method, tc.path, err.Error())
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != tc.status {
+			t.Errorf("got status %d for %s %s but expected %d: %s", res.StatusCode, tc.method, tc.path, tc.status, bytes.TrimSpace(body))
+			continue
+		}
+
+		if _, err := doc.conforms(req, res, body); err != nil {
+			t.Errorf("%s %s: %s", tc.method, tc.path, err.Error())
+		}
+	}
+}
+
+// Test_openapiOperations checks that every operation in the spec names a
+// method the handlers serve, so a removed route can't linger in the docs.
+func Test_openapiOperations(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	var ops []string
+	for tmpl, methods := range doc.Paths {
+		for m := range methods {
+			if m != "parameters" && m != "servers" {
+				ops = append(ops, strings.ToUpper(m)+" "+tmpl)
+			}
+		}
+	}
+	sort.Strings(ops)
+
+	exp := []string{
+		"DELETE /admin/attributes/{key}",
+		"DELETE /people/{id}",
+		"DELETE /people/{id}/addresses/{addressID}",
+		"DELETE /people/{id}/relationships/{relationshipID}",
+		"DELETE /webhooks/{id}",
+		"GET /",
+		"GET /admin/attributes",
+		"GET /admin/attributes/{key}",
+		"GET /docs",
+		"GET /openapi.json",
+		"GET /people",
+		"GET /people/changes",
+		"GET /people/events",
+		"GET /people/search",
+		"GET /people/{id}",
+		"GET /people/{id}/addresses",
+		"GET /people/{id}/addresses/{addressID}",
+		"GET /people/{id}/history",
+		"GET /people/{id}/relationships",
+		"GET /people/{id}/reports",
+		"GET /webhooks",
+		"GET /webhooks/dead_letters",
+		"GET /webhooks/{id}",
+		"GET /webhooks/{id}/deliveries",
+		"PATCH /people/{id}",
+		"POST /graphql",
+		"POST /people",
+		"POST /people/import",
+		"POST /people/{id}/addresses",
+		"POST /people/{id}/relationships",
+		"POST /people/{id}:restore",
+		"POST /people:batch",
+		"POST /webhooks",
+		"PUT /admin/attributes/{key}",
+		"PUT /people/{id}",
+		"PUT /people/{id}/addresses/{addressID}",
+		"PUT /webhooks/{id}",
+	}
+
+	if strings.Join(ops, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("got operations\n%s\nbut expected\n%s", strings.Join(ops, "\n"), strings.Join(exp, "\n"))
+	}
+}
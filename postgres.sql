@@ -1,6 +1,289 @@
+create extension if not exists pg_trgm;
+
+-- Every table of tenant data has a tenant_id, and row-level security only
+-- lets a connection see and write the rows of the tenant it has set in
+-- app.tenant_id. The API runs as people_api, which doesn't bypass it, even
+-- when it logs in as the tables' owner or a superuser.
+create role people_api NOLOGIN;
+grant people_api to current_user;
+
+-- current_tenant is the tenant the connection has set, or NULL when it has
+-- set none, which matches no rows and fails inserts.
+create function current_tenant() RETURNS text AS $$
+  SELECT nullif(current_setting('app.tenant_id', true), '')
+$$ LANGUAGE sql STABLE;
+
+-- tenants lists every tenant that has had people or webhooks, for the
+-- background work done tenant by tenant. It holds nothing else of theirs,
+-- so it is the one table without row-level security.
+create table tenants (
+  id text PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
 create table people (
-  id integer PRIMARY KEY,
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id serial,
+  firstname text NOT NULL,
+  lastname text NOT NULL,
+  age integer,
+  version integer NOT NULL DEFAULT 1,
+  deleted_at timestamptz,
+  email text,
+  phone text,
+  date_of_birth date,
+  attributes jsonb NOT NULL DEFAULT '{}',
+  valid_from timestamptz NOT NULL DEFAULT now(),
+  search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', firstname || ' ' || lastname)) STORED,
+  PRIMARY KEY (tenant_id, id)
+);
+
+create index people_deleted_at on people (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- Emails are unique within a tenant regardless of case, soft deleted people
+-- included.
+create unique index people_email on people (tenant_id, lower(email));
+
+-- The attr.<key> filters of GET /people are jsonb containment queries.
+create index people_attributes on people USING gin (attributes jsonb_path_ops);
+
+-- attribute_schemas holds the JSON Schema, if any, of each attribute key.
+create table attribute_schemas (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  key text NOT NULL,
+  schema jsonb NOT NULL,
+  updated_at timestamptz NOT NULL DEFAULT now(),
+  PRIMARY KEY (tenant_id, key)
+);
+
+-- GET /people/search matches words with search_vector and misspellings with
+-- trigrams of each name and of the full name.
+create index people_search_vector on people USING gin (search_vector);
+create index people_firstname_trgm on people USING gin (firstname gin_trgm_ops);
+create index people_lastname_trgm on people USING gin (lastname gin_trgm_ops);
+create index people_name_trgm on people USING gin ((firstname || ' ' || lastname) gin_trgm_ops);
+
+-- people_history holds every replaced version of a person along with the
+-- system time range it was current for. The store writes it alongside each
+-- change to people.
+create table people_history (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id integer NOT NULL,
   firstname text NOT NULL,
   lastname text NOT NULL,
-  age integer
+  age integer,
+  version integer NOT NULL,
+  deleted_at timestamptz,
+  email text,
+  phone text,
+  date_of_birth date,
+  attributes jsonb NOT NULL DEFAULT '{}',
+  sys_period tstzrange NOT NULL
+);
+
+create index people_history_id on people_history (tenant_id, id, version);
+create index people_history_sys_period on people_history USING gist (sys_period);
+
+create table addresses (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id serial PRIMARY KEY,
+  person_id integer NOT NULL,
+  label text NOT NULL DEFAULT '',
+  line1 text NOT NULL,
+  line2 text NOT NULL DEFAULT '',
+  city text NOT NULL,
+  region text NOT NULL DEFAULT '',
+  postal_code text NOT NULL DEFAULT '',
+  country text NOT NULL,
+  FOREIGN KEY (tenant_id, person_id) REFERENCES people (tenant_id, id) ON DELETE CASCADE
+);
+
+create index addresses_person_id on addresses (tenant_id, person_id, id);
+
+-- relationships: person_id's type is related_id, so for manager related_id
+-- manages person_id. A person has one manager at most.
+create table relationships (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id serial PRIMARY KEY,
+  person_id integer NOT NULL,
+  related_id integer NOT NULL,
+  type text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  CHECK (person_id <> related_id),
+  UNIQUE (tenant_id, person_id, related_id, type),
+  FOREIGN KEY (tenant_id, person_id) REFERENCES people (tenant_id, id) ON DELETE CASCADE,
+  FOREIGN KEY (tenant_id, related_id) REFERENCES people (tenant_id, id) ON DELETE CASCADE
+);
+
+create unique index relationships_one_manager on relationships (tenant_id, person_id) where type = 'manager';
+create index relationships_related_id on relationships (tenant_id, related_id, type);
+
+-- people_outbox is the transactional outbox behind GET /people/changes.
+-- txid lets readers skip events from transactions that have not committed.
+create table people_outbox (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id bigserial PRIMARY KEY,
+  txid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+  person_id integer NOT NULL,
+  action text NOT NULL,
+  person jsonb,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+create index people_outbox_order on people_outbox (txid, id);
+create index people_outbox_created_at on people_outbox (created_at);
+
+create table idempotency_keys (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  key text NOT NULL,
+  fingerprint text NOT NULL,
+  status integer NOT NULL DEFAULT 0,
+  header jsonb,
+  body bytea,
+  expires_at timestamptz NOT NULL,
+  PRIMARY KEY (tenant_id, key)
+);
+
+create index idempotency_keys_expires_at on idempotency_keys (expires_at);
+
+create table person_audit (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id bigserial PRIMARY KEY,
+  person_id integer NOT NULL,
+  action text NOT NULL,
+  actor text NOT NULL,
+  request_id text NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  before jsonb,
+  after jsonb
+);
+
+create index person_audit_person_id on person_audit (tenant_id, person_id, id);
+
+create table webhooks (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id serial PRIMARY KEY,
+  url text NOT NULL,
+  secret text NOT NULL,
+  events text[] NOT NULL DEFAULT '{}',
+  active boolean NOT NULL DEFAULT true,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  UNIQUE (tenant_id, id)
+);
+
+-- webhook_deliveries is the delivery queue, dead letter list and delivery
+-- log in one: rows stay behind once delivered or dead.
+create table webhook_deliveries (
+  tenant_id text NOT NULL DEFAULT current_tenant(),
+  id bigserial PRIMARY KEY,
+  webhook_id integer NOT NULL,
+  event_id bigint NOT NULL,
+  event text NOT NULL,
+  person_id integer NOT NULL,
+  person jsonb,
+  status text NOT NULL DEFAULT 'pending',
+  attempts integer NOT NULL DEFAULT 0,
+  next_attempt_at timestamptz NOT NULL DEFAULT now(),
+  last_status integer NOT NULL DEFAULT 0,
+  last_error text NOT NULL DEFAULT '',
+  created_at timestamptz NOT NULL,
+  delivered_at timestamptz,
+  FOREIGN KEY (tenant_id, webhook_id) REFERENCES webhooks (tenant_id, id) ON DELETE CASCADE
 );
+
+create index webhook_deliveries_due on webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+create index webhook_deliveries_webhook_id on webhook_deliveries (webhook_id, id);
+create index webhook_deliveries_dead on webhook_deliveries (id) WHERE status = 'dead';
+
+-- Every outbox event queues a delivery for each active webhook that wants
+-- it, in the same transaction as the change.
+create function queue_webhook_deliveries() RETURNS trigger AS $$
+DECLARE
+  event text := CASE NEW.action
+    WHEN 'create' THEN 'person.created'
+    WHEN 'update' THEN 'person.updated'
+    WHEN 'delete' THEN 'person.deleted'
+    WHEN 'restore' THEN 'person.restored'
+    WHEN 'purge' THEN 'person.purged'
+  END;
+BEGIN
+  INSERT INTO webhook_deliveries (tenant_id, webhook_id, event_id, event, person_id, person, created_at)
+  SELECT w.tenant_id, w.id, NEW.id, event, NEW.person_id, NEW.person, NEW.created_at
+  FROM webhooks w
+  WHERE w.tenant_id = NEW.tenant_id AND w.active AND (cardinality(w.events) = 0 OR event = ANY (w.events));
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+create trigger people_outbox_webhooks AFTER INSERT ON people_outbox
+  FOR EACH ROW EXECUTE FUNCTION queue_webhook_deliveries();
+
+-- Each transaction that writes outbox events notifies listening replicas
+-- once per tenant when it commits, with the tenant and the IDs of the people
+-- it changed separated by spaces. A transaction that changed more than 500
+-- people sends the tenant alone, which keeps the payload well inside
+-- pg_notify's limit and means any of the tenant's people may have changed.
+-- The trigger is deferred to commit and fires for every row, but only the
+-- first firing of a transaction does anything, so a batch or import of
+-- thousands of rows wakes each replica once.
+create function notify_people_change() RETURNS trigger AS $$
+DECLARE
+  change record;
+BEGIN
+  IF current_setting('app.people_notified', true) = 'on' THEN
+    RETURN NULL;
+  END IF;
+  PERFORM set_config('app.people_notified', 'on', true);
+
+  FOR change IN
+    SELECT tenant_id, count(DISTINCT person_id) AS people, string_agg(DISTINCT person_id::text, ' ') AS ids
+    FROM people_outbox
+    WHERE txid = pg_current_xact_id()
+    GROUP BY tenant_id
+  LOOP
+    IF change.people > 500 THEN
+      PERFORM pg_notify('people_changes', change.tenant_id);
+    ELSE
+      PERFORM pg_notify('people_changes', change.tenant_id || ' ' || change.ids);
+    END IF;
+  END LOOP;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+create constraint trigger people_outbox_notify AFTER INSERT ON people_outbox
+  DEFERRABLE INITIALLY DEFERRED
+  FOR EACH ROW EXECUTE FUNCTION notify_people_change();
+
+create function register_tenants() RETURNS trigger AS $$
+BEGIN
+  INSERT INTO tenants (id) SELECT DISTINCT tenant_id FROM new_rows ON CONFLICT DO NOTHING;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+create trigger people_tenants AFTER INSERT ON people
+  REFERENCING NEW TABLE AS new_rows
+  FOR EACH STATEMENT EXECUTE FUNCTION register_tenants();
+
+create trigger webhooks_tenants AFTER INSERT ON webhooks
+  REFERENCING NEW TABLE AS new_rows
+  FOR EACH STATEMENT EXECUTE FUNCTION register_tenants();
+
+-- FORCE applies the policies to the tables' owner as well, so that nothing
+-- reads across tenants without saying so.
+DO $$
+DECLARE
+  t text;
+BEGIN
+  FOREACH t IN ARRAY ARRAY['people', 'people_history', 'attribute_schemas', 'addresses', 'relationships',
+      'people_outbox', 'idempotency_keys', 'person_audit', 'webhooks', 'webhook_deliveries'] LOOP
+    EXECUTE format('alter table %I enable row level security', t);
+    EXECUTE format('alter table %I force row level security', t);
+    EXECUTE format('create policy tenant_isolation on %I USING (tenant_id = current_tenant()) WITH CHECK (tenant_id = current_tenant())', t);
+  END LOOP;
+END;
+$$;
+
+grant select, insert, update, delete on all tables in schema public to people_api;
+grant usage on all sequences in schema public to people_api;
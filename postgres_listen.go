@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// peopleChannel is the channel the people_outbox trigger notifies once
+	// per tenant of each transaction as it commits, with the tenant and the
+	// IDs of the people it changed separated by spaces, or the tenant alone
+	// when it changed too many to list.
+	peopleChannel = "people_changes"
+
+	// listenHealthCheck is how long the listener waits for a notification
+	// before pinging, so a connection that died quietly is noticed.
+	listenHealthCheck = 30 * time.Second
+
+	listenMinBackoff = time.Second
+	listenMaxBackoff = 30 * time.Second
+)
+
+// listen holds a connection taken from the pool in LISTEN on peopleChannel
+// until ctx is done, calling onChange with the tenant and person IDs of each
+// notification, or nil IDs when any of the tenant's people may have
+// changed. Notifications sent while the connection was down are lost, so
+// onResync is called each time listening (re)starts, and whatever it resets
+// must not depend on having seen every notification.
+func (ps PostgresStore) listen(ctx context.Context, logger logger, onChange func(tenant string, ids []int), onResync func()) {
+	backoff := listenMinBackoff
+	for {
+		listened, err := ps.listenOnce(ctx, onChange, onResync)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if listened {
+			backoff = listenMinBackoff
+		}
+		logger.error(fmt.Errorf("listening on %s: %w", peopleChannel, err))
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > listenMaxBackoff {
+			backoff = listenMaxBackoff
+		}
+	}
+}
+
+// listenOnce listens until the connection fails, reporting whether LISTEN
+// got as far as succeeding.
+func (ps PostgresStore) listenOnce(ctx context.Context, onChange func(tenant string, ids []int), onResync func()) (bool, error) {
+	pc, err := ps.pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// A connection left listening can't go back to the pool, so it is taken
+	// out of it and closed when done.
+	conn := pc.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+peopleChannel); err != nil {
+		return false, err
+	}
+
+	onResync()
+
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, listenHealthCheck)
+		n, err := conn.WaitForNotification(waitCtx)
+		cancel()
+
+		switch {
+		case err == nil:
+			tenant, ids, err := parseChangePayload(n.Payload)
+			if err != nil {
+				onResync()
+				continue
+			}
+			onChange(tenant, ids)
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			if err := conn.Ping(ctx); err != nil {
+				return true, err
+			}
+		default:
+			return true, err
+		}
+	}
+}
+
+// parseChangePayload splits a peopleChannel payload into its tenant and
+// person IDs.
+func parseChangePayload(payload string) (string, []int, error) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return "", nil, errors.New("empty payload")
+	}
+
+	var ids []int
+	for _, f := range fields[1:] {
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			return "", nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return fields[0], ids, nil
+}
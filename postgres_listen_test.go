@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_parseChangePayload(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		tenant  string
+		ids     []int
+		err     bool
+	}{
+		{payload: "acme 7", tenant: "acme", ids: []int{7}},
+		{payload: "acme 1 2 30", tenant: "acme", ids: []int{1, 2, 30}},
+		{payload: "acme", tenant: "acme"},
+		{payload: "", err: true},
+		{payload: "acme 1 x", err: true},
+	} {
+		tenant, ids, err := parseChangePayload(tc.payload)
+		if (err != nil) != tc.err {
+			t.Errorf("got error %v for %q but expected error %t", err, tc.payload, tc.err)
+			continue
+		}
+		if tenant != tc.tenant || !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("got %q %v for %q but expected %q %v", tenant, ids, tc.payload, tc.tenant, tc.ids)
+		}
+	}
+}
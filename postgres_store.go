@@ -2,9 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -19,9 +28,46 @@ func NewPostgresStore(dbURL string) PostgresStore {
 	}
 }
 
+// startDatabase connects as the role people_api, which row-level security
+// applies to, and sets app.tenant_id to the tenant in the context each time
+// a connection is taken from the pool. Every statement the store runs, on
+// the pool or in a transaction begun on it, only sees that tenant's rows.
+//
+// Setting the tenant costs a round trip of its own, so each connection
+// remembers the tenant it has set and only sets it again when it is taken
+// for another one. A request for the tenant a connection last served runs
+// with no extra round trip; one for another tenant pays one.
 func (ps *PostgresStore) startDatabase() func() {
 	fmt.Println("Starting the database")
-	dbpool, err := pgxpool.New(context.Background(), ps.dbURL)
+	config, err := pgxpool.ParseConfig(ps.dbURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse the database URL %v\n", err)
+		os.Exit(1)
+	}
+
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, "SET ROLE people_api")
+		return err
+	}
+	// A connection whose tenant can't be set is closed rather than used.
+	var connTenants sync.Map
+	config.BeforeAcquire = func(ctx context.Context, conn *pgx.Conn) bool {
+		tenant := tenantFromContext(ctx)
+		if set, ok := connTenants.Load(conn); ok && set == tenant {
+			return true
+		}
+
+		if _, err := conn.Exec(ctx, "SELECT set_config('app.tenant_id', $1, false)", tenant); err != nil {
+			return false
+		}
+		connTenants.Store(conn, tenant)
+		return true
+	}
+	config.BeforeClose = func(conn *pgx.Conn) {
+		connTenants.Delete(conn)
+	}
+
+	dbpool, err := pgxpool.NewWithConfig(context.Background(), config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to create connection pool %v\n", err)
 		os.Exit(1)
@@ -32,89 +78,1493 @@ func (ps *PostgresStore) startDatabase() func() {
 	}
 }
 
-func (ps PostgresStore) allPeople(ctx context.Context) ([]Person, error) {
+// personSelect lists the people columns in the order scanPerson expects.
+const personSelect = `id, firstname, lastname, age, version, deleted_at, email, phone, date_of_birth, attributes`
+
+// scanPerson scans the personSelect columns followed by any extra ones. The
+// contact details are NULL when unset, and Age is derived afresh for people
+// with a date of birth.
+func scanPerson(row pgx.Row, extra ...any) (Person, error) {
+	var p Person
+	var email, phone *string
+	var dob *time.Time
+	dest := []any{&p.ID, &p.FirstName, &p.LastName, &p.Age, &p.Version, &p.DeletedAt, &email, &phone, &dob, &p.Attributes}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return p, err
+	}
+
+	if email != nil {
+		p.Email = *email
+	}
+	if phone != nil {
+		p.Phone = *phone
+	}
+	if dob != nil {
+		p.DateOfBirth = dob.Format(dateLayout)
+		p.deriveAge(time.Now())
+	}
+
+	return p, nil
+}
+
+// personArgs are the parameters the write statements take for a person's
+// fields, with unset contact details as NULL. DateOfBirth has been validated
+// by then.
+func personArgs(p Person) []any {
+	var dob *time.Time
+	if t, err := time.Parse(dateLayout, p.DateOfBirth); err == nil {
+		dob = &t
+	}
+
+	attrs := p.Attributes
+	if attrs == nil {
+		attrs = attributes{}
+	}
+
+	return []any{p.FirstName, p.LastName, p.Age, nullString(p.Email), nullString(p.Phone), dob, attrs}
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return &s
+}
+
+// emailError turns a violation of the unique email index into errEmailTaken.
+func emailError(err error, email string) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != "23505" || pgErr.ConstraintName != "people_email" {
+		return err
+	}
+
+	return fmt.Errorf("%w: %s", errEmailTaken, email)
+}
+
+func (ps PostgresStore) eachPerson(ctx context.Context, pq personQuery, fn func(p Person) error) error {
 	q := `
-  SELECT id, lastname, firstname, age
+  SELECT ` + personSelect + `
   FROM people
-  ORDER BY id DESC
+  WHERE ($1 OR deleted_at IS NULL)
   `
-	rows, err := ps.pool.Query(ctx, q)
+	args := []any{pq.IncludeDeleted}
+	if !pq.AsOf.IsZero() {
+		q = asOfPeopleSQL
+		args = []any{pq.AsOf, pq.IncludeDeleted}
+	}
+
+	cond, args := attributeConditions(pq, args)
+	rows, err := ps.pool.Query(ctx, q+cond+`ORDER BY id DESC`, args...)
 	if err != nil {
-		return []Person{}, err
+		return err
 	}
 	defer rows.Close()
 
-	res := []Person{}
 	for rows.Next() {
-		var p Person
-		if err = rows.Scan(&p.ID, &p.LastName, &p.FirstName, &p.Age); err != nil {
-			return []Person{}, err
+		p, err := scanPerson(rows)
+		if err != nil {
+			return err
 		}
 
-		res = append(res, p)
+		if err := fn(p); err != nil {
+			return err
+		}
 	}
 
-	return res, nil
+	return rows.Err()
 }
 
-func (ps PostgresStore) personForID(ctx context.Context, id int) (*Person, error) {
+// personAgeSQL is a person's age as Person.deriveAge works it out.
+const personAgeSQL = `CASE WHEN date_of_birth IS NULL THEN age ELSE greatest(date_part('year', age(current_date, date_of_birth))::int, 0) END`
+
+// pagePeople counts the matches and reads the page in one snapshot, so the
+// counts agree with the page.
+func (ps PostgresStore) pagePeople(ctx context.Context, f personFilter, after int, limit int) (peoplePage, error) {
 	q := `
-  SELECT id, lastname, firstname, age
+  SELECT ` + personSelect + `
   FROM people
-  WHERE id = $1
+  WHERE ($1 OR deleted_at IS NULL)
   `
-	var p Person
-	row := ps.pool.QueryRow(ctx, q, id)
+	args := []any{f.IncludeDeleted}
+	if !f.AsOf.IsZero() {
+		q = asOfPeopleSQL
+		args = []any{f.AsOf, f.IncludeDeleted}
+	}
+
+	cond, args := attributeConditions(f.personQuery, args)
+	q += cond
+	if f.FirstName != "" {
+		args = append(args, f.FirstName)
+		q += fmt.Sprintf("AND lower(firstname) = lower($%d)\n  ", len(args))
+	}
+	if f.LastName != "" {
+		args = append(args, f.LastName)
+		q += fmt.Sprintf("AND lower(lastname) = lower($%d)\n  ", len(args))
+	}
+	if f.MinAge != nil {
+		args = append(args, *f.MinAge)
+		q += fmt.Sprintf("AND %s >= $%d\n  ", personAgeSQL, len(args))
+	}
+	if f.MaxAge != nil {
+		args = append(args, *f.MaxAge)
+		q += fmt.Sprintf("AND %s <= $%d\n  ", personAgeSQL, len(args))
+	}
+	args = append(args, after, limit)
+	n := len(args)
+
+	var page peoplePage
+	err := pgx.BeginTxFunc(ctx, ps.pool, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		counts := fmt.Sprintf(`
+  SELECT count(*), count(*) FILTER (WHERE id <= $%d)
+  FROM (%s) matched
+  `, n-1, q)
+		if err := tx.QueryRow(ctx, counts, args[:n-1]...).Scan(&page.Total, &page.Before); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query(ctx, fmt.Sprintf(`
+  SELECT `+personSelect+`
+  FROM (%s) matched
+  WHERE id > $%d
+  ORDER BY id
+  LIMIT $%d
+  `, q, n-1, n), args...)
+		if err != nil {
+			return err
+		}
+
+		page.People, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (Person, error) {
+			return scanPerson(row)
+		})
+		return err
+	})
+
+	return page, err
+}
+
+// attributeConditions returns the SQL for the attribute filters of pq, to
+// follow the WHERE clause of a query that already takes args. Each filter is
+// a jsonb containment, which the people_attributes index serves.
+func attributeConditions(pq personQuery, args []any) (string, []any) {
+	keys := make([]string, 0, len(pq.Attributes))
+	for k := range pq.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		var alts []string
+		for _, v := range attributeFilterValues(pq.Attributes[k]) {
+			args = append(args, map[string]any{k: v})
+			alts = append(alts, fmt.Sprintf("attributes @> $%d", len(args)))
+		}
+		b.WriteString("AND (" + strings.Join(alts, " OR ") + ")\n  ")
+	}
+
+	return b.String(), args
+}
+
+// checkAttributes runs checkAttributes with the stored schemas.
+func (ps PostgresStore) checkAttributes(ctx context.Context, attrs attributes) (attributes, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+
+	schemas, err := ps.attributeSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkAttributes(attrs, schemas)
+}
+
+func (ps PostgresStore) personForID(ctx context.Context, id int, pq personQuery) (*Person, error) {
+	q := `
+  SELECT ` + personSelect + `
+  FROM people
+  WHERE id = $1 AND ($2 OR deleted_at IS NULL)
+  `
+	args := []any{id, pq.IncludeDeleted}
+	if !pq.AsOf.IsZero() {
+		q = asOfPeopleSQL + `AND id = $3
+  `
+		args = []any{pq.AsOf, pq.IncludeDeleted, id}
+	}
 
-	if err := row.Scan(&p.ID, &p.LastName, &p.FirstName, &p.Age); err != nil {
+	cond, args := attributeConditions(pq, args)
+	p, err := scanPerson(ps.pool.QueryRow(ctx, q+cond, args...))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+		}
 		return nil, err
 	}
 
 	return &p, nil
 }
 
-func (ps PostgresStore) addPerson(ctx context.Context, p Person) (Person, error) {
+// The write statements record their audit event and their people_outbox
+// change event in the same statement as the change, so they all commit or
+// roll back together. The trailing parameters of each are the actor and
+// request ID.
+//
+// Every statement that replaces or removes a row also closes off the old
+// version in people_history, so the pair of tables describes each person
+// over time: a row in people is valid from its valid_from onwards and each
+// history row for the sys_period it covers.
+const (
+	insertPersonSQL = `
+  WITH new AS (
+    INSERT INTO people (firstname, lastname, age, email, phone, date_of_birth, attributes)
+    VALUES ($1, $2, $3, $4, $5, $6, $7)
+    RETURNING ` + personSelect + `
+  ), audit AS (
+    INSERT INTO person_audit (person_id, action, actor, request_id, after)
+    SELECT new.id, 'create', $8, $9, to_jsonb(new) FROM new
+  ), outbox AS (
+    INSERT INTO people_outbox (person_id, action, person)
+    SELECT new.id, 'create', to_jsonb(new) FROM new
+  )
+  SELECT id, version FROM new
+  `
+
+	// insertPeopleSQL is insertPersonSQL for many people at once, from one
+	// array per column. COPY would be quicker still, but Postgres refuses
+	// COPY FROM into a table under row-level security.
+	insertPeopleSQL = `
+  WITH new AS (
+    INSERT INTO people (id, firstname, lastname, age, email, phone, date_of_birth, attributes)
+    SELECT u.id, u.firstname, u.lastname, u.age, u.email, u.phone, u.date_of_birth::date, u.attributes::jsonb
+    FROM unnest($1::int[], $2::text[], $3::text[], $4::int[], $5::text[], $6::text[], $7::text[], $8::text[])
+      AS u(id, firstname, lastname, age, email, phone, date_of_birth, attributes)
+    RETURNING ` + personSelect + `
+  ), audit AS (
+    INSERT INTO person_audit (person_id, action, actor, request_id, after)
+    SELECT new.id, 'create', $9, $10, to_jsonb(new) FROM new ORDER BY new.id
+  ), outbox AS (
+    INSERT INTO people_outbox (person_id, action, person)
+    SELECT new.id, 'create', to_jsonb(new) FROM new ORDER BY new.id
+  )
+  SELECT count(*) FROM new
+  `
+
+	updatePersonSQL = `
+  WITH old AS (
+    SELECT ` + personSelect + `, valid_from
+    FROM people
+    WHERE id = $8 AND deleted_at IS NULL
+    FOR UPDATE
+  ), new AS (
+    UPDATE people
+    SET firstname=$1, lastname=$2, age=$3, email=$4, phone=$5, date_of_birth=$6, attributes=$7, version = people.version + 1, valid_from = now()
+    FROM old
+    WHERE people.id = old.id AND ($9 = 0 OR old.version = $9)
+    RETURNING ` + newPersonSelect + `
+  ), history AS (
+    INSERT INTO people_history (` + personSelect + `, sys_period)
+    SELECT ` + oldPersonSelect + `, tstzrange(old.valid_from, now()) FROM old, new
+  ), audit AS (
+    INSERT INTO person_audit (person_id, action, actor, request_id, before, after)
+    SELECT new.id, 'update', $10, $11, to_jsonb(old) - 'valid_from', to_jsonb(new) FROM old, new
+  ), outbox AS (
+    INSERT INTO people_outbox (person_id, action, person)
+    SELECT new.id, 'update', to_jsonb(new) FROM new
+  )
+  SELECT ` + personSelect + ` FROM new
+  `
+
+	// deletePersonSQL only marks the person deleted; purgeSQL removes the
+	// row for good once it has been deleted for longer than the retention.
+	deletePersonSQL = `
+  WITH old AS (
+    SELECT ` + personSelect + `, valid_from
+    FROM people
+    WHERE id = $1 AND deleted_at IS NULL
+    FOR UPDATE
+  ), new AS (
+    UPDATE people
+    SET deleted_at = now(), version = people.version + 1, valid_from = now()
+    FROM old
+    WHERE people.id = old.id AND ($2 = 0 OR old.version = $2)
+    RETURNING ` + newPersonSelect + `
+  ), history AS (
+    INSERT INTO people_history (` + personSelect + `, sys_period)
+    SELECT ` + oldPersonSelect + `, tstzrange(old.valid_from, now()) FROM old, new
+  ), audit AS (
+    INSERT INTO person_audit (person_id, action, actor, request_id, before, after)
+    SELECT new.id, 'delete', $3, $4, to_jsonb(old) - 'valid_from', to_jsonb(new) FROM old, new
+  ), outbox AS (
+    INSERT INTO people_outbox (person_id, action, person)
+    SELECT new.id, 'delete', to_jsonb(new) FROM new
+  )
+  SELECT id FROM new
+  `
+
+	restorePersonSQL = `
+  WITH old AS (
+    SELECT ` + personSelect + `, valid_from
+    FROM people
+    WHERE id = $1 AND deleted_at IS NOT NULL
+    FOR UPDATE
+  ), new AS (
+    UPDATE people
+    SET deleted_at = NULL, version = people.version + 1, valid_from = now()
+    FROM old
+    WHERE people.id = old.id
+    RETURNING ` + newPersonSelect + `
+  ), history AS (
+    INSERT INTO people_history (` + personSelect + `, sys_period)
+    SELECT ` + oldPersonSelect + `, tstzrange(old.valid_from, now()) FROM old, new
+  ), audit AS (
+    INSERT INTO person_audit (person_id, action, actor, request_id, before, after)
+    SELECT new.id, 'restore', $2, $3, to_jsonb(old) - 'valid_from', to_jsonb(new) FROM old, new
+  ), outbox AS (
+    INSERT INTO people_outbox (person_id, action, person)
+    SELECT new.id, 'restore', to_jsonb(new) FROM new
+  )
+  SELECT ` + personSelect + ` FROM new
+  `
+
+	purgeSQL = `
+  WITH old AS (
+    DELETE FROM people
+    WHERE deleted_at < $1
+    RETURNING ` + personSelect + `, valid_from
+  ), history AS (
+    INSERT INTO people_history (` + personSelect + `, sys_period)
+    SELECT ` + oldPersonSelect + `, tstzrange(old.valid_from, now()) FROM old
+  ), audit AS (
+    INSERT INTO person_audit (person_id, action, actor, request_id, before)
+    SELECT old.id, 'purge', $2, $3, to_jsonb(old) - 'valid_from' FROM old
+  ), outbox AS (
+    INSERT INTO people_outbox (person_id, action, person)
+    SELECT old.id, 'purge', NULL FROM old
+  )
+  SELECT count(*) FROM old
+  `
+
+	// asOfPeopleSQL selects every person as they stood at $1, with $2
+	// including the ones that were soft deleted at the time.
+	asOfPeopleSQL = `
+  SELECT ` + personSelect + `
+  FROM (
+    SELECT ` + personSelect + `
+    FROM people
+    WHERE valid_from <= $1
+    UNION ALL
+    SELECT ` + personSelect + `
+    FROM people_history
+    WHERE sys_period @> $1::timestamptz
+  ) p
+  WHERE ($2 OR deleted_at IS NULL)
+  `
+)
+
+const (
+	oldPersonSelect = `old.id, old.firstname, old.lastname, old.age, old.version, old.deleted_at, old.email, old.phone, old.date_of_birth, old.attributes`
+	newPersonSelect = `people.id, people.firstname, people.lastname, people.age, people.version, people.deleted_at, people.email, people.phone, people.date_of_birth, people.attributes`
+)
+
+func (ps PostgresStore) peopleForIDs(ctx context.Context, ids []int) ([]Person, error) {
 	q := `
-  INSERT INTO people (lastname, firstname, age)
-  VALUES ($1, $2, $3)
-  RETURNING id
+  SELECT ` + personSelect + `
+  FROM people
+  WHERE id = ANY ($1) AND deleted_at IS NULL
+  `
+	rows, err := ps.pool.Query(ctx, q, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var people []Person
+	for rows.Next() {
+		p, err := scanPerson(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		people = append(people, p)
+	}
+
+	return people, rows.Err()
+}
+
+// searchPeople matches the prefix tsquery against search_vector and the
+// query's trigrams against the names, using the indexes on both. The score
+// is the one scorePerson computes for MemoryStore.
+func (ps PostgresStore) searchPeople(ctx context.Context, q string, limit int) ([]searchResult, error) {
+	query := `
+  SELECT ` + personSelect + `, score
+  FROM people,
+    to_tsquery('simple', $2) AS tsq,
+    LATERAL (
+      SELECT (search_vector @@ tsq)::int + greatest(
+        similarity(firstname, $1),
+        similarity(lastname, $1),
+        similarity(firstname || ' ' || lastname, $1)
+      ) AS score
+    ) s
+  WHERE deleted_at IS NULL
+    AND (search_vector @@ tsq OR firstname % $1 OR lastname % $1 OR (firstname || ' ' || lastname) % $1)
+  ORDER BY score DESC, id
+  LIMIT $3
   `
-	var id int
-	row := ps.pool.QueryRow(ctx, q, p.FirstName, p.LastName, p.Age)
-	if err := row.Scan(&id); err != nil {
+	rows, err := ps.pool.Query(ctx, query, q, prefixTSQuery(searchTerms(q)), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []searchResult
+	for rows.Next() {
+		var res searchResult
+		res.Person, err = scanPerson(rows, &res.Score)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, res)
+	}
+
+	return results, rows.Err()
+}
+
+func (ps PostgresStore) addPerson(ctx context.Context, p Person) (Person, error) {
+	a := auditInfoFromContext(ctx)
+	attrs, err := ps.checkAttributes(ctx, p.Attributes)
+	if err != nil {
 		return p, err
 	}
 
+	p.Attributes = attrs
+	p.deriveAge(time.Now())
+	var id, version int
+	row := ps.pool.QueryRow(ctx, insertPersonSQL, append(personArgs(p), a.Actor, a.RequestID)...)
+	if err := row.Scan(&id, &version); err != nil {
+		return p, emailError(err, p.Email)
+	}
+
 	p.ID = id
+	p.Version = version
 	return p, nil
 }
 
-func (ps PostgresStore) deletePerson(ctx context.Context, id int) error {
-	q := `
-  DELETE FROM people
-  WHERE id = $1
-  `
-	_, err := ps.pool.Exec(ctx, q, id)
+func (ps PostgresStore) deletePerson(ctx context.Context, id int, version int) error {
+	a := auditInfoFromContext(ctx)
+	var deleted int
+	row := ps.pool.QueryRow(ctx, deletePersonSQL, id, version, a.Actor, a.RequestID)
+	if err := row.Scan(&deleted); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return versionError(ctx, ps.pool, id)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (ps PostgresStore) updatePerson(ctx context.Context, id int, p Person, version int) (Person, error) {
+	a := auditInfoFromContext(ctx)
+	attrs, err := ps.checkAttributes(ctx, p.Attributes)
+	if err != nil {
+		return p, err
+	}
+
+	p.Attributes = attrs
+	p.deriveAge(time.Now())
+	row := ps.pool.QueryRow(ctx, updatePersonSQL, append(personArgs(p), id, version, a.Actor, a.RequestID)...)
+	up, err := scanPerson(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return p, versionError(ctx, ps.pool, id)
+		}
+		return p, emailError(err, p.Email)
+	}
+
+	return up, nil
+}
+
+// applyBatch runs every operation in one transaction, in order, each in a
+// savepoint of its own so that a failing operation is reported in its result
+// without undoing the rest. The creates that come before any update or
+// delete are inserted with one statement by insertPeople, falling back to
+// one at a time when a row breaks a constraint.
+func (ps PostgresStore) applyBatch(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error) {
+	tx, err := ps.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	schemas, err := ps.attributeSchemas(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The checked attributes replace the given ones, in a copy of ops.
+	ops = append([]batchOperation(nil), ops...)
+	a := auditInfoFromContext(ctx)
+	results := make([]batchResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		results[i] = batchResult{Index: i, Op: op.Op}
+		if op.Op == batchDelete {
+			continue
+		}
+
+		attrs, err := checkAttributes(op.Person.Attributes, schemas)
+		if err != nil {
+			results[i].Err = err
+			failed = true
+			continue
+		}
+		ops[i].Person.Attributes = attrs
+	}
+
+	if atomic && failed {
+		return results, nil
+	}
+
+	var leading []int
+	for i, op := range ops {
+		if op.Op != batchCreate {
+			break
+		}
+		if results[i].Err == nil {
+			leading = append(leading, i)
+		}
+	}
+
+	if len(leading) > 1 {
+		if err := insertPeople(ctx, tx, ops, leading, results, a); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, op := range ops {
+		// Only the creates insertPeople made have a person yet.
+		if results[i].Err != nil || results[i].Person != nil {
+			continue
+		}
+
+		p, err := applyBatchOperation(ctx, tx, op, a)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			results[i].Err = err
+			failed = true
+			continue
+		}
+
+		if op.Op != batchDelete {
+			results[i].Person = &p
+		}
+	}
+
+	if atomic && failed {
+		return results, nil
+	}
+
+	return results, tx.Commit(ctx)
+}
+
+// applyBatchOperation runs op in a savepoint, which is rolled back when op
+// fails so that the transaction can carry on.
+func applyBatchOperation(ctx context.Context, tx pgx.Tx, op batchOperation, a auditInfo) (Person, error) {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return Person{}, err
+	}
+	defer sp.Rollback(ctx)
+
+	p := op.Person
+	p.deriveAge(time.Now())
+	switch op.Op {
+	case batchCreate:
+		row := sp.QueryRow(ctx, insertPersonSQL, append(personArgs(p), a.Actor, a.RequestID)...)
+		if err := row.Scan(&p.ID, &p.Version); err != nil {
+			return p, emailError(err, p.Email)
+		}
+	case batchUpdate:
+		row := sp.QueryRow(ctx, updatePersonSQL, append(personArgs(p), op.ID, op.Version, a.Actor, a.RequestID)...)
+		if p, err = scanPerson(row); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return p, versionError(ctx, sp, op.ID)
+			}
+			return p, emailError(err, op.Person.Email)
+		}
+	case batchDelete:
+		var deleted int
+		row := sp.QueryRow(ctx, deletePersonSQL, op.ID, op.Version, a.Actor, a.RequestID)
+		if err := row.Scan(&deleted); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return p, versionError(ctx, sp, op.ID)
+			}
+			return p, err
+		}
+	}
+
+	return p, sp.Commit(ctx)
+}
+
+// insertPeople inserts the create operations at idx with insertPeopleSQL
+// in a savepoint. The ids are drawn from the people sequence first so each
+// result can report its row. When a row breaks a constraint, such as a
+// taken email, the savepoint is rolled back and the results are left
+// without a person, for the creates to be tried one at a time so that only
+// that row fails.
+func insertPeople(ctx context.Context, tx pgx.Tx, ops []batchOperation, idx []int, results []batchResult, a auditInfo) error {
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer sp.Rollback(ctx)
+
+	q := `SELECT nextval(pg_get_serial_sequence('people', 'id')) FROM generate_series(1, $1)`
+	rows, err := sp.Query(ctx, q, len(idx))
+	if err != nil {
+		return err
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return err
+	}
+
+	people := make([]Person, len(idx))
+	firstnames := make([]string, len(idx))
+	lastnames := make([]string, len(idx))
+	ages := make([]int, len(idx))
+	emails := make([]*string, len(idx))
+	phones := make([]*string, len(idx))
+	dobs := make([]*string, len(idx))
+	attrs := make([]string, len(idx))
+	for n, i := range idx {
+		p := ops[i].Person
+		p.ID = ids[n]
+		p.Version = 1
+		p.deriveAge(time.Now())
+		people[n] = p
+
+		b, err := json.Marshal(p.Attributes)
+		if err != nil {
+			return err
+		}
+		if p.Attributes == nil {
+			b = []byte("{}")
+		}
+		firstnames[n], lastnames[n], ages[n], attrs[n] = p.FirstName, p.LastName, p.Age, string(b)
+		emails[n], phones[n], dobs[n] = nullString(p.Email), nullString(p.Phone), nullString(p.DateOfBirth)
+	}
+
+	_, err = sp.Exec(ctx, insertPeopleSQL, ids, firstnames, lastnames, ages, emails, phones, dobs, attrs, a.Actor, a.RequestID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "23") {
+		return sp.Rollback(ctx)
+	}
 	if err != nil {
 		return err
 	}
 
+	if err := sp.Commit(ctx); err != nil {
+		return err
+	}
+
+	for n, i := range idx {
+		results[i].Person = &people[n]
+	}
+
 	return nil
 }
 
-func (ps PostgresStore) updatePerson(ctx context.Context, id int, p Person) (Person, error) {
-	fmt.Printf("%+v\n", p)
+func (ps PostgresStore) restorePerson(ctx context.Context, id int) (Person, error) {
+	a := auditInfoFromContext(ctx)
+	p, err := scanPerson(ps.pool.QueryRow(ctx, restorePersonSQL, id, a.Actor, a.RequestID))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return p, err
+		}
+
+		var exists bool
+		q := `SELECT EXISTS (SELECT 1 FROM people WHERE id = $1)`
+		if err := ps.pool.QueryRow(ctx, q, id).Scan(&exists); err != nil {
+			return p, err
+		}
+
+		if exists {
+			return p, fmt.Errorf("%w: %d", errPersonNotDeleted, id)
+		}
+		return p, fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+	}
+
+	return p, nil
+}
+
+func (ps PostgresStore) purgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	a := auditInfoFromContext(ctx)
+	var n int
+	if err := ps.pool.QueryRow(ctx, purgeSQL, before, a.Actor, a.RequestID).Scan(&n); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (ps PostgresStore) personHistory(ctx context.Context, id int) ([]auditEvent, error) {
 	q := `
-  UPDATE people
-  SET firstname=$1, lastname=$2, age=$3
-  WHERE id = $4
-  RETURNING id, firstname, lastname, age
+  SELECT id, person_id, action, actor, request_id, created_at, before, after
+  FROM person_audit
+  WHERE person_id = $1
+  ORDER BY id
   `
-	row := ps.pool.QueryRow(ctx, q, p.FirstName, p.LastName, p.Age, id)
-	var up Person
-	if err := row.Scan(&up.ID, &up.LastName, &up.FirstName, &up.Age); err != nil {
-		return p, err
+	rows, err := ps.pool.Query(ctx, q, id)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return up, nil
+	var events []auditEvent
+	for rows.Next() {
+		var e auditEvent
+		if err := rows.Scan(&e.ID, &e.PersonID, &e.Action, &e.Actor, &e.RequestID, &e.Timestamp, &e.Before, &e.After); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// versionError explains why a conditional write matched no rows: either the
+// person is gone or its version moved on.
+func versionError(ctx context.Context, db queryRower, id int) error {
+	var exists bool
+	q := `SELECT EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)`
+	if err := db.QueryRow(ctx, q, id).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+	}
+
+	return errVersionMismatch
+}
+
+// changesSince only returns events from transactions older than every
+// transaction still in progress. Events are numbered when they are written,
+// not when they commit, so without that a consumer could move past an event
+// that was still to commit. The catch is that the snapshot's xmin is
+// cluster wide: while any transaction stays open, in this database or
+// another, no later event is returned, so the change feed, the broker and
+// with them the event streams stall until it ends. Long running transactions
+// should be kept off the cluster, or bounded with
+// idle_in_transaction_session_timeout and transaction_timeout.
+func (ps PostgresStore) changesSince(ctx context.Context, after changeCursor, limit int) ([]changeEvent, error) {
+	q := `
+  SELECT txid::text, id, person_id, action, person, created_at
+  FROM people_outbox
+  WHERE (txid, id) > ($1::text::xid8, $2)
+    AND txid < pg_snapshot_xmin(pg_current_snapshot())
+  ORDER BY txid, id
+  LIMIT $3
+  `
+	rows, err := ps.pool.Query(ctx, q, strconv.FormatUint(after.Tx, 10), after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []changeEvent
+	for rows.Next() {
+		var e changeEvent
+		var tx string
+		if err := rows.Scan(&tx, &e.Cursor.ID, &e.PersonID, &e.Action, &e.Person, &e.Timestamp); err != nil {
+			return nil, err
+		}
+
+		if e.Cursor.Tx, err = strconv.ParseUint(tx, 10, 64); err != nil {
+			return nil, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (ps PostgresStore) latestChangeCursor(ctx context.Context) (changeCursor, error) {
+	q := `
+  SELECT txid::text, id
+  FROM people_outbox
+  WHERE txid < pg_snapshot_xmin(pg_current_snapshot())
+  ORDER BY txid DESC, id DESC
+  LIMIT 1
+  `
+	var c changeCursor
+	var tx string
+	err := ps.pool.QueryRow(ctx, q).Scan(&tx, &c.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	c.Tx, err = strconv.ParseUint(tx, 10, 64)
+	return c, err
+}
+
+func (ps PostgresStore) pruneChanges(ctx context.Context, before time.Time) (int, error) {
+	q := `
+  DELETE FROM people_outbox
+  WHERE created_at < $1
+  `
+	tag, err := ps.pool.Exec(ctx, q, before)
+	return int(tag.RowsAffected()), err
+}
+
+const attributeSchemaSelect = "key, schema, updated_at"
+
+func scanAttributeSchema(row pgx.Row) (attributeSchema, error) {
+	var s attributeSchema
+	err := row.Scan(&s.Key, &s.Schema, &s.UpdatedAt)
+	return s, err
+}
+
+func (ps PostgresStore) attributeSchemas(ctx context.Context) ([]attributeSchema, error) {
+	rows, err := ps.pool.Query(ctx, "SELECT "+attributeSchemaSelect+" FROM attribute_schemas ORDER BY key")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schemas []attributeSchema
+	for rows.Next() {
+		s, err := scanAttributeSchema(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		schemas = append(schemas, s)
+	}
+
+	return schemas, rows.Err()
+}
+
+func (ps PostgresStore) attributeSchemaForKey(ctx context.Context, key string) (*attributeSchema, error) {
+	q := "SELECT " + attributeSchemaSelect + " FROM attribute_schemas WHERE key = $1"
+	s, err := scanAttributeSchema(ps.pool.QueryRow(ctx, q, key))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w for key: %s", errAttributeSchemaNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func (ps PostgresStore) putAttributeSchema(ctx context.Context, s attributeSchema) (attributeSchema, error) {
+	q := `
+  INSERT INTO attribute_schemas (key, schema)
+  VALUES ($1, $2)
+  ON CONFLICT (tenant_id, key) DO UPDATE SET schema = excluded.schema, updated_at = now()
+  RETURNING ` + attributeSchemaSelect
+	return scanAttributeSchema(ps.pool.QueryRow(ctx, q, s.Key, s.Schema))
+}
+
+func (ps PostgresStore) deleteAttributeSchema(ctx context.Context, key string) error {
+	tag, err := ps.pool.Exec(ctx, "DELETE FROM attribute_schemas WHERE key = $1", key)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w for key: %s", errAttributeSchemaNotFound, key)
+	}
+
+	return nil
+}
+
+const addressSelect = "id, person_id, label, line1, line2, city, region, postal_code, country"
+
+func scanAddress(row pgx.Row) (address, error) {
+	var a address
+	err := row.Scan(&a.ID, &a.PersonID, &a.Label, &a.Line1, &a.Line2, &a.City, &a.Region, &a.PostalCode, &a.Country)
+	return a, err
+}
+
+// addressError explains why an address statement found no row: either the
+// person isn't current or they have no such address.
+func (ps PostgresStore) addressError(ctx context.Context, personID int, id int) error {
+	var exists bool
+	q := `SELECT EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)`
+	if err := ps.pool.QueryRow(ctx, q, personID).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("%w for ID: %d", errPersonNotFound, personID)
+	}
+	return fmt.Errorf("%w for ID: %d", errAddressNotFound, id)
+}
+
+func (ps PostgresStore) personAddresses(ctx context.Context, personID int) ([]address, error) {
+	q := `
+  SELECT ` + addressSelect + `
+  FROM addresses
+  WHERE person_id = $1
+  ORDER BY id
+  `
+	rows, err := ps.pool.Query(ctx, q, personID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []address
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(addresses) == 0 {
+		if err := ps.addressError(ctx, personID, 0); errors.Is(err, errPersonNotFound) {
+			return nil, err
+		}
+	}
+
+	return addresses, nil
+}
+
+func (ps PostgresStore) addressForID(ctx context.Context, personID int, id int) (*address, error) {
+	q := `
+  SELECT ` + addressSelect + `
+  FROM addresses
+  WHERE id = $2 AND person_id = $1
+    AND EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)
+  `
+	a, err := scanAddress(ps.pool.QueryRow(ctx, q, personID, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ps.addressError(ctx, personID, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (ps PostgresStore) addAddress(ctx context.Context, personID int, a address) (address, error) {
+	q := `
+  INSERT INTO addresses (person_id, label, line1, line2, city, region, postal_code, country)
+  SELECT id, $2, $3, $4, $5, $6, $7, $8
+  FROM people
+  WHERE id = $1 AND deleted_at IS NULL
+  RETURNING ` + addressSelect
+	na, err := scanAddress(ps.pool.QueryRow(ctx, q, personID, a.Label, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return a, fmt.Errorf("%w for ID: %d", errPersonNotFound, personID)
+	}
+
+	return na, err
+}
+
+func (ps PostgresStore) updateAddress(ctx context.Context, personID int, id int, a address) (address, error) {
+	q := `
+  UPDATE addresses
+  SET label = $3, line1 = $4, line2 = $5, city = $6, region = $7, postal_code = $8, country = $9
+  WHERE id = $2 AND person_id = $1
+    AND EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)
+  RETURNING ` + addressSelect
+	ua, err := scanAddress(ps.pool.QueryRow(ctx, q, personID, id, a.Label, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return a, ps.addressError(ctx, personID, id)
+	}
+
+	return ua, err
+}
+
+func (ps PostgresStore) deleteAddress(ctx context.Context, personID int, id int) error {
+	q := `
+  DELETE FROM addresses
+  WHERE id = $2 AND person_id = $1
+    AND EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)
+  `
+	tag, err := ps.pool.Exec(ctx, q, personID, id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ps.addressError(ctx, personID, id)
+	}
+
+	return nil
+}
+
+const relationshipSelect = "id, person_id, related_id, type, created_at"
+
+func scanRelationship(row pgx.Row) (relationship, error) {
+	var rel relationship
+	err := row.Scan(&rel.ID, &rel.PersonID, &rel.RelatedID, &rel.Type, &rel.CreatedAt)
+	return rel, err
+}
+
+// currentPersonError fails with errPersonNotFound unless the person with id
+// exists and is not deleted.
+func currentPersonError(ctx context.Context, db queryRower, id int) error {
+	var exists bool
+	q := `SELECT EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)`
+	if err := db.QueryRow(ctx, q, id).Scan(&exists); err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("%w for ID: %d", errPersonNotFound, id)
+	}
+	return nil
+}
+
+func (ps PostgresStore) personRelationships(ctx context.Context, personID int, typ string) ([]relationship, error) {
+	if err := currentPersonError(ctx, ps.pool, personID); err != nil {
+		return nil, err
+	}
+
+	q := `
+  SELECT ` + relationshipSelect + `
+  FROM relationships r
+  WHERE (person_id = $1 OR related_id = $1)
+    AND ($2 = '' OR type = $2)
+    AND EXISTS (
+      SELECT 1 FROM people
+      WHERE id = CASE WHEN r.person_id = $1 THEN r.related_id ELSE r.person_id END
+        AND deleted_at IS NULL
+    )
+  ORDER BY id
+  `
+	rows, err := ps.pool.Query(ctx, q, personID, typ)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relationships []relationship
+	for rows.Next() {
+		rel, err := scanRelationship(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		relationships = append(relationships, rel)
+	}
+
+	return relationships, rows.Err()
+}
+
+// addRelationship takes a transaction lock for the tenant so that two
+// relationships added at once can't make a cycle between them. The unique
+// indexes on the table back up relationshipConflict.
+func (ps PostgresStore) addRelationship(ctx context.Context, rel relationship) (relationship, error) {
+	tx, err := ps.pool.Begin(ctx)
+	if err != nil {
+		return rel, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('relationships'), hashtext(current_tenant()))`); err != nil {
+		return rel, err
+	}
+	for _, id := range []int{rel.PersonID, rel.RelatedID} {
+		if err := currentPersonError(ctx, tx, id); err != nil {
+			return rel, err
+		}
+	}
+
+	q := `
+  SELECT ` + relationshipSelect + `
+  FROM relationships
+  WHERE type = $3 AND person_id IN ($1, $2)
+  `
+	rows, err := tx.Query(ctx, q, rel.PersonID, rel.RelatedID, rel.Type)
+	if err != nil {
+		return rel, err
+	}
+	existing, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (relationship, error) {
+		return scanRelationship(row)
+	})
+	if err != nil {
+		return rel, err
+	}
+	if err := relationshipConflict(rel, existing); err != nil {
+		return rel, err
+	}
+
+	if relationshipTypes[rel.Type].hierarchical {
+		q := `
+    WITH RECURSIVE above (id) AS (
+      SELECT $2::int
+      UNION
+      SELECT r.related_id
+      FROM relationships r
+      JOIN above ON r.person_id = above.id
+      WHERE r.type = $3
+    )
+    SELECT EXISTS (SELECT 1 FROM above WHERE id = $1)
+    `
+		var cycle bool
+		if err := tx.QueryRow(ctx, q, rel.PersonID, rel.RelatedID, rel.Type).Scan(&cycle); err != nil {
+			return rel, err
+		}
+		if cycle {
+			return rel, fmt.Errorf("%w: %d is under %d", errRelationshipCycle, rel.RelatedID, rel.PersonID)
+		}
+	}
+
+	q = `
+  INSERT INTO relationships (person_id, related_id, type)
+  VALUES ($1, $2, $3)
+  RETURNING ` + relationshipSelect
+	created, err := scanRelationship(tx.QueryRow(ctx, q, rel.PersonID, rel.RelatedID, rel.Type))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return rel, fmt.Errorf("%w: %s", errRelationshipExists, pgErr.ConstraintName)
+		}
+		return rel, err
+	}
+
+	return created, tx.Commit(ctx)
+}
+
+func (ps PostgresStore) deleteRelationship(ctx context.Context, personID int, id int) error {
+	q := `
+  DELETE FROM relationships
+  WHERE id = $2 AND (person_id = $1 OR related_id = $1)
+    AND EXISTS (SELECT 1 FROM people WHERE id = $1 AND deleted_at IS NULL)
+  `
+	tag, err := ps.pool.Exec(ctx, q, personID, id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		if err := currentPersonError(ctx, ps.pool, personID); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w for ID: %d", errRelationshipNotFound, id)
+	}
+
+	return nil
+}
+
+// reportsUnder follows the manager relationships down with a recursive CTE.
+// Deleted people stop the walk, and the path guards against a cycle that got
+// in some other way than addRelationship.
+func (ps PostgresStore) reportsUnder(ctx context.Context, managerID int) ([]report, error) {
+	if err := currentPersonError(ctx, ps.pool, managerID); err != nil {
+		return nil, err
+	}
+
+	q := `
+  WITH RECURSIVE reports (id, manager_id, depth, path) AS (
+    SELECT r.person_id, r.related_id, 1, ARRAY[r.related_id, r.person_id]
+    FROM relationships r
+    JOIN people p ON p.id = r.person_id AND p.deleted_at IS NULL
+    WHERE r.type = $2 AND r.related_id = $1
+    UNION ALL
+    SELECT r.person_id, r.related_id, reports.depth + 1, reports.path || r.person_id
+    FROM relationships r
+    JOIN reports ON r.related_id = reports.id
+    JOIN people p ON p.id = r.person_id AND p.deleted_at IS NULL
+    WHERE r.type = $2 AND r.person_id <> ALL (reports.path)
+  )
+  SELECT ` + personSelect + `, reports.manager_id, reports.depth
+  FROM reports
+  JOIN people USING (id)
+  ORDER BY reports.depth, id
+  `
+	rows, err := ps.pool.Query(ctx, q, managerID, relationshipManager)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []report
+	for rows.Next() {
+		var r report
+		p, err := scanPerson(rows, &r.ManagerID, &r.Depth)
+		if err != nil {
+			return nil, err
+		}
+
+		r.Person = p
+		reports = append(reports, r)
+	}
+
+	return reports, rows.Err()
+}
+
+const webhookSelect = "id, url, secret, events, active, created_at"
+
+func scanWebhook(row pgx.Row) (webhook, error) {
+	var wh webhook
+	err := row.Scan(&wh.ID, &wh.URL, &wh.Secret, &wh.Events, &wh.Active, &wh.CreatedAt)
+	return wh, err
+}
+
+func (ps PostgresStore) addWebhook(ctx context.Context, wh webhook) (webhook, error) {
+	q := `
+  INSERT INTO webhooks (url, secret, events, active)
+  VALUES ($1, $2, $3, $4)
+  RETURNING ` + webhookSelect
+	return scanWebhook(ps.pool.QueryRow(ctx, q, wh.URL, wh.Secret, wh.Events, wh.Active))
+}
+
+func (ps PostgresStore) allWebhooks(ctx context.Context) ([]webhook, error) {
+	rows, err := ps.pool.Query(ctx, "SELECT "+webhookSelect+" FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []webhook
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		webhooks = append(webhooks, wh)
+	}
+
+	return webhooks, rows.Err()
+}
+
+func (ps PostgresStore) webhookForID(ctx context.Context, id int) (*webhook, error) {
+	wh, err := scanWebhook(ps.pool.QueryRow(ctx, "SELECT "+webhookSelect+" FROM webhooks WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w for ID: %d", errWebhookNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &wh, nil
+}
+
+func (ps PostgresStore) updateWebhook(ctx context.Context, id int, wh webhook) (webhook, error) {
+	q := `
+  UPDATE webhooks
+  SET url = $2, secret = coalesce(nullif($3, ''), secret), events = $4, active = $5
+  WHERE id = $1
+  RETURNING ` + webhookSelect
+	uwh, err := scanWebhook(ps.pool.QueryRow(ctx, q, id, wh.URL, wh.Secret, wh.Events, wh.Active))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return wh, fmt.Errorf("%w for ID: %d", errWebhookNotFound, id)
+	}
+
+	return uwh, err
+}
+
+func (ps PostgresStore) deleteWebhook(ctx context.Context, id int) error {
+	tag, err := ps.pool.Exec(ctx, "DELETE FROM webhooks WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w for ID: %d", errWebhookNotFound, id)
+	}
+
+	return nil
+}
+
+const webhookDeliverySelect = `d.id, d.webhook_id, d.event_id, d.event, d.person_id, d.person, d.status,
+  d.attempts, d.next_attempt_at, d.last_status, d.last_error, d.created_at, d.delivered_at`
+
+func scanWebhookDelivery(row pgx.Row, extra ...any) (webhookDelivery, error) {
+	var d webhookDelivery
+	dest := []any{&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.PersonID, &d.Person, &d.Status,
+		&d.Attempts, &d.NextAttemptAt, &d.LastStatus, &d.LastError, &d.CreatedAt, &d.DeliveredAt}
+	err := row.Scan(append(dest, extra...)...)
+	return d, err
+}
+
+func (ps PostgresStore) webhookDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]webhookDelivery, error) {
+	q := `
+  SELECT ` + webhookDeliverySelect + `
+  FROM webhook_deliveries d
+  WHERE ($1 = 0 OR d.webhook_id = $1) AND ($2 = '' OR d.status = $2)
+  ORDER BY d.id DESC
+  LIMIT $3
+  `
+	rows, err := ps.pool.Query(ctx, q, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// claimWebhookDeliveries skips rows another dispatcher has locked rather than
+// waiting on them.
+func (ps PostgresStore) claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error) {
+	q := `
+  WITH due AS (
+    SELECT d.id
+    FROM webhook_deliveries d
+    JOIN webhooks w ON w.id = d.webhook_id
+    WHERE d.status = 'pending' AND d.next_attempt_at <= now() AND w.active
+    ORDER BY d.next_attempt_at
+    LIMIT $1
+    FOR UPDATE OF d SKIP LOCKED
+  )
+  UPDATE webhook_deliveries d
+  SET next_attempt_at = now() + $2::interval
+  FROM due, webhooks w
+  WHERE d.id = due.id AND w.id = d.webhook_id
+  RETURNING ` + webhookDeliverySelect + `, w.url, w.secret
+  `
+	rows, err := ps.pool.Query(ctx, q, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		var url, secret string
+		d, err := scanWebhookDelivery(rows, &url, &secret)
+		if err != nil {
+			return nil, err
+		}
+
+		d.URL = url
+		d.Secret = secret
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func (ps PostgresStore) recordWebhookAttempt(ctx context.Context, d webhookDelivery) error {
+	q := `
+  UPDATE webhook_deliveries
+  SET status = $2, attempts = $3, next_attempt_at = $4, last_status = $5, last_error = $6, delivered_at = $7
+  WHERE id = $1
+  `
+	_, err := ps.pool.Exec(ctx, q, d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatus, d.LastError, d.DeliveredAt)
+	return err
+}
+
+func (ps PostgresStore) reserveIdempotencyKey(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	q := `
+  INSERT INTO idempotency_keys (key, fingerprint, expires_at)
+  VALUES ($1, $2, $3)
+  ON CONFLICT (tenant_id, key) DO UPDATE
+  SET fingerprint = EXCLUDED.fingerprint, expires_at = EXCLUDED.expires_at,
+      status = 0, header = NULL, body = NULL
+  WHERE idempotency_keys.expires_at <= now()
+  `
+	tag, err := ps.pool.Exec(ctx, q, rec.Key, rec.Fingerprint, rec.ExpiresAt)
+	if err != nil {
+		return rec, false, err
+	}
+
+	if tag.RowsAffected() == 1 {
+		return rec, true, nil
+	}
+
+	q = `
+  SELECT key, fingerprint, status, header, body, expires_at
+  FROM idempotency_keys
+  WHERE key = $1
+  `
+	var existing idempotencyRecord
+	var header []byte
+	row := ps.pool.QueryRow(ctx, q, rec.Key)
+	if err := row.Scan(&existing.Key, &existing.Fingerprint, &existing.Status, &header, &existing.Body, &existing.ExpiresAt); err != nil {
+		return rec, false, err
+	}
+
+	if header != nil {
+		if err := json.Unmarshal(header, &existing.Header); err != nil {
+			return rec, false, err
+		}
+	}
+
+	return existing, false, nil
+}
+
+func (ps PostgresStore) completeIdempotencyKey(ctx context.Context, rec idempotencyRecord) error {
+	header, err := json.Marshal(rec.Header)
+	if err != nil {
+		return err
+	}
+
+	q := `
+  UPDATE idempotency_keys
+  SET status = $2, header = $3, body = $4, expires_at = $5
+  WHERE key = $1
+  `
+	_, err = ps.pool.Exec(ctx, q, rec.Key, rec.Status, header, rec.Body, rec.ExpiresAt)
+	return err
+}
+
+func (ps PostgresStore) releaseIdempotencyKey(ctx context.Context, key string) error {
+	q := `
+  DELETE FROM idempotency_keys
+  WHERE key = $1
+  `
+	_, err := ps.pool.Exec(ctx, q, key)
+	return err
+}
+
+func (ps PostgresStore) deleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	q := `
+  DELETE FROM idempotency_keys
+  WHERE expires_at <= now()
+  `
+	tag, err := ps.pool.Exec(ctx, q)
+	return int(tag.RowsAffected()), err
+}
+
+// tenantIDs reads the tenants table, which triggers on people and webhooks
+// keep up to date and which has no row-level security.
+func (ps PostgresStore) tenantIDs(ctx context.Context) ([]string, error) {
+	rows, err := ps.pool.Query(ctx, `SELECT id FROM tenants ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPostgresStore connects to the database at DATABASE_URL, which must
+// have postgres.sql applied, and returns a context for a tenant of the
+// test's own, so tests never see each other's rows. Without DATABASE_URL the
+// test is skipped.
+func newTestPostgresStore(t *testing.T) (*PostgresStore, context.Context) {
+	t.Helper()
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	ps := NewPostgresStore(url)
+	t.Cleanup(ps.startDatabase())
+
+	return &ps, withTenant(context.Background(), "test-"+newRequestID())
+}
+
+func Test_PostgresStoreApplyBatchOrder(t *testing.T) {
+	ps, ctx := newTestPostgresStore(t)
+
+	p, err := ps.addPerson(ctx, Person{FirstName: "Foo", LastName: "Bar", Email: "foo@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The create only fits after the update has freed the email.
+	results, err := ps.applyBatch(ctx, []batchOperation{
+		{Op: batchCreate, Person: Person{FirstName: "New", LastName: "Comer"}},
+		{Op: batchUpdate, ID: p.ID, Person: Person{FirstName: "Foo", LastName: "Bar", Email: "bar@example.com"}},
+		{Op: batchCreate, Person: Person{FirstName: "Baz", LastName: "Qux", Email: "foo@example.com"}},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("got error %v for operation %d but expected none", res.Err, res.Index)
+		}
+	}
+
+	// Best effort reports the clash in its own result and keeps the rest.
+	results, err = ps.applyBatch(ctx, []batchOperation{
+		{Op: batchCreate, Person: Person{FirstName: "One", LastName: "More", Email: "ONE@example.com"}},
+		{Op: batchCreate, Person: Person{FirstName: "Dup", LastName: "Licate", Email: "bar@example.com"}},
+		{Op: batchCreate, Person: Person{FirstName: "Two", LastName: "More"}},
+		{Op: batchDelete, ID: p.ID, Version: 99},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, exp := range []error{nil, errEmailTaken, nil, errVersionMismatch} {
+		if !errors.Is(results[i].Err, exp) {
+			t.Errorf("got error %v for operation %d but expected %v", results[i].Err, i, exp)
+		}
+	}
+	if results[0].Person == nil || results[2].Person == nil || results[1].Person != nil {
+		t.Errorf("got results %+v but expected people for only the first and third", results)
+	}
+}
+
+func Test_PostgresStoreNotifiesOncePerTransaction(t *testing.T) {
+	ps, ctx := newTestPostgresStore(t)
+
+	conn, err := ps.pool.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "LISTEN "+peopleChannel); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := []batchOperation{{Op: batchCreate, Person: Person{FirstName: "Foo", LastName: "Bar"}}}
+	for i := 0; i < 20; i++ {
+		ops = append(ops, batchOperation{Op: batchCreate, Person: Person{FirstName: "Foo", LastName: strconv.Itoa(i)}})
+		ops = append(ops, batchOperation{Op: batchDelete, ID: -1})
+	}
+	if _, err := ps.applyBatch(ctx, ops, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var notifications []string
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		n, err := conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if err != nil {
+			break
+		}
+		if strings.HasPrefix(n.Payload, tenantFromContext(ctx)+" ") {
+			notifications = append(notifications, n.Payload)
+		}
+	}
+
+	if len(notifications) != 1 || len(strings.Fields(notifications[0])) != 22 {
+		t.Errorf("got notifications %q but expected one naming all 21 people", notifications)
+	}
+}
+
+func Test_PostgresStorePagePeople(t *testing.T) {
+	ps, ctx := newTestPostgresStore(t)
+
+	var ids []int
+	for _, p := range []Person{
+		{FirstName: "Ann", LastName: "Young", Age: 20},
+		{FirstName: "Bea", LastName: "Old", Age: 60},
+		{FirstName: "ann", LastName: "Older", Age: 70},
+		{FirstName: "Cy", LastName: "Oldest", Age: 80},
+	} {
+		added, err := ps.addPerson(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, added.ID)
+	}
+
+	minAge := 50
+	page, err := ps.pagePeople(ctx, personFilter{MinAge: &minAge}, ids[1], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || page.Before != 1 || len(page.People) != 1 || page.People[0].ID != ids[2] {
+		t.Errorf("got page %+v but expected the third of three people over 50", page)
+	}
+
+	page, err = ps.pagePeople(ctx, personFilter{FirstName: "ANN"}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.People) != 2 || page.People[0].ID != ids[0] {
+		t.Errorf("got page %+v but expected both Anns", page)
+	}
+}
+
+func Test_PostgresStoreTenantIsolation(t *testing.T) {
+	ps, ctx := newTestPostgresStore(t)
+
+	checkStoreTenantIsolation(t, ps, ctx, withTenant(context.Background(), "test-"+newRequestID()))
+}
+
+func Test_PostgresStoreSwitchesTenants(t *testing.T) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	// With one connection, every request reuses the tenant setting of the
+	// one before, so each switch of tenant has to set it again.
+	sep := " "
+	if strings.Contains(url, "://") {
+		sep = "?"
+		if strings.Contains(url, "?") {
+			sep = "&"
+		}
+	}
+	ps := NewPostgresStore(url + sep + "pool_max_conns=1")
+	t.Cleanup(ps.startDatabase())
+
+	a := withTenant(context.Background(), "test-"+newRequestID())
+	b := withTenant(context.Background(), "test-"+newRequestID())
+	count := func(ctx context.Context) int {
+		n := 0
+		if err := ps.eachPerson(ctx, personQuery{}, func(Person) error { n++; return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := ps.addPerson(a, Person{FirstName: "Foo", LastName: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(b); n != 0 {
+			t.Fatalf("got %d people for another tenant but expected none", n)
+		}
+		if n := count(a); n != i {
+			t.Fatalf("got %d people but expected %d", n, i)
+		}
+	}
+}
+
+func Test_PostgresStoreInsertPeople(t *testing.T) {
+	ps, ctx := newTestPostgresStore(t)
+
+	insert := func(ops []batchOperation) []batchResult {
+		t.Helper()
+		tx, err := ps.pool.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback(ctx)
+
+		idx := make([]int, len(ops))
+		results := make([]batchResult, len(ops))
+		for i := range ops {
+			idx[i] = i
+		}
+		if err := insertPeople(ctx, tx, ops, idx, results, auditInfo{Actor: "importer", RequestID: "req-1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	// The creates are made in one go, under row-level security.
+	results := insert([]batchOperation{
+		{Op: batchCreate, Person: Person{FirstName: "Ann", LastName: "One", Email: "ann@example.com", DateOfBirth: "1990-04-30"}},
+		{Op: batchCreate, Person: Person{FirstName: "Bea", LastName: "Two", Phone: "+14155550123"}},
+		{Op: batchCreate, Person: Person{FirstName: "Cy", LastName: "Three", Attributes: attributes{"team": "eng"}}},
+	})
+	for i, res := range results {
+		if res.Person == nil {
+			t.Fatalf("got no person for create %d but expected all three inserted together", i)
+		}
+		p, err := ps.personForID(ctx, res.Person.ID, personQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.FirstName != res.Person.FirstName || p.Email != res.Person.Email || p.DateOfBirth != res.Person.DateOfBirth || len(p.Attributes) != len(res.Person.Attributes) {
+			t.Errorf("got %+v but expected %+v", *p, *res.Person)
+		}
+		events, err := ps.personHistory(ctx, res.Person.ID)
+		if err != nil || len(events) != 1 || events[0].Actor != "importer" {
+			t.Errorf("got history %+v and error %v but expected the create by importer", events, err)
+		}
+	}
+	changes, err := ps.changesSince(ctx, changeCursor{}, 10)
+	if err != nil || len(changes) != 3 {
+		t.Errorf("got %d changes and error %v but expected 3", len(changes), err)
+	}
+
+	// A row that breaks a constraint leaves them all to be made one at a
+	// time.
+	results = insert([]batchOperation{
+		{Op: batchCreate, Person: Person{FirstName: "Dee", LastName: "Four"}},
+		{Op: batchCreate, Person: Person{FirstName: "Ann", LastName: "Again", Email: "ANN@example.com"}},
+	})
+	for i, res := range results {
+		if res.Person != nil {
+			t.Errorf("got person %+v for create %d but expected none", *res.Person, i)
+		}
+	}
+}
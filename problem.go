@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+const problemMediaType = "application/problem+json"
+
+// problem is an RFC 9457 problem details body. Extensions are added to the
+// top level object next to the standard members.
+type problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	RequestID  string
+	Extensions map[string]any
+}
+
+func (p problem) MarshalJSON() ([]byte, error) {
+	m := map[string]any{}
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+
+	m["type"] = p.Type
+	m["title"] = p.Title
+	m["status"] = p.Status
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	if p.RequestID != "" {
+		m["request_id"] = p.RequestID
+	}
+
+	return json.Marshal(m)
+}
+
+// problemType is the type URI and title of a kind of problem. Problems with no
+// more to say than their status use about:blank and the status text.
+type problemType struct {
+	uri   string
+	title string
+}
+
+var (
+	problemValidation      = problemType{"/problems/validation-error", "The request is not valid"}
+	problemPersonNotFound  = problemType{"/problems/person-not-found", "No such person"}
+	problemPersonExists    = problemType{"/problems/person-exists", "The person ID is taken"}
+	problemVersionMismatch = problemType{"/problems/version-mismatch", "The person has changed"}
+	problemNotDeleted      = problemType{"/problems/person-not-deleted", "The person is not deleted"}
+	problemWebhookNotFound = problemType{"/problems/webhook-not-found", "No such webhook"}
+	problemEmailTaken      = problemType{"/problems/email-taken", "The email belongs to another person"}
+	problemAddressNotFound = problemType{"/problems/address-not-found", "No such address"}
+
+	problemAttributeSchemaNotFound = problemType{"/problems/attribute-schema-not-found", "No such attribute schema"}
+	problemRelationshipNotFound    = problemType{"/problems/relationship-not-found", "No such relationship"}
+	problemRelationshipExists      = problemType{"/problems/relationship-exists", "The relationship already exists"}
+	problemRelationshipCycle       = problemType{"/problems/relationship-cycle", "The relationship would make a cycle"}
+)
+
+// validationError is a request field that failed validation. Its message is
+// meant for clients, and problems built from it list the field under the
+// invalid_params extension.
+type validationError struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (e *validationError) Error() string {
+	return e.Name + " " + e.Reason
+}
+
+// newProblem returns the problem for a client error. err's message becomes
+// the detail, so it must not carry anything internal.
+func newProblem(r *http.Request, status int, err error) problem {
+	p := problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    err.Error(),
+		Instance:  r.URL.Path,
+		RequestID: requestIDFromContext(r.Context()),
+	}
+
+	var ve *validationError
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) && te.Field != "" {
+		ve = &validationError{Name: te.Field, Reason: "must be " + jsonKind(te.Type.Kind())}
+		p.Detail = ve.Error()
+	}
+	if ve != nil || errors.As(err, &ve) {
+		p.Type, p.Title = problemValidation.uri, problemValidation.title
+		p.Extensions = map[string]any{"invalid_params": []validationError{*ve}}
+	}
+
+	return p
+}
+
+// jsonKind names the JSON value a Go kind is decoded from.
+func jsonKind(k reflect.Kind) string {
+	switch k {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	default:
+		return "a " + k.String()
+	}
+}
+
+func writeProblem(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", problemMediaType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeError writes a client error. Use writeStoreError for errors that may
+// come from the database.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	writeProblem(w, newProblem(r, status, err))
+}
+
+// storeProblems maps the store's errors that clients can act on to the
+// status and problem type they get.
+var storeProblems = []struct {
+	err    error
+	status int
+	typ    problemType
+}{
+	{errPersonNotFound, http.StatusNotFound, problemPersonNotFound},
+	{errPersonExists, http.StatusBadRequest, problemPersonExists},
+	{errVersionMismatch, http.StatusPreconditionFailed, problemVersionMismatch},
+	{errPersonNotDeleted, http.StatusConflict, problemNotDeleted},
+	{errWebhookNotFound, http.StatusNotFound, problemWebhookNotFound},
+	{errEmailTaken, http.StatusConflict, problemEmailTaken},
+	{errAddressNotFound, http.StatusNotFound, problemAddressNotFound},
+	{errAttributeSchemaNotFound, http.StatusNotFound, problemAttributeSchemaNotFound},
+	{errRelationshipNotFound, http.StatusNotFound, problemRelationshipNotFound},
+	{errRelationshipExists, http.StatusConflict, problemRelationshipExists},
+	{errRelationshipCycle, http.StatusConflict, problemRelationshipCycle},
+}
+
+// writeStoreError writes the problem for an error returned by the store.
+// Errors clients can act on and validation errors are described; anything
+// else is logged and reported without its details, since it may be a
+// database error.
+func writeStoreError(actx *AppContext, w http.ResponseWriter, r *http.Request, err error) {
+	for _, sp := range storeProblems {
+		if errors.Is(err, sp.err) {
+			p := newProblem(r, sp.status, err)
+			p.Type, p.Title = sp.typ.uri, sp.typ.title
+			writeProblem(w, p)
+			return
+		}
+	}
+
+	var ve *validationError
+	if errors.As(err, &ve) {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	writeInternalError(actx, w, r, err)
+}
+
+// writeInternalError logs err and tells the client only that the request
+// failed, and whether it was because it ran out of time.
+func writeInternalError(actx *AppContext, w http.ResponseWriter, r *http.Request, err error) {
+	logInternalError(actx, r, err)
+
+	status := http.StatusInternalServerError
+	if errors.Is(err, context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	}
+
+	writeError(w, r, status, errors.New(internalErrorDetail(err)))
+}
+
+// clientErrorMessage returns the message of a store error for one item of a
+// batch or import: the error itself when clients can act on it, and
+// otherwise the same generic detail writeInternalError gives.
+func clientErrorMessage(actx *AppContext, r *http.Request, err error) string {
+	var ve *validationError
+	if errors.As(err, &ve) || errors.Is(err, errBatchAborted) {
+		return err.Error()
+	}
+	for _, sp := range storeProblems {
+		if errors.Is(err, sp.err) {
+			return err.Error()
+		}
+	}
+
+	logInternalError(actx, r, err)
+	return internalErrorDetail(err)
+}
+
+func internalErrorDetail(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "The request timed out"
+	}
+	return "The request could not be completed"
+}
+
+// logInternalError logs err with the request ID the client was given, so the
+// two can be matched up.
+func logInternalError(actx *AppContext, r *http.Request, err error) {
+	actx.logger.error(fmt.Errorf("request %s: %w", requestIDFromContext(r.Context()), err))
+}
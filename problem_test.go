@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// decodeProblem reads a problem+json body.
+func decodeProblem(t *testing.T, res *http.Response) map[string]any {
+	t.Helper()
+
+	if ct := res.Header.Get("Content-Type"); ct != problemMediaType {
+		t.Errorf("got Content-Type %q but expected %q", ct, problemMediaType)
+	}
+
+	var p map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return p
+}
+
+// recordingLogger keeps the events and errors it is given.
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+	errors []error
+}
+
+func (l *recordingLogger) info(p loggerPayload) {}
+
+func (l *recordingLogger) event(e logEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, e)
+}
+
+func (l *recordingLogger) error(e error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, e)
+}
+
+func Test_problemStoreError(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/people/99", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	p := decodeProblem(t, res)
+	exp := map[string]any{
+		"type":       problemPersonNotFound.uri,
+		"title":      problemPersonNotFound.title,
+		"status":     float64(http.StatusNotFound),
+		"detail":     "No person exists for ID: 99",
+		"instance":   "/people/99",
+		"request_id": "req-1",
+	}
+	for k, v := range exp {
+		if p[k] != v {
+			t.Errorf("got %s %v but expected %v", k, p[k], v)
+		}
+	}
+}
+
+func Test_problemInternalErrorIsLogged(t *testing.T) {
+	ss := StorerStub{
+		personForIDStub: func(ctx context.Context, id int, pq personQuery) (*Person, error) {
+			return nil, errors.New(`FATAL: password authentication failed for user "myuser"`)
+		},
+	}
+	logger := &recordingLogger{}
+	server := httptest.NewServer(NewHandler(AppContext{storer: ss, timeout: time.Second, logger: logger}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/people/1", nil)
+	req.Header.Set("X-Request-ID", "req-2")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusInternalServerError)
+	}
+
+	p := decodeProblem(t, res)
+	if detail, _ := p["detail"].(string); strings.Contains(detail, "password") {
+		t.Errorf("got detail %q which exposes the store error", detail)
+	}
+
+	if len(logger.errors) != 1 || !strings.Contains(logger.errors[0].Error(), "req-2") || !strings.Contains(logger.errors[0].Error(), "password") {
+		t.Errorf("got logged errors %v but expected the store error with the request ID", logger.errors)
+	}
+}
+
+func Test_problemInvalidParams(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/people", "application/json", strings.NewReader(`{"firstname": "Foo", "lastname": "Bar", "age": "old"}`))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	p := decodeProblem(t, res)
+	if p["type"] != problemValidation.uri || p["detail"] != "age must be an integer" {
+		t.Errorf("got problem %v but expected a validation error for age", p)
+	}
+
+	params, _ := p["invalid_params"].([]any)
+	if len(params) != 1 {
+		t.Fatalf("got invalid_params %v but expected one", p["invalid_params"])
+	}
+	if param := params[0].(map[string]any); param["name"] != "age" || param["reason"] != "must be an integer" {
+		t.Errorf("got invalid param %v but expected age", param)
+	}
+}
+
+func Test_problemBatchRolledBack(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	body := `{"operations": [{"op": "create", "person": {"id": 10, "firstname": "Foo", "lastname": "Bar"}}, {"op": "delete", "id": 99}]}`
+	res, err := http.Post(server.URL+"/people:batch", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	p := decodeProblem(t, res)
+	results, _ := p["results"].([]any)
+	if p["status"] != float64(http.StatusBadRequest) || p["applied"] != false || len(results) != 2 {
+		t.Errorf("got problem %v but expected the rolled back batch with both results", p)
+	}
+}
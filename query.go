@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// personQueryFromRequest reads the listing and lookup options from the query
+// string.
+func personQueryFromRequest(r *http.Request) (personQuery, error) {
+	var pq personQuery
+	query := r.URL.Query()
+
+	if v := query.Get("include_deleted"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return pq, fmt.Errorf("Invalid include_deleted: %q", v)
+		}
+		pq.IncludeDeleted = b
+	}
+
+	if v := query.Get("as_of"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return pq, fmt.Errorf("Invalid as_of, expected an RFC 3339 timestamp: %q", v)
+		}
+		pq.AsOf = t
+	}
+
+	for name, values := range query {
+		key, ok := strings.CutPrefix(name, "attr.")
+		if !ok {
+			continue
+		}
+		if !attributeKey.MatchString(key) {
+			return pq, fmt.Errorf("Invalid attribute filter: %q", name)
+		}
+		if pq.Attributes == nil {
+			pq.Attributes = map[string]string{}
+		}
+		pq.Attributes[key] = values[0]
+	}
+
+	return pq, nil
+}
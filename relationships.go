@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// relationship links two people: PersonID's Type is RelatedID, so with type
+// manager RelatedID manages PersonID. A relationship belongs to both of
+// them and is listed and deleted through either.
+type relationship struct {
+	ID        int       `json:"id"`
+	PersonID  int       `json:"person_id"`
+	RelatedID int       `json:"related_id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// relationshipType says how relationships of a type behave. A person has at
+// most one relationship of a single type. The relationships of a
+// hierarchical type may not form a cycle. A symmetric one reads the same
+// both ways, so only one of the two directions can exist.
+type relationshipType struct {
+	single       bool
+	hierarchical bool
+	symmetric    bool
+}
+
+const relationshipManager = "manager"
+
+var relationshipTypes = map[string]relationshipType{
+	relationshipManager: {single: true, hierarchical: true},
+	"emergency_contact": {},
+	"household":         {symmetric: true},
+}
+
+func relationshipTypeNames() []string {
+	var names []string
+	for name := range relationshipTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func validateRelationshipType(typ string) error {
+	if _, ok := relationshipTypes[typ]; !ok {
+		return &validationError{Name: "type", Reason: "must be one of " + strings.Join(relationshipTypeNames(), ", ")}
+	}
+
+	return nil
+}
+
+// report is a person somewhere under a manager, with Depth 1 for a direct
+// report, 2 for their reports and so on. ManagerID is who they report to.
+type report struct {
+	Person    Person `json:"person"`
+	ManagerID int    `json:"manager_id"`
+	Depth     int    `json:"depth"`
+}
+
+// handlePersonRelationshipsGET lists the relationships on either side of
+// the person, optionally of one type.
+func handlePersonRelationshipsGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	typ := r.URL.Query().Get("type")
+	if typ != "" {
+		if err := validateRelationshipType(typ); err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	relationships, err := actx.storer.personRelationships(ctx, pathInt(r, "id"), typ)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	if relationships == nil {
+		relationships = []relationship{}
+	}
+	writeJSON(w, http.StatusOK, relationships)
+}
+
+func handlePersonRelationshipsPOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type      string `json:"type"`
+		RelatedID int    `json:"related_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	rel := relationship{PersonID: pathInt(r, "id"), RelatedID: req.RelatedID, Type: req.Type}
+	if err := validateRelationshipType(rel.Type); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if rel.RelatedID == rel.PersonID {
+		writeError(w, r, http.StatusBadRequest, &validationError{Name: "related_id", Reason: "must be another person"})
+		return
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	created, err := actx.storer.addRelationship(ctx, rel)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, created)
+}
+
+func handlePersonRelationshipDELETE(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	if err := actx.storer.deleteRelationship(ctx, pathInt(r, "id"), pathInt(r, "relationshipID")); err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// handlePersonReportsGET lists everyone under the person through manager
+// relationships, nearest first.
+func handlePersonReportsGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	reports, err := actx.storer.reportsUnder(ctx, pathInt(r, "id"))
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	if reports == nil {
+		reports = []report{}
+	}
+	writeJSON(w, http.StatusOK, reports)
+}
+
+// relationshipConflict checks rel against the existing relationships the
+// way both stores do, except for cycles, which need the whole hierarchy.
+func relationshipConflict(rel relationship, existing []relationship) error {
+	rt := relationshipTypes[rel.Type]
+	for _, e := range existing {
+		if e.Type != rel.Type {
+			continue
+		}
+
+		same := e.PersonID == rel.PersonID && e.RelatedID == rel.RelatedID
+		reversed := e.PersonID == rel.RelatedID && e.RelatedID == rel.PersonID
+		if same || (rt.symmetric && reversed) {
+			return fmt.Errorf("%w: %d is already %s of %d", errRelationshipExists, rel.RelatedID, rel.Type, rel.PersonID)
+		}
+		if rt.single && e.PersonID == rel.PersonID {
+			return fmt.Errorf("%w: %d already has a %s", errRelationshipExists, rel.PersonID, rel.Type)
+		}
+	}
+
+	return nil
+}
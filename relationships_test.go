@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_relationshipConflict(t *testing.T) {
+	existing := []relationship{
+		{ID: 1, PersonID: 2, RelatedID: 1, Type: "manager"},
+		{ID: 2, PersonID: 1, RelatedID: 3, Type: "household"},
+		{ID: 3, PersonID: 1, RelatedID: 2, Type: "emergency_contact"},
+	}
+
+	for _, tc := range []struct {
+		rel relationship
+		exp error
+	}{
+		{relationship{PersonID: 2, RelatedID: 1, Type: "manager"}, errRelationshipExists},
+		{relationship{PersonID: 2, RelatedID: 3, Type: "manager"}, errRelationshipExists},
+		{relationship{PersonID: 3, RelatedID: 1, Type: "manager"}, nil},
+		{relationship{PersonID: 3, RelatedID: 1, Type: "household"}, errRelationshipExists},
+		{relationship{PersonID: 2, RelatedID: 1, Type: "household"}, nil},
+		{relationship{PersonID: 1, RelatedID: 2, Type: "emergency_contact"}, errRelationshipExists},
+		{relationship{PersonID: 2, RelatedID: 1, Type: "emergency_contact"}, nil},
+		{relationship{PersonID: 1, RelatedID: 3, Type: "emergency_contact"}, nil},
+	} {
+		if err := relationshipConflict(tc.rel, existing); !errors.Is(err, tc.exp) {
+			t.Errorf("got error %v for %+v but expected %v", err, tc.rel, tc.exp)
+		}
+	}
+}
+
+func Test_MemoryStoreRelationships(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+
+	for _, id := range []int{4, 5} {
+		if _, err := ms.addPerson(ctx, Person{ID: id, FirstName: "P", LastName: "Q"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1 manages 2 and 3, 2 manages 4, and 4 manages 5.
+	for _, rel := range []relationship{
+		{PersonID: 3, RelatedID: 1, Type: "manager"},
+		{PersonID: 2, RelatedID: 1, Type: "manager"},
+		{PersonID: 4, RelatedID: 2, Type: "manager"},
+		{PersonID: 5, RelatedID: 4, Type: "manager"},
+	} {
+		if _, err := ms.addRelationship(ctx, rel); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		rel relationship
+		exp error
+	}{
+		{relationship{PersonID: 1, RelatedID: 5, Type: "manager"}, errRelationshipCycle},
+		{relationship{PersonID: 1, RelatedID: 2, Type: "manager"}, errRelationshipCycle},
+		{relationship{PersonID: 5, RelatedID: 3, Type: "manager"}, errRelationshipExists},
+		{relationship{PersonID: 1, RelatedID: 99, Type: "manager"}, errPersonNotFound},
+		// Other types may go round in circles.
+		{relationship{PersonID: 1, RelatedID: 5, Type: "emergency_contact"}, nil},
+		{relationship{PersonID: 5, RelatedID: 1, Type: "emergency_contact"}, nil},
+	} {
+		if _, err := ms.addRelationship(ctx, tc.rel); !errors.Is(err, tc.exp) {
+			t.Errorf("got error %v for %+v but expected %v", err, tc.rel, tc.exp)
+		}
+	}
+
+	reportIDs := func(managerID int) [][3]int {
+		t.Helper()
+		reports, err := ms.reportsUnder(ctx, managerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := [][3]int{}
+		for _, r := range reports {
+			ids = append(ids, [3]int{r.Person.ID, r.ManagerID, r.Depth})
+		}
+		return ids
+	}
+
+	exp := [][3]int{{2, 1, 1}, {3, 1, 1}, {4, 2, 2}, {5, 4, 3}}
+	if got := reportIDs(1); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got reports %v but expected %v", got, exp)
+	}
+
+	// A deleted person takes everyone under them out of the reports, and
+	// out of the relationships of people still current.
+	if err := ms.deletePerson(ctx, 4, 0); err != nil {
+		t.Fatal(err)
+	}
+	exp = [][3]int{{2, 1, 1}, {3, 1, 1}}
+	if got := reportIDs(1); !reflect.DeepEqual(got, exp) {
+		t.Errorf("got reports %v after a delete but expected %v", got, exp)
+	}
+	rels, err := ms.personRelationships(ctx, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rels) != 1 || rels[0].RelatedID != 1 {
+		t.Errorf("got relationships %+v but expected only 2's manager", rels)
+	}
+
+	// Purging a person removes their relationships for good.
+	if _, err := ms.restorePerson(ctx, 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.deletePerson(ctx, 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.purgeDeleted(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	rels, err = ms.personRelationships(ctx, 1, "emergency_contact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rels) != 0 || len(ms.tenants[defaultTenant].relationships) != 3 {
+		t.Errorf("got relationships %+v after a purge but expected none with 5", ms.tenants[defaultTenant].relationships)
+	}
+}
+
+func Test_handlePersonRelationships(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	do := func(method, path, body string, expstatus int, v any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", method, path, err.Error())
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != expstatus {
+			t.Fatalf("got status %d for %s %s but expected %d", res.StatusCode, method, path, expstatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("error during decode: %s", err.Error())
+			}
+		}
+	}
+
+	var household relationship
+	do("POST", "/people/1/relationships", `{"type": "household", "related_id": 2}`, http.StatusOK, &household)
+	if household.ID != 1 || household.PersonID != 1 || household.RelatedID != 2 || household.CreatedAt.IsZero() {
+		t.Errorf("got %+v but expected a new household of 1 and 2", household)
+	}
+
+	// A household reads the same from either side.
+	do("POST", "/people/2/relationships", `{"type": "household", "related_id": 1}`, http.StatusConflict, nil)
+	do("POST", "/people/1/relationships", `{"type": "household", "related_id": 1}`, http.StatusBadRequest, nil)
+	do("POST", "/people/1/relationships", `{"type": "cousin", "related_id": 2}`, http.StatusBadRequest, nil)
+	do("POST", "/people/1/relationships", `{"type": "manager", "related_id": 99}`, http.StatusNotFound, nil)
+	do("POST", "/people/3/relationships", `{"type": "manager", "related_id": 2}`, http.StatusOK, nil)
+	do("POST", "/people/2/relationships", `{"type": "manager", "related_id": 3}`, http.StatusConflict, nil)
+
+	var rels []relationship
+	do("GET", "/people/2/relationships", "", http.StatusOK, &rels)
+	if len(rels) != 2 {
+		t.Errorf("got relationships %+v but expected 2", rels)
+	}
+	do("GET", "/people/2/relationships?type=manager", "", http.StatusOK, &rels)
+	if len(rels) != 1 || rels[0].PersonID != 3 {
+		t.Errorf("got relationships %+v but expected 3's manager", rels)
+	}
+	do("GET", "/people/2/relationships?type=cousin", "", http.StatusBadRequest, nil)
+
+	var reports []report
+	do("GET", "/people/2/reports", "", http.StatusOK, &reports)
+	if len(reports) != 1 || reports[0].Person.ID != 3 || reports[0].Person.FirstName != "Joan" {
+		t.Errorf("got reports %+v but expected Joan", reports)
+	}
+
+	// Relationships are deleted from either side, but only from theirs.
+	do("DELETE", "/people/3/relationships/1", "", http.StatusNotFound, nil)
+	do("DELETE", "/people/2/relationships/1", "", http.StatusOK, nil)
+	do("DELETE", "/people/2/relationships/1", "", http.StatusNotFound, nil)
+	do("GET", "/people/99/relationships", "", http.StatusNotFound, nil)
+	do("GET", "/people/99/reports", "", http.StatusNotFound, nil)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// router dispatches requests on method and path. Patterns are split on "/"
+// and each segment is either a literal or a parameter written {name} or
+// {name:int}, optionally followed by a literal suffix as in {id:int}:restore.
+//
+// A path no pattern matches gets 404, and a matched path without a handler
+// for the method gets 405 with an Allow header. OPTIONS is answered for every
+// pattern and HEAD is served by the GET handler. A path that only matches
+// once an int parameter is given something else gets 400, as the handlers
+// did before they were routed here.
+type router struct {
+	actx   *AppContext
+	routes []*route
+}
+
+type route struct {
+	pattern  string
+	segments []routeSegment
+	handlers map[string]appHandler
+}
+
+type routeSegment struct {
+	literal string
+	param   string
+	kind    string
+	suffix  string
+}
+
+func newRouter(actx *AppContext) *router {
+	return &router{actx: actx}
+}
+
+// handle registers h for method on pattern. Registering the same method and
+// pattern twice is a programming error.
+func (rt *router) handle(method, pattern string, h appHandler) {
+	var rte *route
+	for _, r := range rt.routes {
+		if r.pattern == pattern {
+			rte = r
+		}
+	}
+	if rte == nil {
+		rte = &route{pattern: pattern, segments: parsePattern(pattern), handlers: map[string]appHandler{}}
+		rt.routes = append(rt.routes, rte)
+	}
+
+	if _, ok := rte.handlers[method]; ok {
+		panic("router: " + method + " " + pattern + " registered twice")
+	}
+	rte.handlers[method] = h
+}
+
+func parsePattern(pattern string) []routeSegment {
+	var segments []routeSegment
+	for _, s := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if !strings.HasPrefix(s, "{") {
+			segments = append(segments, routeSegment{literal: s})
+			continue
+		}
+
+		end := strings.Index(s, "}")
+		if end == -1 {
+			panic("router: unterminated parameter in " + pattern)
+		}
+		name, kind, _ := strings.Cut(s[1:end], ":")
+		if kind != "" && kind != "int" {
+			panic("router: unknown parameter type " + kind + " in " + pattern)
+		}
+		segments = append(segments, routeSegment{param: name, kind: kind, suffix: s[end+1:]})
+	}
+
+	return segments
+}
+
+// match reports whether path has the route's shape, returning its parameters
+// and whether they all have the declared types.
+func (rte *route) match(parts []string) (map[string]string, bool, bool) {
+	if len(parts) != len(rte.segments) {
+		return nil, false, false
+	}
+
+	params := map[string]string{}
+	typed := true
+	for i, seg := range rte.segments {
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, false, false
+			}
+			continue
+		}
+
+		v, ok := strings.CutSuffix(parts[i], seg.suffix)
+		if !ok || v == "" {
+			return nil, false, false
+		}
+		if seg.kind == "int" {
+			if _, err := strconv.Atoi(v); err != nil {
+				typed = false
+			}
+		}
+		params[seg.param] = v
+	}
+
+	return params, typed, true
+}
+
+// allow lists the methods a route answers, for the Allow header.
+func (rte *route) allow() string {
+	methods := []string{"OPTIONS"}
+	for m := range rte.handlers {
+		methods = append(methods, m)
+	}
+	if _, ok := rte.handlers["GET"]; ok {
+		if _, ok := rte.handlers["HEAD"]; !ok {
+			methods = append(methods, "HEAD")
+		}
+	}
+	sort.Strings(methods)
+
+	return strings.Join(methods, ", ")
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	// The route with the fewest parameters wins, so literal segments such as
+	// /people/changes take precedence over /people/{id:int}.
+	var best *route
+	var bestParams map[string]string
+	mistyped := false
+	for _, rte := range rt.routes {
+		params, typed, ok := rte.match(parts)
+		if !ok {
+			continue
+		}
+		if !typed {
+			mistyped = true
+			continue
+		}
+		if best == nil || len(params) < len(bestParams) {
+			best, bestParams = rte, params
+		}
+	}
+
+	if best == nil {
+		if mistyped {
+			writeError(w, r, http.StatusBadRequest, errors.New("invalid request"))
+			return
+		}
+		writeError(w, r, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	h, ok := best.handlers[r.Method]
+	if !ok && r.Method == "HEAD" {
+		h, ok = best.handlers["GET"]
+	}
+	if !ok {
+		w.Header().Set("Allow", best.allow())
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), pathParamsKey, bestParams)
+	h(rt.actx, w, r.WithContext(ctx))
+}
+
+// pathParam returns a parameter of the route that matched the request.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey).(map[string]string)
+	return params[name]
+}
+
+// pathInt returns an {name:int} parameter, which the router has already
+// checked is an int.
+func pathInt(r *http.Request, name string) int {
+	n, _ := strconv.Atoi(pathParam(r, name))
+	return n
+}
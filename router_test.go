@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_routerStatus(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method    string
+		path      string
+		expstatus int
+		expallow  string
+	}{
+		{"GET", "/", http.StatusOK, ""},
+		{"GET", "/nope", http.StatusNotFound, ""},
+		{"GET", "/people/1/extra", http.StatusNotFound, ""},
+		{"GET", "/people/", http.StatusNotFound, ""},
+		{"GET", "/people/foo", http.StatusBadRequest, ""},
+		{"POST", "/people/foo:restore", http.StatusBadRequest, ""},
+		{"POST", "/", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"DELETE", "/people", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS, POST"},
+		{"POST", "/people/1", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, OPTIONS, PATCH, PUT"},
+		{"GET", "/people/1:restore", http.StatusMethodNotAllowed, "OPTIONS, POST"},
+		{"OPTIONS", "/webhooks/1", http.StatusNoContent, "DELETE, GET, HEAD, OPTIONS, PUT"},
+		{"HEAD", "/people/1", http.StatusOK, ""},
+	} {
+		req, _ := http.NewRequest(tc.method, server.URL+tc.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", tc.method, tc.path, err.Error())
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != tc.expstatus {
+			t.Errorf("got status %d for %s %s but expected %d", res.StatusCode, tc.method, tc.path, tc.expstatus)
+		}
+
+		if allow := res.Header.Get("Allow"); allow != tc.expallow {
+			t.Errorf("got Allow %q for %s %s but expected %q", allow, tc.method, tc.path, tc.expallow)
+		}
+
+		if tc.expstatus == http.StatusNotFound || tc.expstatus == http.StatusMethodNotAllowed {
+			if p := decodeProblem(t, res); p["status"] != float64(tc.expstatus) {
+				t.Errorf("got problem %v for %s %s but expected status %d", p, tc.method, tc.path, tc.expstatus)
+			}
+		}
+	}
+}
+
+func Test_routerPathParams(t *testing.T) {
+	var got map[string]string
+	rt := newRouter(&AppContext{})
+	rt.handle("GET", "/a/{id:int}/b/{name}:x", func(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+		got = map[string]string{"id": pathParam(r, "id"), "name": pathParam(r, "name")}
+	})
+	rt.handle("GET", "/a/1/b/fixed:x", func(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+		got = map[string]string{"literal": "true"}
+	})
+
+	for _, tc := range []struct {
+		path string
+		exp  map[string]string
+	}{
+		{"/a/12/b/foo:x", map[string]string{"id": "12", "name": "foo"}},
+		{"/a/1/b/fixed:x", map[string]string{"literal": "true"}},
+		{"/a/12/b/foo", nil},
+		{"/a/12/b/:x", nil},
+	} {
+		got = nil
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.path, nil))
+
+		if len(got) != len(tc.exp) {
+			t.Errorf("got params %v for %s but expected %v", got, tc.path, tc.exp)
+			continue
+		}
+		for k, v := range tc.exp {
+			if got[k] != v {
+				t.Errorf("got params %v for %s but expected %v", got, tc.path, tc.exp)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	// searchSimilarityThreshold is the trigram similarity a name needs to
+	// match a misspelled query, the same as pg_trgm's default for %.
+	searchSimilarityThreshold = 0.3
+)
+
+// searchResult is a person matching a search. Score orders the results:
+// a full-text match on every query term counts 1, and the best trigram
+// similarity between the query and the first, last or full name adds the
+// rest. Highlight holds the names with a match, as HTML with each matching
+// word in <mark>.
+type searchResult struct {
+	Person    Person            `json:"person"`
+	Score     float64           `json:"score"`
+	Highlight map[string]string `json:"highlight"`
+}
+
+type searchResponse struct {
+	Query   string         `json:"query"`
+	Results []searchResult `json:"results"`
+}
+
+// handlePeopleSearchGET finds current people by name, best match first.
+// Every query word can be the start of a name, and misspelled names are
+// still found when they are similar enough.
+func handlePeopleSearchGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if len(searchTerms(q)) == 0 {
+		writeError(w, r, http.StatusBadRequest, errors.New("q must contain a letter or digit"))
+		return
+	}
+
+	limit := defaultSearchLimit
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit))
+			return
+		}
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	results, err := actx.storer.searchPeople(ctx, q, limit)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	terms := searchTerms(q)
+	for i := range results {
+		results[i].Highlight = highlightPerson(results[i].Person, terms)
+	}
+	if results == nil {
+		results = []searchResult{}
+	}
+
+	writeJSON(w, http.StatusOK, searchResponse{Query: q, Results: results})
+}
+
+// searchTerms splits a query into lower case words of letters and digits,
+// the way the simple text search configuration does.
+func searchTerms(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// prefixTSQuery builds the tsquery text that requires every term as the
+// start of a word. The terms are letters and digits only, so none of them
+// can be tsquery syntax.
+func prefixTSQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for i, t := range terms {
+		parts[i] = t + ":*"
+	}
+
+	return strings.Join(parts, " & ")
+}
+
+// scorePerson is the in-memory equivalent of the search query in
+// PostgresStore: it reports whether p matches q and with what score.
+func scorePerson(p Person, q string) (float64, bool) {
+	terms := searchTerms(q)
+	words := searchTerms(p.FirstName + " " + p.LastName)
+
+	textMatch := len(terms) > 0
+	for _, t := range terms {
+		found := false
+		for _, w := range words {
+			found = found || strings.HasPrefix(w, t)
+		}
+		textMatch = textMatch && found
+	}
+
+	sim := 0.0
+	for _, name := range []string{p.FirstName, p.LastName, p.FirstName + " " + p.LastName} {
+		if s := trigramSimilarity(name, q); s > sim {
+			sim = s
+		}
+	}
+
+	if !textMatch && sim < searchSimilarityThreshold {
+		return 0, false
+	}
+
+	score := sim
+	if textMatch {
+		score++
+	}
+	return score, true
+}
+
+// trigrams returns the set of trigrams pg_trgm extracts from s: each word is
+// lower cased and padded with two spaces in front and one behind.
+func trigrams(s string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range searchTerms(s) {
+		padded := []rune("  " + w + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			set[string(padded[i:i+3])] = true
+		}
+	}
+
+	return set
+}
+
+// trigramSimilarity is pg_trgm's similarity: the trigrams a and b share over
+// all the trigrams either has.
+func trigramSimilarity(a, b string) float64 {
+	ta, tb := trigrams(a), trigrams(b)
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for t := range ta {
+		if tb[t] {
+			shared++
+		}
+	}
+
+	return float64(shared) / float64(len(ta)+len(tb)-shared)
+}
+
+// highlightPerson marks the matching words of each name, leaving out names
+// with no match.
+func highlightPerson(p Person, terms []string) map[string]string {
+	highlight := map[string]string{}
+	for field, value := range map[string]string{"firstname": p.FirstName, "lastname": p.LastName} {
+		if h, ok := highlightWords(value, terms); ok {
+			highlight[field] = h
+		}
+	}
+
+	return highlight
+}
+
+// highlightWords escapes s as HTML and wraps each word that starts with a
+// term, or is similar enough to one, in <mark>.
+func highlightWords(s string, terms []string) (string, bool) {
+	var b strings.Builder
+	marked := false
+
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		j := i
+		isWord := unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j])) == isWord {
+			j++
+		}
+
+		part := string(runes[i:j])
+		if isWord && wordMatches(strings.ToLower(part), terms) {
+			b.WriteString("<mark>" + html.EscapeString(part) + "</mark>")
+			marked = true
+		} else {
+			b.WriteString(html.EscapeString(part))
+		}
+		i = j
+	}
+
+	return b.String(), marked
+}
+
+func wordMatches(word string, terms []string) bool {
+	for _, t := range terms {
+		if strings.HasPrefix(word, t) || trigramSimilarity(word, t) >= searchSimilarityThreshold {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func Test_trigramSimilarity(t *testing.T) {
+	// Values as pg_trgm's similarity() gives them.
+	for _, tc := range []struct {
+		a, b string
+		exp  float64
+	}{
+		{"Barker", "barker", 1},
+		{"Barker", "bar", 3.0 / 8},
+		{"Barker", "barkr", 4.0 / 9},
+		{"word", "two words", 4.0 / 11},
+		{"Bob", "", 0},
+	} {
+		if got := trigramSimilarity(tc.a, tc.b); math.Abs(got-tc.exp) > 1e-9 {
+			t.Errorf("got similarity %f for %q and %q but expected %f", got, tc.a, tc.b, tc.exp)
+		}
+	}
+}
+
+func Test_MemoryStoreSearchPeople(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	for _, p := range []Person{
+		{ID: 4, FirstName: "Barbara", LastName: "Bush"},
+		{ID: 5, FirstName: "Robert", LastName: "Barkley"},
+		{ID: 6, FirstName: "Gone", LastName: "Barker"},
+	} {
+		if _, err := ms.addPerson(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.deletePerson(ctx, 6, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		q     string
+		limit int
+		exp   []int
+	}{
+		// Prefix matches first, closest names first among them, then
+		// names that are only similar.
+		{"bark", 10, []int{1, 5, 4}},
+		{"bar", 10, []int{1, 4, 5}},
+		{"bar", 2, []int{1, 4}},
+		// Misspellings only match by similarity.
+		{"barkr", 10, []int{1, 5, 4}},
+		{"flintstoen", 10, []int{2}},
+		// Every word has to match for a text match.
+		{"bob barker", 10, []int{1}},
+		{"zzz", 10, nil},
+	} {
+		results, err := ms.searchPeople(ctx, tc.q, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int
+		for _, res := range results {
+			got = append(got, res.Person.ID)
+		}
+		if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("got %v for %q but expected %v", got, tc.q, tc.exp)
+		}
+	}
+}
+
+func Test_highlightPerson(t *testing.T) {
+	for _, tc := range []struct {
+		p   Person
+		q   string
+		exp map[string]string
+	}{
+		{Person{FirstName: "Bob", LastName: "Barker"}, "bark", map[string]string{"lastname": "<mark>Barker</mark>"}},
+		{Person{FirstName: "Bob", LastName: "Barker"}, "bob barkr", map[string]string{"firstname": "<mark>Bob</mark>", "lastname": "<mark>Barker</mark>"}},
+		{Person{FirstName: "Mary <b>", LastName: "O'Brien-Smith"}, "smith", map[string]string{"lastname": "O&#39;Brien-<mark>Smith</mark>"}},
+		{Person{FirstName: "Mary", LastName: "Jones"}, "zzz", map[string]string{}},
+	} {
+		if got := highlightPerson(tc.p, searchTerms(tc.q)); !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("got %v for %q but expected %v", got, tc.q, tc.exp)
+		}
+	}
+}
+
+func Test_handlePeopleSearchGET(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		query     string
+		expstatus int
+		expids    []int
+	}{
+		{"?q=barkr", http.StatusOK, []int{1}},
+		{"?q=jet&limit=5", http.StatusOK, []int{3}},
+		{"?q=nobody", http.StatusOK, []int{}},
+		{"", http.StatusBadRequest, nil},
+		{"?q=%20-%20", http.StatusBadRequest, nil},
+		{"?q=bob&limit=0", http.StatusBadRequest, nil},
+		{"?q=bob&limit=101", http.StatusBadRequest, nil},
+	} {
+		res, err := http.Get(server.URL + "/people/search" + tc.query)
+		if err != nil {
+			t.Fatalf("error during GET %s: %s", tc.query, err.Error())
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != tc.expstatus {
+			t.Errorf("got status %d for %s but expected %d", res.StatusCode, tc.query, tc.expstatus)
+			continue
+		}
+		if tc.expstatus != http.StatusOK {
+			continue
+		}
+
+		var sr searchResponse
+		if err := json.NewDecoder(res.Body).Decode(&sr); err != nil {
+			t.Fatalf("error during decode: %s", err.Error())
+		}
+
+		ids := []int{}
+		for _, r := range sr.Results {
+			ids = append(ids, r.Person.ID)
+			if len(r.Highlight) == 0 {
+				t.Errorf("got no highlight for %v in %s", r.Person, tc.query)
+			}
+		}
+		if !reflect.DeepEqual(ids, tc.expids) {
+			t.Errorf("got %v for %s but expected %v", ids, tc.query, tc.expids)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// purgeActor is recorded in the audit trail for rows the purge job removes.
+const purgeActor = "purge-job"
+
+// handlePersonRestorePOST brings back a soft deleted person.
+func handlePersonRestorePOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	c, ok := negotiateCodec(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	p, err := actx.storer.restorePerson(ctx, id)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(p.Version))
+	writeEntity(w, c, http.StatusOK, p)
+}
+
+// runPurge hard deletes people that have been soft deleted for longer than
+// retention, along with expired Idempotency-Keys and change events past
+// changeRetention, checking every interval until ctx is done.
+func runPurge(ctx context.Context, actx AppContext, retention time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purgeOnce(ctx, actx, retention)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// purgeOnce purges each tenant in turn, so one whose purge fails doesn't
+// hold up the rest.
+func purgeOnce(ctx context.Context, actx AppContext, retention time.Duration) {
+	ctx = withActor(ctx, purgeActor)
+	ctx = withRequestID(ctx, newRequestID())
+
+	tenantsCtx, cancel := context.WithTimeout(ctx, actx.timeout)
+	tenants, err := actx.storer.tenantIDs(tenantsCtx)
+	cancel()
+	if err != nil {
+		actx.logger.error(fmt.Errorf("purge failed: %w", err))
+		return
+	}
+
+	for _, tenant := range tenants {
+		ctx, cancel := context.WithTimeout(withTenant(ctx, tenant), actx.timeout)
+		n, err := actx.storer.purgeDeleted(ctx, time.Now().Add(-retention))
+		if err != nil {
+			actx.logger.error(fmt.Errorf("purge failed for tenant %s: %w", tenant, err))
+		} else if n > 0 {
+			actx.logger.event(logEvent{Event: "purge", Tenant: tenant, Count: n})
+		}
+
+		// Expired Idempotency-Keys are only ever replaced by a reuse of the
+		// same key, so the purge clears out the rest.
+		if _, err := actx.storer.deleteExpiredIdempotencyKeys(ctx); err != nil {
+			actx.logger.error(fmt.Errorf("deleting expired idempotency keys of tenant %s: %w", tenant, err))
+		}
+		if _, err := actx.storer.pruneChanges(ctx, time.Now().Add(-changeRetention)); err != nil {
+			actx.logger.error(fmt.Errorf("pruning the change feed of tenant %s: %w", tenant, err))
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_softDeleteAndRestore(t *testing.T) {
+	ms := NewMemoryStore(0)
+	h := newTestHandler(&ms)
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	cli := &http.Client{}
+	req, err := http.NewRequest(http.MethodDelete, server.URL+"/people/2", nil)
+	if err != nil {
+		t.Fatalf("New request error: %s", err.Error())
+	}
+	res, err := cli.Do(req)
+	if err != nil {
+		t.Fatalf("Error during cli.Do: %s", err.Error())
+	}
+	res.Body.Close()
+
+	res, err = http.Get(server.URL + "/people/2")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d for deleted person but expected %d", res.StatusCode, http.StatusNotFound)
+	}
+
+	var people []Person
+	res, err = http.Get(server.URL + "/people?include_deleted=true")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	if err := json.NewDecoder(res.Body).Decode(&people); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+	res.Body.Close()
+	if len(people) != 3 || people[1].DeletedAt == nil {
+		t.Errorf("expected deleted person to be listed with include_deleted, got %v", people)
+	}
+
+	res, err = http.Post(server.URL+"/people/2:restore", "application/json", nil)
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	var p Person
+	if err := json.NewDecoder(res.Body).Decode(&p); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || p.DeletedAt != nil || p.Version != 3 {
+		t.Errorf("got status %d and person %v after restore", res.StatusCode, p)
+	}
+
+	res, err = http.Post(server.URL+"/people/2:restore", "application/json", nil)
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("got status %d restoring a live person but expected %d", res.StatusCode, http.StatusConflict)
+	}
+}
+
+func Test_purgeOnce(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	if err := ms.deletePerson(ctx, 1, 0); err != nil {
+		t.Fatalf("error during deletePerson: %s", err.Error())
+	}
+	if err := ms.deletePerson(ctx, 2, 0); err != nil {
+		t.Fatalf("error during deletePerson: %s", err.Error())
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	ms.tenants[defaultTenant].people[0].DeletedAt = &old
+
+	logger := &recordingLogger{}
+	actx := AppContext{storer: &ms, timeout: time.Second, logger: logger}
+	purgeOnce(ctx, actx, 24*time.Hour)
+
+	if exp := (logEvent{Event: "purge", Tenant: defaultTenant, Count: 1}); len(logger.events) != 1 || logger.events[0] != exp {
+		t.Errorf("got events %+v but expected %+v", logger.events, exp)
+	}
+
+	if len(ms.tenants[defaultTenant].people) != 2 || ms.tenants[defaultTenant].people[0].ID != 2 {
+		t.Errorf("expected only the expired person to be purged, got %v", ms.tenants[defaultTenant].people)
+	}
+
+	events, err := ms.personHistory(ctx, 1)
+	if err != nil {
+		t.Fatalf("error during personHistory: %s", err.Error())
+	}
+	if last := events[len(events)-1]; last.Action != auditPurge || last.Actor != purgeActor {
+		t.Errorf("got last event %s by %s but expected %s by %s", last.Action, last.Actor, auditPurge, purgeActor)
+	}
+}
@@ -1,11 +1,187 @@
 package main
 
-import "context"
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
 
+var (
+	errPersonNotFound   = errors.New("No person exists")
+	errVersionMismatch  = errors.New("Person version does not match")
+	errPersonNotDeleted = errors.New("Person is not deleted")
+	errWebhookNotFound  = errors.New("No webhook exists")
+	errPersonExists     = errors.New("Person ID is already taken")
+	errEmailTaken       = errors.New("Email is already taken")
+	errAddressNotFound  = errors.New("No address exists")
+
+	errAttributeSchemaNotFound = errors.New("No attribute schema exists")
+
+	errRelationshipNotFound = errors.New("No relationship exists")
+	errRelationshipExists   = errors.New("Relationship already exists")
+	errRelationshipCycle    = errors.New("Relationship would make a cycle")
+
+	// errNoTenant is a bug: something reached the store without scoping
+	// its ctx to a tenant with withTenant.
+	errNoTenant = errors.New("The context names no tenant")
+)
+
+// personQuery narrows the people the read methods return. By default soft
+// deleted people are left out. A non-zero AsOf reads people as they stood at
+// that time instead of as they are now. Attributes keeps only the people
+// with each of the attribute values; see attributeFilterValues.
+type personQuery struct {
+	IncludeDeleted bool
+	AsOf           time.Time
+	Attributes     map[string]string
+}
+
+// matches reports whether p belongs in the results of pq.
+func (pq personQuery) matches(p Person) bool {
+	return (pq.IncludeDeleted || p.DeletedAt == nil) && attributesMatch(p.Attributes, pq.Attributes)
+}
+
+// personFilter narrows a personQuery further for pagePeople. Names match
+// case-insensitively, and a nil age bound leaves that end open.
+type personFilter struct {
+	personQuery
+	FirstName string
+	LastName  string
+	MinAge    *int
+	MaxAge    *int
+}
+
+// matches reports whether p belongs in the results of f.
+func (f personFilter) matches(p Person) bool {
+	return f.personQuery.matches(p) &&
+		(f.FirstName == "" || strings.EqualFold(p.FirstName, f.FirstName)) &&
+		(f.LastName == "" || strings.EqualFold(p.LastName, f.LastName)) &&
+		(f.MinAge == nil || p.Age >= *f.MinAge) &&
+		(f.MaxAge == nil || p.Age <= *f.MaxAge)
+}
+
+// peoplePage is a page of pagePeople. Total is how many people the filter
+// matches on every page, and Before how many of those come before this one.
+type peoplePage struct {
+	People []Person
+	Total  int
+	Before int
+}
+
+// Storer is implemented by the person backends. The version passed to
+// updatePerson and deletePerson is the version the caller expects the stored
+// person to have; a version of 0 skips the check. deletePerson is a soft
+// delete: the person can be brought back with restorePerson until
+// purgeDeleted removes them for good.
+//
+// Every method reads and writes only the data of the tenant in ctx, as
+// tenantFromContext gives it; people, IDs and everything hanging off them
+// are separate for each tenant.
 type Storer interface {
-	allPeople(ctx context.Context) ([]Person, error)
-	personForID(ctx context.Context, id int) (*Person, error)
+	// eachPerson calls fn for every person the query matches, highest ID
+	// first, without loading them all at once, stopping at the first error fn
+	// returns.
+	eachPerson(ctx context.Context, pq personQuery, fn func(p Person) error) error
+	// pagePeople returns up to limit of the people f matches with an ID
+	// above after, lowest ID first.
+	pagePeople(ctx context.Context, f personFilter, after int, limit int) (peoplePage, error)
+	personForID(ctx context.Context, id int, pq personQuery) (*Person, error)
+	// peopleForIDs looks up several current people at once, in no particular
+	// order. IDs with no current person are left out rather than failing.
+	peopleForIDs(ctx context.Context, ids []int) ([]Person, error)
+	// searchPeople returns up to limit current people matching q, highest
+	// score first and by ID among equal scores. See searchResult for how
+	// they are scored; Highlight is left for the caller.
+	searchPeople(ctx context.Context, q string, limit int) ([]searchResult, error)
 	addPerson(ctx context.Context, p Person) (Person, error)
-	deletePerson(ctx context.Context, id int) error
-	updatePerson(ctx context.Context, id int, p Person) (Person, error)
+	deletePerson(ctx context.Context, id int, version int) error
+	updatePerson(ctx context.Context, id int, p Person, version int) (Person, error)
+	restorePerson(ctx context.Context, id int) (Person, error)
+	// purgeDeleted permanently removes people deleted before the given time
+	// and returns how many were removed.
+	purgeDeleted(ctx context.Context, before time.Time) (int, error)
+
+	// applyBatch runs ops in order and reports an outcome for each. When
+	// atomic is set and any operation fails, none of them are kept.
+	applyBatch(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error)
+
+	// personHistory returns the audit events for a person, oldest first.
+	// Every write above records its events along with the change itself,
+	// taking the actor and request ID from ctx.
+	personHistory(ctx context.Context, id int) ([]auditEvent, error)
+	// changesSince returns up to limit change events after the cursor, in
+	// feed order. Every write records its event along with the change.
+	changesSince(ctx context.Context, after changeCursor, limit int) ([]changeEvent, error)
+	// latestChangeCursor returns the cursor of the last event changesSince
+	// would currently return, or the zero cursor when there is none.
+	latestChangeCursor(ctx context.Context) (changeCursor, error)
+	// pruneChanges deletes the change events recorded before before and
+	// returns how many there were. Consumers that are further behind than
+	// that carry on from the oldest event left.
+	pruneChanges(ctx context.Context, before time.Time) (int, error)
+
+	// The address methods fail with errPersonNotFound unless the person is
+	// current, and with errAddressNotFound for an address that is not
+	// theirs. Addresses go when their person is purged.
+	personAddresses(ctx context.Context, personID int) ([]address, error)
+	addressForID(ctx context.Context, personID int, id int) (*address, error)
+	addAddress(ctx context.Context, personID int, a address) (address, error)
+	updateAddress(ctx context.Context, personID int, id int, a address) (address, error)
+	deleteAddress(ctx context.Context, personID int, id int) error
+
+	// The person writes above check attributes against these schemas with
+	// checkAttributes, and store what it returns.
+	attributeSchemas(ctx context.Context) ([]attributeSchema, error)
+	attributeSchemaForKey(ctx context.Context, key string) (*attributeSchema, error)
+	// putAttributeSchema creates or replaces the schema for s.Key.
+	putAttributeSchema(ctx context.Context, s attributeSchema) (attributeSchema, error)
+	deleteAttributeSchema(ctx context.Context, key string) error
+
+	// personRelationships returns the relationships on either side of a
+	// current person, of type typ unless it is "", leaving out those whose
+	// other person is deleted. addRelationship fails with errPersonNotFound
+	// unless both people are current, with errRelationshipExists when
+	// relationshipConflict does, and with errRelationshipCycle when a
+	// hierarchical relationship would lead back to its person.
+	// Relationships go when either person is purged.
+	personRelationships(ctx context.Context, personID int, typ string) ([]relationship, error)
+	addRelationship(ctx context.Context, rel relationship) (relationship, error)
+	deleteRelationship(ctx context.Context, personID int, id int) error
+	// reportsUnder walks the manager relationships down from a current
+	// person, ordered by depth and then ID, skipping deleted people and
+	// everyone under them.
+	reportsUnder(ctx context.Context, managerID int) ([]report, error)
+
+	addWebhook(ctx context.Context, wh webhook) (webhook, error)
+	allWebhooks(ctx context.Context) ([]webhook, error)
+	webhookForID(ctx context.Context, id int) (*webhook, error)
+	// updateWebhook replaces the webhook, keeping its secret when wh has none.
+	updateWebhook(ctx context.Context, id int, wh webhook) (webhook, error)
+	deleteWebhook(ctx context.Context, id int) error
+	// webhookDeliveries returns up to limit deliveries newest first, for
+	// every webhook when webhookID is 0 and in any status when status is "".
+	webhookDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]webhookDelivery, error)
+	// claimWebhookDeliveries returns up to limit pending deliveries that are
+	// due, pushing their next attempt back by lease so no one else claims
+	// them meanwhile.
+	claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error)
+	// recordWebhookAttempt saves the outcome of an attempt at d.
+	recordWebhookAttempt(ctx context.Context, d webhookDelivery) error
+
+	// reserveIdempotencyKey stores rec unless an unexpired record already
+	// exists for its key, in which case that record is returned with false.
+	reserveIdempotencyKey(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error)
+	// completeIdempotencyKey stores the response of rec and its new expiry.
+	completeIdempotencyKey(ctx context.Context, rec idempotencyRecord) error
+	releaseIdempotencyKey(ctx context.Context, key string) error
+	// deleteExpiredIdempotencyKeys removes the records that expired before
+	// now and returns how many there were.
+	deleteExpiredIdempotencyKeys(ctx context.Context) (int, error)
+
+	// tenantIDs lists every tenant that may have people or webhooks, sorted,
+	// for the background work done for each of them. It is the one method
+	// that isn't scoped to the tenant in ctx, and it returns nothing of
+	// theirs but IDs.
+	tenantIDs(ctx context.Context) ([]string, error)
 }
@@ -1,31 +1,221 @@
 package main
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type StorerStub struct {
-	allPeopleStub    func(ctx context.Context) ([]Person, error)
-	personForIDStub  func(ctx context.Context, id int) (*Person, error)
-	addPersonStub    func(ctx context.Context, p Person) (Person, error)
-	deletePersonStub func(ctx context.Context, id int) error
-	updatePersonStub func(ctx context.Context, id int, p Person) (Person, error)
+	eachPersonStub         func(ctx context.Context, pq personQuery, fn func(p Person) error) error
+	pagePeopleStub         func(ctx context.Context, f personFilter, after int, limit int) (peoplePage, error)
+	personForIDStub        func(ctx context.Context, id int, pq personQuery) (*Person, error)
+	peopleForIDsStub       func(ctx context.Context, ids []int) ([]Person, error)
+	searchPeopleStub       func(ctx context.Context, q string, limit int) ([]searchResult, error)
+	addPersonStub          func(ctx context.Context, p Person) (Person, error)
+	deletePersonStub       func(ctx context.Context, id int, version int) error
+	updatePersonStub       func(ctx context.Context, id int, p Person, version int) (Person, error)
+	restorePersonStub      func(ctx context.Context, id int) (Person, error)
+	purgeDeletedStub       func(ctx context.Context, before time.Time) (int, error)
+	applyBatchStub         func(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error)
+	personHistoryStub      func(ctx context.Context, id int) ([]auditEvent, error)
+	changesSinceStub       func(ctx context.Context, after changeCursor, limit int) ([]changeEvent, error)
+	latestChangeCursorStub func(ctx context.Context) (changeCursor, error)
+	pruneChangesStub       func(ctx context.Context, before time.Time) (int, error)
+
+	personAddressesStub func(ctx context.Context, personID int) ([]address, error)
+	addressForIDStub    func(ctx context.Context, personID int, id int) (*address, error)
+	addAddressStub      func(ctx context.Context, personID int, a address) (address, error)
+	updateAddressStub   func(ctx context.Context, personID int, id int, a address) (address, error)
+	deleteAddressStub   func(ctx context.Context, personID int, id int) error
+
+	attributeSchemasStub      func(ctx context.Context) ([]attributeSchema, error)
+	attributeSchemaForKeyStub func(ctx context.Context, key string) (*attributeSchema, error)
+	putAttributeSchemaStub    func(ctx context.Context, s attributeSchema) (attributeSchema, error)
+	deleteAttributeSchemaStub func(ctx context.Context, key string) error
+
+	personRelationshipsStub func(ctx context.Context, personID int, typ string) ([]relationship, error)
+	addRelationshipStub     func(ctx context.Context, rel relationship) (relationship, error)
+	deleteRelationshipStub  func(ctx context.Context, personID int, id int) error
+	reportsUnderStub        func(ctx context.Context, managerID int) ([]report, error)
+
+	addWebhookStub             func(ctx context.Context, wh webhook) (webhook, error)
+	allWebhooksStub            func(ctx context.Context) ([]webhook, error)
+	webhookForIDStub           func(ctx context.Context, id int) (*webhook, error)
+	updateWebhookStub          func(ctx context.Context, id int, wh webhook) (webhook, error)
+	deleteWebhookStub          func(ctx context.Context, id int) error
+	webhookDeliveriesStub      func(ctx context.Context, webhookID int, status string, limit int) ([]webhookDelivery, error)
+	claimWebhookDeliveriesStub func(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error)
+	recordWebhookAttemptStub   func(ctx context.Context, d webhookDelivery) error
+
+	reserveIdempotencyKeyStub  func(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error)
+	completeIdempotencyKeyStub func(ctx context.Context, rec idempotencyRecord) error
+	releaseIdempotencyKeyStub  func(ctx context.Context, key string) error
+
+	deleteExpiredIdempotencyKeysStub func(ctx context.Context) (int, error)
+
+	tenantIDsStub func(ctx context.Context) ([]string, error)
+}
+
+func (ss StorerStub) eachPerson(ctx context.Context, pq personQuery, fn func(p Person) error) error {
+	return ss.eachPersonStub(ctx, pq, fn)
+}
+
+func (ss StorerStub) pagePeople(ctx context.Context, f personFilter, after int, limit int) (peoplePage, error) {
+	return ss.pagePeopleStub(ctx, f, after, limit)
+}
+
+func (ss StorerStub) personForID(ctx context.Context, id int, pq personQuery) (*Person, error) {
+	return ss.personForIDStub(ctx, id, pq)
 }
 
-func (ss StorerStub) allPeople(ctx context.Context) ([]Person, error) {
-	return ss.allPeopleStub(ctx)
+func (ss StorerStub) peopleForIDs(ctx context.Context, ids []int) ([]Person, error) {
+	return ss.peopleForIDsStub(ctx, ids)
 }
 
-func (ss StorerStub) personForID(ctx context.Context, id int) (*Person, error) {
-	return ss.personForIDStub(ctx, id)
+func (ss StorerStub) searchPeople(ctx context.Context, q string, limit int) ([]searchResult, error) {
+	return ss.searchPeopleStub(ctx, q, limit)
 }
 
 func (ss StorerStub) addPerson(ctx context.Context, p Person) (Person, error) {
 	return ss.addPersonStub(ctx, p)
 }
 
-func (ss StorerStub) deletePerson(ctx context.Context, id int) error {
-	return ss.deletePersonStub(ctx, id)
+func (ss StorerStub) deletePerson(ctx context.Context, id int, version int) error {
+	return ss.deletePersonStub(ctx, id, version)
+}
+
+func (ss StorerStub) updatePerson(ctx context.Context, id int, p Person, version int) (Person, error) {
+	return ss.updatePersonStub(ctx, id, p, version)
+}
+
+func (ss StorerStub) restorePerson(ctx context.Context, id int) (Person, error) {
+	return ss.restorePersonStub(ctx, id)
+}
+
+func (ss StorerStub) purgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	return ss.purgeDeletedStub(ctx, before)
+}
+
+func (ss StorerStub) applyBatch(ctx context.Context, ops []batchOperation, atomic bool) ([]batchResult, error) {
+	return ss.applyBatchStub(ctx, ops, atomic)
+}
+
+func (ss StorerStub) personHistory(ctx context.Context, id int) ([]auditEvent, error) {
+	return ss.personHistoryStub(ctx, id)
+}
+
+func (ss StorerStub) changesSince(ctx context.Context, after changeCursor, limit int) ([]changeEvent, error) {
+	return ss.changesSinceStub(ctx, after, limit)
+}
+
+func (ss StorerStub) latestChangeCursor(ctx context.Context) (changeCursor, error) {
+	return ss.latestChangeCursorStub(ctx)
+}
+
+func (ss StorerStub) pruneChanges(ctx context.Context, before time.Time) (int, error) {
+	return ss.pruneChangesStub(ctx, before)
+}
+
+func (ss StorerStub) personAddresses(ctx context.Context, personID int) ([]address, error) {
+	return ss.personAddressesStub(ctx, personID)
+}
+
+func (ss StorerStub) addressForID(ctx context.Context, personID int, id int) (*address, error) {
+	return ss.addressForIDStub(ctx, personID, id)
+}
+
+func (ss StorerStub) addAddress(ctx context.Context, personID int, a address) (address, error) {
+	return ss.addAddressStub(ctx, personID, a)
+}
+
+func (ss StorerStub) updateAddress(ctx context.Context, personID int, id int, a address) (address, error) {
+	return ss.updateAddressStub(ctx, personID, id, a)
+}
+
+func (ss StorerStub) deleteAddress(ctx context.Context, personID int, id int) error {
+	return ss.deleteAddressStub(ctx, personID, id)
+}
+
+func (ss StorerStub) attributeSchemas(ctx context.Context) ([]attributeSchema, error) {
+	return ss.attributeSchemasStub(ctx)
+}
+
+func (ss StorerStub) attributeSchemaForKey(ctx context.Context, key string) (*attributeSchema, error) {
+	return ss.attributeSchemaForKeyStub(ctx, key)
+}
+
+func (ss StorerStub) putAttributeSchema(ctx context.Context, s attributeSchema) (attributeSchema, error) {
+	return ss.putAttributeSchemaStub(ctx, s)
+}
+
+func (ss StorerStub) deleteAttributeSchema(ctx context.Context, key string) error {
+	return ss.deleteAttributeSchemaStub(ctx, key)
+}
+
+func (ss StorerStub) personRelationships(ctx context.Context, personID int, typ string) ([]relationship, error) {
+	return ss.personRelationshipsStub(ctx, personID, typ)
+}
+
+func (ss StorerStub) addRelationship(ctx context.Context, rel relationship) (relationship, error) {
+	return ss.addRelationshipStub(ctx, rel)
+}
+
+func (ss StorerStub) deleteRelationship(ctx context.Context, personID int, id int) error {
+	return ss.deleteRelationshipStub(ctx, personID, id)
+}
+
+func (ss StorerStub) reportsUnder(ctx context.Context, managerID int) ([]report, error) {
+	return ss.reportsUnderStub(ctx, managerID)
+}
+
+func (ss StorerStub) addWebhook(ctx context.Context, wh webhook) (webhook, error) {
+	return ss.addWebhookStub(ctx, wh)
+}
+
+func (ss StorerStub) allWebhooks(ctx context.Context) ([]webhook, error) {
+	return ss.allWebhooksStub(ctx)
+}
+
+func (ss StorerStub) webhookForID(ctx context.Context, id int) (*webhook, error) {
+	return ss.webhookForIDStub(ctx, id)
+}
+
+func (ss StorerStub) updateWebhook(ctx context.Context, id int, wh webhook) (webhook, error) {
+	return ss.updateWebhookStub(ctx, id, wh)
+}
+
+func (ss StorerStub) deleteWebhook(ctx context.Context, id int) error {
+	return ss.deleteWebhookStub(ctx, id)
+}
+
+func (ss StorerStub) webhookDeliveries(ctx context.Context, webhookID int, status string, limit int) ([]webhookDelivery, error) {
+	return ss.webhookDeliveriesStub(ctx, webhookID, status, limit)
+}
+
+func (ss StorerStub) claimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhookDelivery, error) {
+	return ss.claimWebhookDeliveriesStub(ctx, limit, lease)
+}
+
+func (ss StorerStub) recordWebhookAttempt(ctx context.Context, d webhookDelivery) error {
+	return ss.recordWebhookAttemptStub(ctx, d)
+}
+
+func (ss StorerStub) reserveIdempotencyKey(ctx context.Context, rec idempotencyRecord) (idempotencyRecord, bool, error) {
+	return ss.reserveIdempotencyKeyStub(ctx, rec)
+}
+
+func (ss StorerStub) completeIdempotencyKey(ctx context.Context, rec idempotencyRecord) error {
+	return ss.completeIdempotencyKeyStub(ctx, rec)
+}
+
+func (ss StorerStub) releaseIdempotencyKey(ctx context.Context, key string) error {
+	return ss.releaseIdempotencyKeyStub(ctx, key)
+}
+
+func (ss StorerStub) deleteExpiredIdempotencyKeys(ctx context.Context) (int, error) {
+	return ss.deleteExpiredIdempotencyKeysStub(ctx)
 }
 
-func (ss StorerStub) updatePerson(ctx context.Context, id int, p Person) (Person, error) {
-	return ss.updatePersonStub(ctx, id, p)
+func (ss StorerStub) tenantIDs(ctx context.Context) ([]string, error) {
+	return ss.tenantIDsStub(ctx)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// withIdleTimeout returns a context that is cancelled once timeout passes
+// without a call to touch, rather than at a fixed deadline, so a stream may
+// run as long as it keeps making progress. Its cause is then
+// context.DeadlineExceeded, which idleError reports in place of the error
+// of the cancelled work.
+func withIdleTimeout(parent context.Context, timeout time.Duration) (ctx context.Context, touch func(), cancel func()) {
+	ctx, cancelCause := context.WithCancelCause(parent)
+	timer := time.AfterFunc(timeout, func() {
+		cancelCause(context.DeadlineExceeded)
+	})
+
+	touch = func() {
+		timer.Reset(timeout)
+	}
+	cancel = func() {
+		timer.Stop()
+		cancelCause(context.Canceled)
+	}
+
+	return ctx, touch, cancel
+}
+
+// idleError returns the cause of ctx once it is done, so that work cut short
+// by withIdleTimeout fails with context.DeadlineExceeded.
+func idleError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	return err
+}
+
+// jsonArrayWriter encodes a JSON array one element at a time, flushing every
+// flushEvery elements, so a listing never has to be held in memory. The
+// status line is only sent with the first element, which leaves the handler
+// free to report an error instead as long as nothing has been written.
+type jsonArrayWriter struct {
+	w          http.ResponseWriter
+	flushEvery int
+	count      int
+}
+
+func newJSONArrayWriter(w http.ResponseWriter, flushEvery int) *jsonArrayWriter {
+	return &jsonArrayWriter{w: w, flushEvery: flushEvery}
+}
+
+// started reports whether any part of the response has been written.
+func (aw *jsonArrayWriter) started() bool {
+	return aw.count > 0
+}
+
+func (aw *jsonArrayWriter) item(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	sep := ","
+	if aw.count == 0 {
+		aw.w.Header().Set("Content-Type", mediaJSON)
+		aw.w.WriteHeader(http.StatusOK)
+		sep = "["
+	}
+
+	if _, err := io.WriteString(aw.w, sep); err != nil {
+		return err
+	}
+
+	if _, err := aw.w.Write(b); err != nil {
+		return err
+	}
+
+	aw.count++
+	if aw.count%aw.flushEvery == 0 {
+		if f, ok := aw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	return nil
+}
+
+// close ends the array, writing an empty one if there were no elements.
+func (aw *jsonArrayWriter) close() error {
+	end := "]\n"
+	if aw.count == 0 {
+		aw.w.Header().Set("Content-Type", mediaJSON)
+		aw.w.WriteHeader(http.StatusOK)
+		end = "[]\n"
+	}
+
+	_, err := io.WriteString(aw.w, end)
+	return err
+}
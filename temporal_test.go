@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_handlePersonGETAsOf(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	tick := func() time.Time {
+		time.Sleep(2 * time.Millisecond)
+		now := time.Now()
+		time.Sleep(2 * time.Millisecond)
+		return now
+	}
+
+	beforeCreate := tick()
+	if _, err := ms.addPerson(ctx, Person{ID: 10, FirstName: "Foo", LastName: "Bar", Age: 22}); err != nil {
+		t.Fatalf("error during addPerson: %s", err.Error())
+	}
+	afterCreate := tick()
+	if _, err := ms.updatePerson(ctx, 10, Person{FirstName: "Foo", LastName: "Baz", Age: 23}, 0); err != nil {
+		t.Fatalf("error during updatePerson: %s", err.Error())
+	}
+	afterUpdate := tick()
+	if err := ms.deletePerson(ctx, 10, 0); err != nil {
+		t.Fatalf("error during deletePerson: %s", err.Error())
+	}
+
+	h := newTestHandler(&ms)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	tests := []struct {
+		asOf      time.Time
+		expstatus int
+		explast   string
+	}{
+		{asOf: beforeCreate, expstatus: http.StatusNotFound},
+		{asOf: afterCreate, expstatus: http.StatusOK, explast: "Bar"},
+		{asOf: afterUpdate, expstatus: http.StatusOK, explast: "Baz"},
+		{asOf: time.Now(), expstatus: http.StatusNotFound},
+	}
+
+	for i, tt := range tests {
+		res, err := http.Get(server.URL + "/people/10?as_of=" + url.QueryEscape(tt.asOf.Format(time.RFC3339Nano)))
+		if err != nil {
+			t.Fatalf("error during http.Get: %s", err.Error())
+		}
+
+		var p Person
+		json.NewDecoder(res.Body).Decode(&p)
+		res.Body.Close()
+
+		if res.StatusCode != tt.expstatus {
+			t.Errorf("case %d: got status %d but expected %d", i, res.StatusCode, tt.expstatus)
+			continue
+		}
+
+		if tt.expstatus == http.StatusOK && p.LastName != tt.explast {
+			t.Errorf("case %d: got lastname %s but expected %s", i, p.LastName, tt.explast)
+		}
+	}
+
+	res, err := http.Get(server.URL + "/people?as_of=" + url.QueryEscape(afterUpdate.Format(time.RFC3339Nano)))
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	var people []Person
+	if err := json.NewDecoder(res.Body).Decode(&people); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	if len(people) != 4 || people[0].ID != 10 || people[0].Version != 2 || people[3].ID != 1 {
+		t.Errorf("got people %v as of after the update", people)
+	}
+
+	res, err = http.Get(server.URL + "/people?as_of=yesterday")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for an invalid as_of but expected %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultTenant is the tenant of requests that name none while tenants are
+// not required, so a single tenant deployment works without any setup.
+const defaultTenant = "default"
+
+// tenantID is the form of a tenant ID: a DNS label, so that every tenant can
+// have a subdomain.
+var tenantID = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var (
+	errTenantRequired  = errors.New("The request names no tenant")
+	errTenantMismatch  = errors.New("The request names more than one tenant")
+	errInvalidToken    = errors.New("Bearer token is not valid")
+	errTenantUntrusted = errors.New("The API is not set up to take the tenant from X-Tenant-ID or the subdomain")
+)
+
+// tenantlessPaths serve nothing that belongs to a tenant, so they answer
+// requests that name none even when tenants are required.
+var tenantlessPaths = map[string]bool{"/": true, "/openapi.json": true, "/docs": true}
+
+// tenantResolver works out which tenant a request is for. With a secret,
+// the tenant is the tenant_id claim of an HS256 bearer token signed with it,
+// and X-Tenant-ID and the subdomain can only repeat it. Without one, any
+// caller could name any tenant, so X-Tenant-ID and the subdomain of domain
+// are only taken when trustHeaders is set, which is only safe behind a proxy
+// that sets or strips them itself; otherwise every request is for
+// defaultTenant, and one that names another tenant fails. Either way,
+// sources that disagree fail the request rather than one of them winning.
+type tenantResolver struct {
+	secret       []byte
+	domain       string
+	trustHeaders bool
+	required     bool
+}
+
+// requestIdentity is who a request is from: its tenant and, when it is
+// authenticated with a token, the token's subject.
+type requestIdentity struct {
+	tenant  string
+	subject string
+}
+
+// tenantSource is what a request carries that can name its tenant.
+type tenantSource struct {
+	authorization string
+	header        string
+	host          string
+}
+
+func (tr tenantResolver) resolve(src tenantSource) (requestIdentity, error) {
+	var id requestIdentity
+	var named []string
+	if tr.authenticates() {
+		claims, err := tr.verifyToken(src.authorization)
+		if err != nil {
+			return id, err
+		}
+		named = append(named, claims.TenantID)
+		id.subject = claims.Subject
+	}
+	subdomain := tr.subdomain(src.host)
+	if (src.header != "" || subdomain != "") && !tr.authenticates() && !tr.trustHeaders {
+		return id, errTenantUntrusted
+	}
+	if src.header != "" {
+		if !tenantID.MatchString(src.header) {
+			return id, &validationError{Name: "X-Tenant-ID", Reason: "must be up to 63 lowercase letters, digits and -, not starting or ending with -"}
+		}
+		named = append(named, src.header)
+	}
+	if subdomain != "" {
+		named = append(named, subdomain)
+	}
+
+	// This is the only place a request without a tenant gets defaultTenant;
+	// the stores never fall back to it. See tenantFromContext.
+	if len(named) == 0 {
+		if tr.required {
+			return id, errTenantRequired
+		}
+		id.tenant = defaultTenant
+		return id, nil
+	}
+
+	for _, tenant := range named[1:] {
+		if tenant != named[0] {
+			return id, errTenantMismatch
+		}
+	}
+
+	id.tenant = named[0]
+	return id, nil
+}
+
+// authenticates reports whether requests must carry a token. Only then is
+// the actor of a change taken from the token rather than from X-Actor.
+func (tr tenantResolver) authenticates() bool {
+	return len(tr.secret) > 0
+}
+
+// subdomain returns the tenant whose subdomain of tr.domain host is, or ""
+// when it isn't one.
+func (tr tenantResolver) subdomain(host string) string {
+	if tr.domain == "" {
+		return ""
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(tr.domain))
+	if !ok || !tenantID.MatchString(label) {
+		return ""
+	}
+
+	return label
+}
+
+// tokenClaims are the claims of a token that the API uses.
+type tokenClaims struct {
+	TenantID string `json:"tenant_id"`
+	Subject  string `json:"sub"`
+	Exp      *int64 `json:"exp"`
+}
+
+// verifyToken verifies an HS256 JWT bearer token and returns its claims,
+// which always include a valid tenant_id. Tokens without an exp claim don't
+// expire.
+func (tr tenantResolver) verifyToken(authorization string) (tokenClaims, error) {
+	var claims tokenClaims
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return claims, fmt.Errorf("%w: none was sent", errInvalidToken)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("%w: it is not a JWT", errInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return claims, fmt.Errorf("%w: it must be signed with HS256", errInvalidToken)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	mac := hmac.New(sha256.New, tr.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return claims, fmt.Errorf("%w: the signature does not match", errInvalidToken)
+	}
+
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return claims, fmt.Errorf("%w: its claims are not JSON", errInvalidToken)
+	}
+	if claims.Exp != nil && time.Now().Unix() >= *claims.Exp {
+		return claims, fmt.Errorf("%w: it has expired", errInvalidToken)
+	}
+	if !tenantID.MatchString(claims.TenantID) {
+		return claims, fmt.Errorf("%w: it has no valid tenant_id claim", errInvalidToken)
+	}
+
+	return claims, nil
+}
+
+func decodeTokenPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// tenantErrorStatus is the status of a request whose tenant couldn't be
+// resolved.
+func tenantErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidToken):
+		return http.StatusUnauthorized
+	case errors.Is(err, errTenantMismatch), errors.Is(err, errTenantUntrusted):
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// withIdentity scopes ctx to the tenant of id. When tr authenticates
+// requests, the actor becomes the token's subject, replacing any X-Actor,
+// which any caller could set.
+func withIdentity(ctx context.Context, tr tenantResolver, id requestIdentity) context.Context {
+	ctx = withTenant(ctx, id.tenant)
+	if tr.authenticates() {
+		ctx = withActor(ctx, id.subject)
+	}
+
+	return ctx
+}
+
+// tenantMw scopes each request to the tenant actx.tenants resolves for it.
+func tenantMw(actx AppContext, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := actx.tenants.resolve(tenantSource{
+			authorization: r.Header.Get("Authorization"),
+			header:        r.Header.Get("X-Tenant-ID"),
+			host:          r.Host,
+		})
+		if err != nil && !tenantlessPaths[r.URL.Path] {
+			if errors.Is(err, errInvalidToken) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			}
+			writeError(w, r, tenantErrorStatus(err), err)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), actx.tenants, id)))
+	})
+}
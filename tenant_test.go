@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signToken(secret string, claims string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+
+	return "Bearer " + header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func Test_tenantResolver(t *testing.T) {
+	untrusted := tenantResolver{domain: "people.example"}
+	open := tenantResolver{domain: "people.example", trustHeaders: true}
+	required := tenantResolver{domain: "people.example", trustHeaders: true, required: true}
+	tokens := tenantResolver{secret: []byte("s3cret"), domain: "people.example"}
+
+	acme := signToken("s3cret", `{"tenant_id": "acme"}`)
+	expired := signToken("s3cret", `{"tenant_id": "acme", "exp": 1}`)
+	forged := signToken("guess", `{"tenant_id": "acme"}`)
+	noTenant := signToken("s3cret", `{"sub": "bob"}`)
+
+	var invalid *validationError
+	for _, tc := range []struct {
+		tr     tenantResolver
+		src    tenantSource
+		exp    string
+		experr any
+	}{
+		{untrusted, tenantSource{}, defaultTenant, nil},
+		{untrusted, tenantSource{host: "people.example"}, defaultTenant, nil},
+		{untrusted, tenantSource{header: "acme"}, "", errTenantUntrusted},
+		{untrusted, tenantSource{host: "acme.people.example"}, "", errTenantUntrusted},
+		{open, tenantSource{}, defaultTenant, nil},
+		{open, tenantSource{header: "acme"}, "acme", nil},
+		{open, tenantSource{host: "acme.people.example:8080"}, "acme", nil},
+		{open, tenantSource{host: "people.example"}, defaultTenant, nil},
+		{open, tenantSource{host: "a.b.people.example"}, defaultTenant, nil},
+		{open, tenantSource{header: "acme", host: "ACME.people.example"}, "acme", nil},
+		{open, tenantSource{header: "acme", host: "globex.people.example"}, "", errTenantMismatch},
+		{open, tenantSource{header: "Acme!"}, "", &invalid},
+		{required, tenantSource{}, "", errTenantRequired},
+		{required, tenantSource{host: "acme.people.example"}, "acme", nil},
+		{tokens, tenantSource{authorization: acme}, "acme", nil},
+		{tokens, tenantSource{authorization: acme, header: "acme"}, "acme", nil},
+		{tokens, tenantSource{authorization: acme, header: "globex"}, "", errTenantMismatch},
+		{tokens, tenantSource{header: "acme"}, "", errInvalidToken},
+		{tokens, tenantSource{authorization: expired}, "", errInvalidToken},
+		{tokens, tenantSource{authorization: forged}, "", errInvalidToken},
+		{tokens, tenantSource{authorization: noTenant}, "", errInvalidToken},
+		{tokens, tenantSource{authorization: "Bearer not.a.jwt"}, "", errInvalidToken},
+	} {
+		id, err := tc.tr.resolve(tc.src)
+		tenant := id.tenant
+		switch experr := tc.experr.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("got error %v for %+v but expected none", err, tc.src)
+			}
+		case error:
+			if !errors.Is(err, experr) {
+				t.Errorf("got error %v for %+v but expected %v", err, tc.src, experr)
+			}
+		default:
+			if !errors.As(err, experr) {
+				t.Errorf("got error %v for %+v but expected a validation error", err, tc.src)
+			}
+		}
+		if tenant != tc.exp {
+			t.Errorf("got tenant %q for %+v but expected %q", tenant, tc.src, tc.exp)
+		}
+	}
+}
+
+func Test_tenantMw(t *testing.T) {
+	ms := NewMemoryStore(0)
+	actx := AppContext{
+		storer:  &ms,
+		timeout: 30 * time.Millisecond,
+		logger:  noopLogger{},
+		tenants: tenantResolver{secret: []byte("s3cret"), required: true},
+	}
+	server := httptest.NewServer(NewHandler(actx))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path          string
+		authorization string
+		header        string
+		exp           int
+	}{
+		{"/people", "", "", http.StatusUnauthorized},
+		{"/people", signToken("guess", `{"tenant_id": "acme"}`), "", http.StatusUnauthorized},
+		{"/people", signToken("s3cret", `{"tenant_id": "acme"}`), "globex", http.StatusForbidden},
+		{"/people", signToken("s3cret", `{"tenant_id": "acme"}`), "", http.StatusOK},
+		{"/people", signToken("s3cret", `{"tenant_id": "acme"}`), "Acme!", http.StatusBadRequest},
+		{"/openapi.json", "", "", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+tc.path, nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		if tc.header != "" {
+			req.Header.Set("X-Tenant-ID", tc.header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during GET %s: %s", tc.path, err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.exp {
+			t.Errorf("got status %d for %+v but expected %d", res.StatusCode, tc, tc.exp)
+		}
+		if res.StatusCode == http.StatusUnauthorized && res.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("got no WWW-Authenticate for %+v", tc)
+		}
+	}
+}
+
+func Test_tenantIsolation(t *testing.T) {
+	ms := NewMemoryStore(0)
+	actx := AppContext{
+		storer:  &ms,
+		timeout: 30 * time.Millisecond,
+		logger:  noopLogger{},
+		tenants: tenantResolver{trustHeaders: true},
+	}
+	server := httptest.NewServer(NewHandler(actx))
+	defer server.Close()
+
+	do := func(tenant, method, path, body string, expstatus int, v any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during %s %s: %s", method, path, err.Error())
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != expstatus {
+			t.Fatalf("got status %d for %s %s of %q but expected %d", res.StatusCode, method, path, tenant, expstatus)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("error during decode: %s", err.Error())
+			}
+		}
+	}
+
+	// acme starts out empty, and its IDs are its own.
+	var people []Person
+	do("acme", "GET", "/people", "", http.StatusOK, &people)
+	if len(people) != 0 {
+		t.Errorf("got people %+v for a new tenant but expected none", people)
+	}
+	do("acme", "GET", "/people/1", "", http.StatusNotFound, nil)
+	do("acme", "POST", "/people", `{"id": 1, "firstname": "Wile", "lastname": "Coyote", "email": "wile@acme.example"}`, http.StatusOK, nil)
+	do("acme", "POST", "/people", `{"id": 4, "firstname": "Road", "lastname": "Runner"}`, http.StatusOK, nil)
+
+	var p Person
+	do("", "GET", "/people/1", "", http.StatusOK, &p)
+	if p.FirstName != "Bob" {
+		t.Errorf("got %+v but expected the default tenant's Bob", p)
+	}
+	do("acme", "GET", "/people/1", "", http.StatusOK, &p)
+	if p.FirstName != "Wile" {
+		t.Errorf("got %+v but expected acme's Wile", p)
+	}
+
+	// Neither tenant can reach the other's people.
+	do("", "GET", "/people/4", "", http.StatusNotFound, nil)
+	do("", "PATCH", "/people/4", `{"firstname": "Taken"}`, http.StatusNotFound, nil)
+	do("", "DELETE", "/people/4", "", http.StatusNotFound, nil)
+	do("globex", "GET", "/people/4", "", http.StatusNotFound, nil)
+	do("", "GET", "/people", "", http.StatusOK, &people)
+	if len(people) != 3 {
+		t.Errorf("got people %+v but expected only the default tenant's 3", people)
+	}
+
+	// Emails are only unique within a tenant.
+	do("", "POST", "/people", `{"id": 5, "firstname": "Wile", "lastname": "E", "email": "wile@acme.example"}`, http.StatusOK, nil)
+
+	do("acme", "POST", "/people/4/addresses", `{"line1": "1 Desert Rd", "city": "Mesa", "country": "US"}`, http.StatusOK, nil)
+	do("", "GET", "/people/4/addresses", "", http.StatusNotFound, nil)
+
+	do("acme", "POST", "/webhooks", `{"url": "http://acme.example/hook", "secret": "s3cret"}`, http.StatusOK, nil)
+	var webhooks []webhook
+	do("", "GET", "/webhooks", "", http.StatusOK, &webhooks)
+	if len(webhooks) != 0 {
+		t.Errorf("got webhooks %+v but expected none outside acme", webhooks)
+	}
+	do("", "GET", "/webhooks/1", "", http.StatusNotFound, nil)
+
+	tenants, err := ms.tenantIDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// globex only read, so the store never kept it.
+	if strings.Join(tenants, ",") != "acme,default" {
+		t.Errorf("got tenants %v but expected acme and default", tenants)
+	}
+}
+
+// checkStoreTenantIsolation writes through s as the tenant in a and checks
+// that every read through s as the tenant in b, a tenant with nothing
+// written yet, comes back empty, that b can't change a's data, and that a
+// ctx without a tenant can neither read nor write anything.
+func checkStoreTenantIsolation(t *testing.T, s Storer, a, b context.Context) {
+	t.Helper()
+
+	manager, err := s.addPerson(a, Person{ID: 1, FirstName: "Wile", LastName: "Coyote"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.addPerson(a, Person{ID: 2, FirstName: "Road", LastName: "Runner", Attributes: map[string]any{"team": "acme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := s.addAddress(a, p.ID, address{Line1: "1 Desert Rd", City: "Mesa", Country: "US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := s.addRelationship(a, relationship{PersonID: p.ID, RelatedID: manager.ID, Type: relationshipManager})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.putAttributeSchema(a, attributeSchema{Key: "team", Schema: json.RawMessage(`{"type": "string"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	wh, err := s.addWebhook(a, webhook{URL: "http://acme.example/hook", Secret: "s3cret", Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The webhook only hears of people added after it.
+	if _, err := s.addPerson(a, Person{ID: 3, FirstName: "Acme", LastName: "Corp"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.reserveIdempotencyKey(a, idempotencyRecord{Key: "abc", Fingerprint: "f", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := func(method string, n int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Errorf("got error %v from %s but expected none", err, method)
+		} else if n != 0 {
+			t.Errorf("got %d results from %s of another tenant but expected none", n, method)
+		}
+	}
+	notFound := func(method string, err error, exp error) {
+		t.Helper()
+		if !errors.Is(err, exp) {
+			t.Errorf("got error %v from %s of another tenant but expected %v", err, method, exp)
+		}
+	}
+
+	var seen int
+	err = s.eachPerson(b, personQuery{IncludeDeleted: true}, func(Person) error { seen++; return nil })
+	empty("eachPerson", seen, err)
+	page, err := s.pagePeople(b, personFilter{}, 0, 10)
+	empty("pagePeople", len(page.People)+page.Total, err)
+	_, err = s.personForID(b, p.ID, personQuery{IncludeDeleted: true})
+	notFound("personForID", err, errPersonNotFound)
+	people, err := s.peopleForIDs(b, []int{manager.ID, p.ID})
+	empty("peopleForIDs", len(people), err)
+	results, err := s.searchPeople(b, "Runner", 10)
+	empty("searchPeople", len(results), err)
+	events, err := s.personHistory(b, p.ID)
+	empty("personHistory", len(events), err)
+	changes, err := s.changesSince(b, changeCursor{}, 10)
+	empty("changesSince", len(changes), err)
+	if cursor, err := s.latestChangeCursor(b); err != nil || cursor != (changeCursor{}) {
+		t.Errorf("got cursor %v and error %v from latestChangeCursor of another tenant but expected neither", cursor, err)
+	}
+	_, err = s.personAddresses(b, p.ID)
+	notFound("personAddresses", err, errPersonNotFound)
+	_, err = s.addressForID(b, p.ID, addr.ID)
+	notFound("addressForID", err, errPersonNotFound)
+	_, err = s.personRelationships(b, p.ID, "")
+	notFound("personRelationships", err, errPersonNotFound)
+	_, err = s.reportsUnder(b, manager.ID)
+	notFound("reportsUnder", err, errPersonNotFound)
+	schemas, err := s.attributeSchemas(b)
+	empty("attributeSchemas", len(schemas), err)
+	_, err = s.attributeSchemaForKey(b, "team")
+	notFound("attributeSchemaForKey", err, errAttributeSchemaNotFound)
+	webhooks, err := s.allWebhooks(b)
+	empty("allWebhooks", len(webhooks), err)
+	_, err = s.webhookForID(b, wh.ID)
+	notFound("webhookForID", err, errWebhookNotFound)
+	deliveries, err := s.webhookDeliveries(b, 0, "", 10)
+	empty("webhookDeliveries", len(deliveries), err)
+	deliveries, err = s.claimWebhookDeliveries(b, 10, time.Minute)
+	empty("claimWebhookDeliveries", len(deliveries), err)
+	if rec, ok, err := s.reserveIdempotencyKey(b, idempotencyRecord{Key: "abc", Fingerprint: "g", ExpiresAt: time.Now().Add(time.Hour)}); err != nil || !ok {
+		t.Errorf("got record %+v from reserveIdempotencyKey of another tenant but expected to reserve its own", rec)
+	}
+
+	// Nor can b change any of it.
+	_, err = s.updatePerson(b, p.ID, Person{FirstName: "Taken", LastName: "Over"}, 1)
+	notFound("updatePerson", err, errPersonNotFound)
+	err = s.deletePerson(b, p.ID, 1)
+	notFound("deletePerson", err, errPersonNotFound)
+	_, err = s.updateAddress(b, p.ID, addr.ID, address{Line1: "2 Desert Rd", City: "Mesa", Country: "US"})
+	notFound("updateAddress", err, errPersonNotFound)
+	err = s.deleteRelationship(b, p.ID, rel.ID)
+	notFound("deleteRelationship", err, errPersonNotFound)
+	err = s.deleteAttributeSchema(b, "team")
+	notFound("deleteAttributeSchema", err, errAttributeSchemaNotFound)
+	_, err = s.updateWebhook(b, wh.ID, webhook{URL: "http://evil.example/hook"})
+	notFound("updateWebhook", err, errWebhookNotFound)
+	err = s.deleteWebhook(b, wh.ID)
+	notFound("deleteWebhook", err, errWebhookNotFound)
+
+	if got, err := s.personForID(a, p.ID, personQuery{}); err != nil || got.FirstName != "Road" {
+		t.Errorf("got %+v and error %v but expected the tenant's own person untouched", got, err)
+	}
+	if got, err := s.webhookForID(a, wh.ID); err != nil || got.URL != "http://acme.example/hook" {
+		t.Errorf("got %+v and error %v but expected the tenant's own webhook untouched", got, err)
+	}
+
+	// A ctx without a tenant sees no one's data and can't write.
+	none := context.Background()
+	seen = 0
+	s.eachPerson(none, personQuery{IncludeDeleted: true}, func(Person) error { seen++; return nil })
+	if seen != 0 {
+		t.Errorf("got %d people without a tenant but expected none", seen)
+	}
+	if webhooks, _ := s.allWebhooks(none); len(webhooks) != 0 {
+		t.Errorf("got webhooks %+v without a tenant but expected none", webhooks)
+	}
+	if _, err := s.addPerson(none, Person{FirstName: "No", LastName: "One"}); err == nil {
+		t.Errorf("expected adding a person without a tenant to fail")
+	}
+}
+
+func Test_MemoryStoreTenantIsolation(t *testing.T) {
+	ms := NewMemoryStore(0)
+	checkStoreTenantIsolation(t, &ms, withTenant(context.Background(), "acme"), withTenant(context.Background(), "globex"))
+
+	tenants, err := ms.tenantIDs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(tenants, ",") != "acme,default,globex" {
+		t.Errorf("got tenants %v but expected acme, default and globex", tenants)
+	}
+}
+
+func Test_webhookDispatcherTenants(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	rs := httptest.NewServer(receiver)
+	defer rs.Close()
+
+	ms := NewMemoryStore(0)
+	acme := withTenant(context.Background(), "acme")
+	if _, err := ms.addWebhook(acme, webhook{URL: rs.URL, Secret: "s3cret", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ctx := range []context.Context{withTenant(context.Background(), defaultTenant), acme} {
+		if _, err := ms.addPerson(ctx, Person{ID: 10, FirstName: "Foo", LastName: "Bar"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := newTestDispatcher(&ms).dispatchOnce(context.Background()); n != 1 {
+		t.Fatalf("got %d deliveries but expected only acme's create", n)
+	}
+
+	deliveries, err := ms.webhookDeliveries(acme, 1, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != "delivered" {
+		t.Errorf("got deliveries %+v but expected acme's create delivered", deliveries)
+	}
+}
+
+func Test_changeBrokerTenants(t *testing.T) {
+	ms := NewMemoryStore(0)
+	broker := newChangeBroker(&ms, noopLogger{}, time.Second)
+
+	sub, err := broker.subscribe(withTenant(context.Background(), "acme"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.publish(defaultTenant, changeEvent{Cursor: changeCursor{ID: 1}})
+	broker.publish("acme", changeEvent{Cursor: changeCursor{ID: 2}})
+	broker.unsubscribe(sub)
+
+	var ids []int64
+	for e := range sub.events {
+		ids = append(ids, e.Cursor.ID)
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Errorf("got events %v but expected only acme's", ids)
+	}
+}
+
+func Test_tenantMwActor(t *testing.T) {
+	ms := NewMemoryStore(0)
+	actx := AppContext{
+		storer:  &ms,
+		timeout: time.Second,
+		logger:  noopLogger{},
+		tenants: tenantResolver{secret: []byte("s3cret")},
+	}
+	server := httptest.NewServer(NewHandler(actx))
+	defer server.Close()
+
+	for i, token := range []string{
+		signToken("s3cret", `{"tenant_id": "acme", "sub": "alice"}`),
+		signToken("s3cret", `{"tenant_id": "acme"}`),
+	} {
+		req, _ := http.NewRequest("POST", server.URL+"/people", strings.NewReader(`{"firstname": "Foo", "lastname": "Bar", "id": `+strconv.Itoa(i+10)+`}`))
+		req.Header.Set("Authorization", token)
+		req.Header.Set("X-Actor", "mallory")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during POST: %s", err.Error())
+		}
+		res.Body.Close()
+	}
+
+	// The token names the actor, and without a subject nobody is named.
+	for id, exp := range map[int]string{10: "alice", 11: anonymousActor} {
+		events, err := ms.personHistory(withTenant(context.Background(), "acme"), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].Actor != exp {
+			t.Errorf("got events %+v for %d but expected a create by %s", events, id, exp)
+		}
+	}
+}
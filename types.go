@@ -1,8 +1,95 @@
 package main
 
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dateLayout is how dates of birth are written.
+const dateLayout = "2006-01-02"
+
+// e164 matches a phone number in E.164 form: a plus sign and up to 15
+// digits, the first of which is not 0.
+var e164 = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
 type Person struct {
-	ID        int    `json:"id"`
-	FirstName string `json:"firstname"`
-	LastName  string `json:"lastname"`
-	Age       int    `json:"age"`
+	ID        int    `json:"id" xml:"id" yaml:"id"`
+	FirstName string `json:"firstname" xml:"firstname" yaml:"firstname"`
+	LastName  string `json:"lastname" xml:"lastname" yaml:"lastname"`
+	Age       int    `json:"age" xml:"age" yaml:"age"`
+	Version   int    `json:"version" xml:"version" yaml:"version"`
+
+	// The contact details are optional. Email is unique across people, and
+	// a person with a DateOfBirth has their Age derived from it.
+	Email       string `json:"email,omitempty" xml:"email,omitempty" yaml:"email,omitempty"`
+	Phone       string `json:"phone,omitempty" xml:"phone,omitempty" yaml:"phone,omitempty"`
+	DateOfBirth string `json:"date_of_birth,omitempty" xml:"date_of_birth,omitempty" yaml:"date_of_birth,omitempty"`
+
+	// Attributes are the custom fields; see attributes.
+	Attributes attributes `json:"attributes,omitempty" xml:"attributes,omitempty" yaml:"attributes,omitempty"`
+
+	// DeletedAt is set while the person is soft deleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty" yaml:"deleted_at,omitempty"`
+}
+
+// validatePerson checks the fields every stored person must have.
+func validatePerson(p Person) error {
+	if strings.TrimSpace(p.FirstName) == "" {
+		return &validationError{Name: "firstname", Reason: "is required"}
+	}
+
+	if strings.TrimSpace(p.LastName) == "" {
+		return &validationError{Name: "lastname", Reason: "is required"}
+	}
+
+	if p.Age < 0 {
+		return &validationError{Name: "age", Reason: "must not be negative"}
+	}
+
+	return validateContact(p)
+}
+
+// validateContact checks the format of the contact details that are set.
+func validateContact(p Person) error {
+	if p.Email != "" {
+		if a, err := mail.ParseAddress(p.Email); err != nil || a.Address != p.Email {
+			return &validationError{Name: "email", Reason: "must be an email address"}
+		}
+	}
+
+	if p.Phone != "" && !e164.MatchString(p.Phone) {
+		return &validationError{Name: "phone", Reason: "must be an E.164 number such as +14155550123"}
+	}
+
+	if p.DateOfBirth != "" {
+		dob, err := time.Parse(dateLayout, p.DateOfBirth)
+		if err != nil {
+			return &validationError{Name: "date_of_birth", Reason: "must be a date such as 1990-04-30"}
+		}
+		if dob.After(time.Now()) {
+			return &validationError{Name: "date_of_birth", Reason: "must not be in the future"}
+		}
+	}
+
+	return nil
+}
+
+// deriveAge sets Age from DateOfBirth as of now, leaving people without a
+// date of birth alone.
+func (p *Person) deriveAge(now time.Time) {
+	dob, err := time.Parse(dateLayout, p.DateOfBirth)
+	if err != nil {
+		return
+	}
+
+	age := now.Year() - dob.Year()
+	if now.Month() < dob.Month() || (now.Month() == dob.Month() && now.Day() < dob.Day()) {
+		age--
+	}
+	if age < 0 {
+		age = 0
+	}
+	p.Age = age
 }
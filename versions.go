@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The unversioned routes are the v1 routes under their old paths. They keep
+// working until legacySunset, and every response to one says so.
+var (
+	legacyDeprecation = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset      = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// defaultVersion serves unversioned requests that don't ask for a version.
+const defaultVersion = "v1"
+
+// apiRoute is a route of one API version, with its pattern relative to the
+// version's /v1 or /v2 prefix.
+type apiRoute struct {
+	method  string
+	pattern string
+	handler appHandler
+}
+
+// apiVersion is an API version served under /<name>. Every version runs
+// against the same Storer; a new version starts from the routes of the one
+// before and replaces the handlers whose behavior changes.
+type apiVersion struct {
+	name   string
+	routes func() []apiRoute
+}
+
+var apiVersions = []apiVersion{
+	{name: "v1", routes: v1Routes},
+	{name: "v2", routes: v2Routes},
+}
+
+func v1Routes() []apiRoute {
+	return []apiRoute{
+		{"GET", "/people", handlePeopleGET},
+		{"POST", "/people", idempotent(handlePeoplePOST)},
+		{"GET", "/people/changes", handlePeopleChangesGET},
+		{"GET", "/people/events", handlePeopleEventsGET},
+		{"GET", "/people/search", handlePeopleSearchGET},
+		{"POST", "/people/import", handlePeopleImportPOST},
+		{"POST", "/people:batch", idempotent(handlePeopleBatchPOST)},
+		{"GET", "/people/{id:int}", handlePersonGET},
+		{"PUT", "/people/{id:int}", handlePersonPUT},
+		{"PATCH", "/people/{id:int}", handlePersonPATCH},
+		{"DELETE", "/people/{id:int}", handlePersonDELETE},
+		{"POST", "/people/{id:int}:restore", handlePersonRestorePOST},
+		{"GET", "/people/{id:int}/history", handlePersonHistoryGET},
+		{"GET", "/people/{id:int}/addresses", handlePersonAddressesGET},
+		{"POST", "/people/{id:int}/addresses", handlePersonAddressesPOST},
+		{"GET", "/people/{id:int}/addresses/{addressID:int}", handlePersonAddressGET},
+		{"PUT", "/people/{id:int}/addresses/{addressID:int}", handlePersonAddressPUT},
+		{"DELETE", "/people/{id:int}/addresses/{addressID:int}", handlePersonAddressDELETE},
+		{"GET", "/people/{id:int}/relationships", handlePersonRelationshipsGET},
+		{"POST", "/people/{id:int}/relationships", handlePersonRelationshipsPOST},
+		{"DELETE", "/people/{id:int}/relationships/{relationshipID:int}", handlePersonRelationshipDELETE},
+		{"GET", "/people/{id:int}/reports", handlePersonReportsGET},
+		{"GET", "/admin/attributes", handleAttributeSchemasGET},
+		{"GET", "/admin/attributes/{key}", handleAttributeSchemaGET},
+		{"PUT", "/admin/attributes/{key}", handleAttributeSchemaPUT},
+		{"DELETE", "/admin/attributes/{key}", handleAttributeSchemaDELETE},
+		{"GET", "/webhooks", handleWebhooksGET},
+		{"POST", "/webhooks", handleWebhooksPOST},
+		{"GET", "/webhooks/dead_letters", handleWebhookDeadLettersGET},
+		{"GET", "/webhooks/{id:int}", handleWebhookGET},
+		{"PUT", "/webhooks/{id:int}", handleWebhookPUT},
+		{"DELETE", "/webhooks/{id:int}", handleWebhookDELETE},
+		{"GET", "/webhooks/{id:int}/deliveries", handleWebhookDeliveriesGET},
+	}
+}
+
+// v2Routes starts out identical to v1. Changes that would break v1 clients
+// go here as replacement handlers, leaving v1Routes as it is.
+func v2Routes() []apiRoute {
+	return overrideRoutes(v1Routes())
+}
+
+// overrideRoutes returns routes with the handlers of any matching method and
+// pattern in overrides replaced, and the rest of overrides added.
+func overrideRoutes(routes []apiRoute, overrides ...apiRoute) []apiRoute {
+	out := append([]apiRoute{}, routes...)
+	for _, o := range overrides {
+		replaced := false
+		for i, r := range out {
+			if r.method == o.method && r.pattern == o.pattern {
+				out[i], replaced = o, true
+			}
+		}
+		if !replaced {
+			out = append(out, o)
+		}
+	}
+
+	return out
+}
+
+// mountVersions registers every version under its prefix, and the v1 routes
+// under their unversioned paths too. An unversioned request can pick its
+// version with a version parameter on the Accept media type, as in
+// "application/json; version=2"; one that doesn't gets the default version
+// with Deprecation, Sunset and successor Link headers.
+func mountVersions(rt *router) {
+	handlers := map[string]map[string]appHandler{}
+	for _, v := range apiVersions {
+		handlers[v.name] = map[string]appHandler{}
+		for _, r := range v.routes() {
+			rt.handle(r.method, "/"+v.name+r.pattern, r.handler)
+			handlers[v.name][r.method+" "+r.pattern] = r.handler
+		}
+	}
+
+	for _, r := range v1Routes() {
+		rt.handle(r.method, r.pattern, unversioned(r.method+" "+r.pattern, handlers))
+	}
+}
+
+func unversioned(key string, handlers map[string]map[string]appHandler) appHandler {
+	return func(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+		version, err := acceptVersion(r)
+		if err != nil {
+			writeError(w, r, http.StatusNotAcceptable, err)
+			return
+		}
+
+		if version == "" {
+			version = defaultVersion
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecation.Unix(), 10))
+			w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+			w.Header().Add("Link", fmt.Sprintf("</%s%s>; rel=\"successor-version\"", version, r.URL.Path))
+		}
+
+		h, ok := handlers[version][key]
+		if !ok {
+			writeError(w, r, http.StatusNotAcceptable, fmt.Errorf("%s is not served by API %s", key, version))
+			return
+		}
+
+		h(actx, w, r)
+	}
+}
+
+// acceptVersion returns the API version named by the first Accept media type
+// with a version parameter, or "" when there is none. Both version=2 and
+// version=v2 name v2.
+func acceptVersion(r *http.Request) (string, error) {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mt := range strings.Split(accept, ",") {
+			_, params, err := mime.ParseMediaType(strings.TrimSpace(mt))
+			if err != nil {
+				continue
+			}
+
+			v, ok := params["version"]
+			if !ok {
+				continue
+			}
+			if !strings.HasPrefix(v, "v") {
+				v = "v" + v
+			}
+			for _, known := range apiVersions {
+				if known.name == v {
+					return v, nil
+				}
+			}
+			return "", fmt.Errorf("Unsupported API version: %q", params["version"])
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_versionedRoutes(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		path       string
+		accept     string
+		expstatus  int
+		deprecated bool
+	}{
+		{"/v1/people/1", "", http.StatusOK, false},
+		{"/v2/people/1", "", http.StatusOK, false},
+		{"/people/1", "", http.StatusOK, true},
+		{"/people/1", "application/json; version=2", http.StatusOK, false},
+		{"/people/1", "application/json;version=v1", http.StatusOK, false},
+		{"/people/1", "text/html, application/json; version=2", http.StatusOK, false},
+		{"/people/1", "application/json; version=9", http.StatusNotAcceptable, false},
+		{"/v3/people/1", "", http.StatusNotFound, false},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+tc.path, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error during http.Get: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != tc.expstatus {
+			t.Errorf("got status %d for %s with Accept %q but expected %d", res.StatusCode, tc.path, tc.accept, tc.expstatus)
+		}
+
+		deprecated := res.Header.Get("Deprecation") != "" && res.Header.Get("Sunset") != ""
+		if deprecated != tc.deprecated {
+			t.Errorf("got Deprecation %q and Sunset %q for %s with Accept %q but expected deprecated to be %t",
+				res.Header.Get("Deprecation"), res.Header.Get("Sunset"), tc.path, tc.accept, tc.deprecated)
+		}
+
+		if tc.deprecated {
+			if link := res.Header.Get("Link"); link != `</v1/people/1>; rel="successor-version"` {
+				t.Errorf("got Link %q but expected the /v1 successor", link)
+			}
+		}
+	}
+}
+
+func Test_overrideRoutes(t *testing.T) {
+	var called string
+	handler := func(name string) appHandler {
+		return func(actx *AppContext, w http.ResponseWriter, r *http.Request) { called = name }
+	}
+
+	routes := overrideRoutes(
+		[]apiRoute{{"GET", "/a", handler("old a")}, {"GET", "/b", handler("old b")}},
+		apiRoute{"GET", "/a", handler("new a")},
+		apiRoute{"POST", "/a", handler("post a")},
+	)
+
+	var got []string
+	for _, r := range routes {
+		r.handler(nil, nil, nil)
+		got = append(got, r.method+" "+r.pattern+" "+called)
+	}
+
+	exp := []string{"GET /a new a", "GET /b old b", "POST /a post a"}
+	if len(got) != len(exp) {
+		t.Fatalf("got routes %v but expected %v", got, exp)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("got routes %v but expected %v", got, exp)
+		}
+	}
+}
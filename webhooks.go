@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+
+	defaultDeliveriesLimit = 100
+
+	// webhookMaxAttempts is how many times a delivery is tried before it is
+	// moved to the dead letters.
+	webhookMaxAttempts = 10
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+
+	// webhookLease is how long a claimed delivery is hidden from other
+	// dispatchers. It must outlast webhookRequestTimeout.
+	webhookLease          = time.Minute
+	webhookRequestTimeout = 10 * time.Second
+	webhookConcurrency    = 8
+
+	// webhookDrainBytes is how much of a response body is read and thrown
+	// away so its connection can be reused.
+	webhookDrainBytes = 64 << 10
+)
+
+var errWebhookDestination = errors.New("webhook destination is not a public address")
+
+// webhook is a subscription to change events. An empty Events receives every
+// event type. Secret signs each delivery and is only shown when the webhook
+// is created.
+type webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wants reports whether the webhook should receive events of type event.
+func (wh webhook) wants(event string) bool {
+	if !wh.Active {
+		return false
+	}
+
+	if len(wh.Events) == 0 {
+		return true
+	}
+
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// webhookDelivery is one change event queued for one webhook. Stores queue a
+// delivery for every active webhook wanting the event in the same write as
+// the change, and the dispatcher works through them. EventID is the same for
+// every webhook told about a change, so receivers can drop duplicates.
+type webhookDelivery struct {
+	ID            int64      `json:"id"`
+	WebhookID     int        `json:"webhook_id"`
+	EventID       int64      `json:"event_id"`
+	Event         string     `json:"event"`
+	PersonID      int        `json:"person_id"`
+	Person        *Person    `json:"person"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+
+	// URL and Secret are the webhook's, filled in when a delivery is claimed.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// webhookPayload is the body POSTed to a webhook.
+type webhookPayload struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	PersonID  int       `json:"person_id"`
+	Person    *Person   `json:"person"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// signWebhook signs a delivery body for the X-Webhook-Signature header. The
+// timestamp is signed along with the body so a captured request can't be
+// replayed later with a fresh timestamp.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// webhookBackoff is the delay before retrying a delivery that has failed
+// attempts times: exponential from webhookBaseBackoff, capped at
+// webhookMaxBackoff, with up to 10% jitter so retries don't arrive together.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookMaxBackoff
+	if attempts < 20 {
+		d = webhookBaseBackoff << (attempts - 1)
+		if d > webhookMaxBackoff {
+			d = webhookMaxBackoff
+		}
+	}
+
+	return d + time.Duration(mrand.Int63n(int64(d/10)+1))
+}
+
+func validateWebhook(wh webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid webhook url: %q", wh.URL)
+	}
+
+	for _, e := range wh.Events {
+		known := false
+		for _, t := range sseEventTypes {
+			known = known || t == e
+		}
+		if !known {
+			return fmt.Errorf("Unknown webhook event: %q", e)
+		}
+	}
+
+	return nil
+}
+
+func handleWebhooksGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	webhooks, err := actx.storer.allWebhooks(ctx)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	if webhooks == nil {
+		webhooks = []webhook{}
+	}
+
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+// handleWebhooksPOST subscribes a URL to change events. A secret is generated
+// when the request doesn't supply one; either way it is returned only here.
+func handleWebhooksPOST(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	wh := webhook{URL: req.URL, Secret: req.Secret, Events: req.Events, Active: req.Active == nil || *req.Active}
+	if err := validateWebhook(wh); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if wh.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			writeInternalError(actx, w, r, err)
+			return
+		}
+		wh.Secret = secret
+	}
+
+	if wh.Events == nil {
+		wh.Events = []string{}
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	created, err := actx.storer.addWebhook(ctx, wh)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, created)
+}
+
+func handleWebhookGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	wh, err := actx.storer.webhookForID(ctx, id)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	wh.Secret = ""
+	writeJSON(w, http.StatusOK, *wh)
+}
+
+// handleWebhookPUT replaces a webhook. Leaving out the secret keeps the
+// current one.
+func handleWebhookPUT(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	wh := webhook{URL: req.URL, Secret: req.Secret, Events: req.Events, Active: req.Active == nil || *req.Active}
+	if err := validateWebhook(wh); err != nil {
+		writeError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	if wh.Events == nil {
+		wh.Events = []string{}
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	updated, err := actx.storer.updateWebhook(ctx, id, wh)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	updated.Secret = ""
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// handleWebhookDELETE removes a webhook along with its queued deliveries and
+// delivery log.
+func handleWebhookDELETE(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	id := pathInt(r, "id")
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	if err := actx.storer.deleteWebhook(ctx, id); err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// handleWebhookDeliveriesGET lists a webhook's deliveries, optionally only
+// those in the status query parameter.
+func handleWebhookDeliveriesGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	listWebhookDeliveries(actx, w, r, pathInt(r, "id"), r.URL.Query().Get("status"))
+}
+
+// handleWebhookDeadLettersGET lists the deliveries of every webhook that ran
+// out of attempts.
+func handleWebhookDeadLettersGET(actx *AppContext, w http.ResponseWriter, r *http.Request) {
+	listWebhookDeliveries(actx, w, r, 0, deliveryDead)
+}
+
+// listWebhookDeliveries lists deliveries newest first, for one webhook or for
+// all of them when webhookID is 0, optionally only those in status.
+func listWebhookDeliveries(actx *AppContext, w http.ResponseWriter, r *http.Request, webhookID int, status string) {
+	switch status {
+	case "", deliveryPending, deliveryDelivered, deliveryDead:
+	default:
+		writeError(w, r, http.StatusBadRequest, fmt.Errorf("Unknown delivery status: %q", status))
+		return
+	}
+
+	limit := defaultDeliveriesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxChangesLimit {
+			writeError(w, r, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxChangesLimit))
+			return
+		}
+	}
+
+	ctx := r.Context()
+	ctx, cancel := context.WithTimeout(ctx, actx.timeout)
+	defer cancel()
+
+	if webhookID != 0 {
+		if _, err := actx.storer.webhookForID(ctx, webhookID); err != nil {
+			writeStoreError(actx, w, r, err)
+			return
+		}
+	}
+
+	deliveries, err := actx.storer.webhookDeliveries(ctx, webhookID, status, limit)
+	if err != nil {
+		writeStoreError(actx, w, r, err)
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = []webhookDelivery{}
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// webhookDispatcher sends queued deliveries. Deliveries are claimed with a
+// lease before being sent, so several replicas can dispatch from the same
+// queue, and one whose dispatcher dies part way is sent again once the lease
+// runs out.
+type webhookDispatcher struct {
+	storer      Storer
+	logger      logger
+	timeout     time.Duration
+	broker      *changeBroker
+	client      *http.Client
+	maxAttempts int
+	backoff     func(attempts int) time.Duration
+}
+
+func newWebhookDispatcher(actx AppContext) *webhookDispatcher {
+	return &webhookDispatcher{
+		storer:      actx.storer,
+		logger:      actx.logger,
+		timeout:     actx.timeout,
+		broker:      actx.broker,
+		client:      newWebhookClient(),
+		maxAttempts: webhookMaxAttempts,
+		backoff:     webhookBackoff,
+	}
+}
+
+// newWebhookClient returns the client deliveries are sent with. Anyone can
+// register a webhook, so it refuses to connect to loopback, private and
+// link-local addresses, which would let a caller reach the server's own
+// network. The check is made on the address actually dialled, after DNS, so
+// a public name resolving to a private address is refused too. Redirects are
+// not followed, and a delivery answered with one fails.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: webhookDialControl,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   webhookRequestTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	addr := ap.Addr().Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return fmt.Errorf("%w: %s", errWebhookDestination, addr)
+	}
+
+	return nil
+}
+
+// run dispatches until ctx is done, every interval and whenever the broker
+// hears of a write.
+func (wd *webhookDispatcher) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var written <-chan struct{}
+	if wd.broker != nil {
+		written = wd.broker.written
+	}
+
+	for {
+		for wd.dispatchOnce(ctx) >= webhookConcurrency {
+		}
+
+		select {
+		case <-written:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// dispatchOnce sends the deliveries that are due for each tenant, up to
+// webhookConcurrency of a tenant's at a time, and returns how many it
+// claimed.
+func (wd *webhookDispatcher) dispatchOnce(ctx context.Context) int {
+	tenantsCtx, cancel := context.WithTimeout(ctx, wd.timeout)
+	tenants, err := wd.storer.tenantIDs(tenantsCtx)
+	cancel()
+	if err != nil {
+		wd.logger.error(fmt.Errorf("listing tenants for webhook deliveries: %w", err))
+		return 0
+	}
+
+	claimed := 0
+	for _, tenant := range tenants {
+		claimed += wd.dispatchTenant(withTenant(ctx, tenant))
+	}
+
+	return claimed
+}
+
+// dispatchTenant sends up to webhookConcurrency due deliveries of the
+// tenant in ctx and returns how many it claimed.
+func (wd *webhookDispatcher) dispatchTenant(ctx context.Context) int {
+	claimCtx, cancel := context.WithTimeout(ctx, wd.timeout)
+	deliveries, err := wd.storer.claimWebhookDeliveries(claimCtx, webhookConcurrency, webhookLease)
+	cancel()
+	if err != nil {
+		wd.logger.error(fmt.Errorf("claiming webhook deliveries: %w", err))
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d webhookDelivery) {
+			defer wg.Done()
+			d = wd.deliver(ctx, d)
+
+			ctx, cancel := context.WithTimeout(withTenant(context.Background(), tenantFromContext(ctx)), wd.timeout)
+			defer cancel()
+			if err := wd.storer.recordWebhookAttempt(ctx, d); err != nil {
+				wd.logger.error(fmt.Errorf("recording webhook delivery %d: %w", d.ID, err))
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	return len(deliveries)
+}
+
+// deliver makes one attempt at d and returns it updated with the outcome.
+// Any 2xx response counts as delivered.
+func (wd *webhookDispatcher) deliver(ctx context.Context, d webhookDelivery) webhookDelivery {
+	d.Attempts++
+	d.LastStatus = 0
+	d.LastError = ""
+
+	err := wd.post(ctx, &d)
+	if err == nil {
+		now := time.Now()
+		d.Status = deliveryDelivered
+		d.DeliveredAt = &now
+		return d
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= wd.maxAttempts {
+		d.Status = deliveryDead
+		return d
+	}
+
+	d.NextAttemptAt = time.Now().Add(wd.backoff(d.Attempts))
+	return d
+}
+
+func (wd *webhookDispatcher) post(ctx context.Context, d *webhookDelivery) error {
+	body, err := json.Marshal(webhookPayload{
+		ID:        d.EventID,
+		Type:      d.Event,
+		PersonID:  d.PersonID,
+		Person:    d.Person,
+		Timestamp: d.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Event-ID", strconv.FormatInt(d.EventID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.Secret, timestamp, body))
+
+	res, err := wd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(res.Body, webhookDrainBytes))
+		res.Body.Close()
+	}()
+
+	d.LastStatus = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New(res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the deliveries it is sent, answering with status.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.received = append(wr.received, r)
+	wr.bodies = append(wr.bodies, body)
+	w.WriteHeader(wr.status)
+}
+
+func createWebhook(t *testing.T, url string, body string) webhook {
+	res, err := http.Post(url+"/webhooks", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error during http.Post: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	var wh webhook
+	if err := json.NewDecoder(res.Body).Decode(&wh); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return wh
+}
+
+func getDeliveries(t *testing.T, url string) []webhookDelivery {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d but expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	var deliveries []webhookDelivery
+	if err := json.NewDecoder(res.Body).Decode(&deliveries); err != nil {
+		t.Fatalf("error during decode: %s", err.Error())
+	}
+
+	return deliveries
+}
+
+func newTestDispatcher(ss Storer) *webhookDispatcher {
+	return &webhookDispatcher{
+		storer:      ss,
+		logger:      noopLogger{},
+		timeout:     time.Second,
+		client:      &http.Client{Timeout: time.Second},
+		maxAttempts: 3,
+		backoff:     func(int) time.Duration { return 0 },
+	}
+}
+
+func Test_handleWebhooks(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	wh := createWebhook(t, server.URL, `{"url": "https://example.com/hook", "events": ["person.created"]}`)
+	if wh.ID == 0 || !wh.Active || len(wh.Secret) != 64 {
+		t.Errorf("got %+v but expected an active webhook with a generated secret", wh)
+	}
+
+	res, err := http.Get(server.URL + "/webhooks")
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	var webhooks []webhook
+	json.NewDecoder(res.Body).Decode(&webhooks)
+	res.Body.Close()
+
+	if len(webhooks) != 1 || webhooks[0].Secret != "" {
+		t.Errorf("got %+v but expected the webhook without its secret", webhooks)
+	}
+
+	id := strconv.Itoa(wh.ID)
+	req, _ := http.NewRequest("PUT", server.URL+"/webhooks/"+id, strings.NewReader(`{"url": "https://example.com/other", "active": false}`))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during PUT: %s", err.Error())
+	}
+	res.Body.Close()
+
+	stored, _ := ms.webhookForID(withTenant(context.Background(), defaultTenant), wh.ID)
+	if stored.URL != "https://example.com/other" || stored.Active || stored.Secret != wh.Secret {
+		t.Errorf("got %+v but expected the new url, inactive, with the secret kept", *stored)
+	}
+
+	req, _ = http.NewRequest("DELETE", server.URL+"/webhooks/"+id, nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during DELETE: %s", err.Error())
+	}
+	res.Body.Close()
+
+	res, err = http.Get(server.URL + "/webhooks/" + id)
+	if err != nil {
+		t.Fatalf("error during http.Get: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d but expected %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func Test_handleWebhooksPOSTInvalid(t *testing.T) {
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	for _, body := range []string{
+		`{"url": "ftp://example.com/hook"}`,
+		`{"url": "/hook"}`,
+		`{"url": "https://example.com/hook", "events": ["person.exploded"]}`,
+	} {
+		res, err := http.Post(server.URL+"/webhooks", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("error during http.Post: %s", err.Error())
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d for %s but expected %d", res.StatusCode, body, http.StatusBadRequest)
+		}
+	}
+}
+
+func Test_webhookDelivery(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	rs := httptest.NewServer(receiver)
+	defer rs.Close()
+
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	wh := createWebhook(t, server.URL, `{"url": "`+rs.URL+`", "secret": "s3cret", "events": ["person.created"]}`)
+
+	postPerson(t, server.URL, `{"id": 10, "firstname": "Foo", "lastname": "Bar"}`)
+	req, _ := http.NewRequest("DELETE", server.URL+"/people/10", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error during DELETE: %s", err.Error())
+	}
+	res.Body.Close()
+
+	if n := newTestDispatcher(&ms).dispatchOnce(context.Background()); n != 1 {
+		t.Fatalf("got %d deliveries but expected only the create", n)
+	}
+
+	if len(receiver.received) != 1 {
+		t.Fatalf("got %d requests but expected 1", len(receiver.received))
+	}
+
+	r, body := receiver.received[0], receiver.bodies[0]
+	timestamp, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	if sig := r.Header.Get("X-Webhook-Signature"); sig != signWebhook("s3cret", timestamp, body) {
+		t.Errorf("got signature %q which does not match the body", sig)
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("error during unmarshal: %s", err.Error())
+	}
+
+	if payload.Type != "person.created" || payload.PersonID != 10 || payload.Person == nil || payload.Person.FirstName != "Foo" {
+		t.Errorf("got payload %+v but expected the create of 10", payload)
+	}
+
+	deliveries := getDeliveries(t, server.URL+"/webhooks/"+strconv.Itoa(wh.ID)+"/deliveries")
+	if len(deliveries) != 1 || deliveries[0].Status != deliveryDelivered || deliveries[0].Attempts != 1 || deliveries[0].LastStatus != http.StatusNoContent {
+		t.Errorf("got deliveries %+v but expected one delivered on the first attempt", deliveries)
+	}
+}
+
+func Test_webhookDeliveryRetriesThenDeadLetters(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusInternalServerError}
+	rs := httptest.NewServer(receiver)
+	defer rs.Close()
+
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	createWebhook(t, server.URL, `{"url": "`+rs.URL+`"}`)
+	postPerson(t, server.URL, `{"id": 10, "firstname": "Foo", "lastname": "Bar"}`)
+
+	wd := newTestDispatcher(&ms)
+	for i := 0; i < 5; i++ {
+		wd.dispatchOnce(context.Background())
+	}
+
+	if len(receiver.received) != wd.maxAttempts {
+		t.Errorf("got %d attempts but expected %d", len(receiver.received), wd.maxAttempts)
+	}
+
+	dead := getDeliveries(t, server.URL+"/webhooks/dead_letters")
+	if len(dead) != 1 || dead[0].Attempts != wd.maxAttempts || dead[0].LastStatus != http.StatusInternalServerError {
+		t.Errorf("got dead letters %+v but expected the create after %d attempts", dead, wd.maxAttempts)
+	}
+}
+
+func Test_webhookDeliveryBackoff(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusServiceUnavailable}
+	rs := httptest.NewServer(receiver)
+	defer rs.Close()
+
+	ms := NewMemoryStore(0)
+	server := httptest.NewServer(newTestHandler(&ms))
+	defer server.Close()
+
+	createWebhook(t, server.URL, `{"url": "`+rs.URL+`"}`)
+	postPerson(t, server.URL, `{"id": 10, "firstname": "Foo", "lastname": "Bar"}`)
+
+	wd := newTestDispatcher(&ms)
+	wd.backoff = webhookBackoff
+	wd.dispatchOnce(context.Background())
+	wd.dispatchOnce(context.Background())
+
+	if len(receiver.received) != 1 {
+		t.Errorf("got %d attempts but expected the retry to wait", len(receiver.received))
+	}
+
+	pending, _ := ms.webhookDeliveries(withTenant(context.Background(), defaultTenant), 0, deliveryPending, 10)
+	if len(pending) != 1 || time.Until(pending[0].NextAttemptAt) < webhookBaseBackoff/2 {
+		t.Errorf("got pending %+v but expected a retry about %s away", pending, webhookBaseBackoff)
+	}
+}
+
+func Test_webhookBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		attempts int
+		min      time.Duration
+	}{
+		{1, webhookBaseBackoff},
+		{2, 2 * webhookBaseBackoff},
+		{3, 4 * webhookBaseBackoff},
+		{50, webhookMaxBackoff},
+	} {
+		d := webhookBackoff(tc.attempts)
+		if d < tc.min || d > tc.min+tc.min/10 {
+			t.Errorf("got %s after %d attempts but expected %s plus up to 10%%", d, tc.attempts, tc.min)
+		}
+	}
+}
+
+func Test_webhookDialControl(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"[2606:2800:220:1::1]:443", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:80", false},
+		{"10.1.2.3:80", false},
+		{"192.168.0.1:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"0.0.0.0:80", false},
+	} {
+		err := webhookDialControl("tcp", tc.address, nil)
+		if (err == nil) != tc.allowed {
+			t.Errorf("got error %v dialling %s but expected allowed %t", err, tc.address, tc.allowed)
+		}
+	}
+}
+
+func Test_webhookClientRefusesLoopback(t *testing.T) {
+	receiver := &webhookReceiver{status: http.StatusOK}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	wd := newTestDispatcher(nil)
+	wd.client = newWebhookClient()
+
+	err := wd.post(context.Background(), &webhookDelivery{URL: server.URL, Event: "person.created"})
+	if !errors.Is(err, errWebhookDestination) {
+		t.Errorf("got error %v but expected %v", err, errWebhookDestination)
+	}
+	if len(receiver.received) != 0 {
+		t.Errorf("got %d deliveries to loopback but expected none", len(receiver.received))
+	}
+}
+
+func Test_MemoryStoreBatchRollbackDropsDeliveries(t *testing.T) {
+	ms := NewMemoryStore(0)
+	ctx := withTenant(context.Background(), defaultTenant)
+	ms.addWebhook(ctx, webhook{URL: "https://example.com/hook", Active: true})
+
+	ms.applyBatch(ctx, []batchOperation{
+		{Op: batchCreate, Person: Person{ID: 10, FirstName: "Foo", LastName: "Bar"}},
+		{Op: batchDelete, ID: 99},
+	}, true)
+
+	deliveries, _ := ms.webhookDeliveries(ctx, 0, "", 10)
+	if len(deliveries) != 0 {
+		t.Errorf("got %d deliveries but expected none for a rolled back batch", len(deliveries))
+	}
+}